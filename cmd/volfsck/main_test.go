@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/peterouob/file_system/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeVolume writes keys 1 to n to a new volume and closes it, it returns the
+// path of the data file.
+func writeVolume(t *testing.T, n uint64) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "bench.vol")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer func() {
+		_ = f.Close()
+	}()
+
+	v, err := storage.NewVolume(f)
+	require.NoError(t, err)
+	for key := uint64(1); key <= n; key++ {
+		require.NoError(t, v.Write(&storage.Needle{Header: storage.NeedleHeader{Key: key, Cookie: key}, Data: []byte("payload")}))
+	}
+	require.NoError(t, v.Close())
+	return path
+}
+
+// readBack opens the volume at path and reads keys 1 to n.
+func readBack(t *testing.T, path string, n uint64) {
+	t.Helper()
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer func() {
+		_ = f.Close()
+	}()
+
+	v, err := storage.NewVolume(f)
+	require.NoError(t, err)
+	for key := uint64(1); key <= n; key++ {
+		got, err := v.Read(storage.KeyPair{Key: key}, key)
+		require.NoError(t, err, "key %d", key)
+		assert.Equal(t, "payload", string(got))
+	}
+	require.NoError(t, v.Close())
+}
+
+func indexFile(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".idx"
+}
+
+func TestRun(t *testing.T) {
+	t.Run("Success_Clean", func(t *testing.T) {
+		path := writeVolume(t, 3)
+
+		var stdout, stderr bytes.Buffer
+		assert.Equal(t, 0, run([]string{path}, &stdout, &stderr))
+		assert.Empty(t, stderr.String())
+		assert.Equal(t, 3, strings.Count(stdout.String(), " ok "))
+		assert.Contains(t, stdout.String(), "needles:  3 intact, 3 live, 0 deleted, 0 tombstones")
+		assert.Contains(t, stdout.String(), "0 torn bytes")
+
+		stdout.Reset()
+		assert.Equal(t, 0, run([]string{"-q", path}, &stdout, &stderr))
+		assert.NotContains(t, stdout.String(), " ok ")
+		assert.Contains(t, stdout.String(), "needles:")
+	})
+
+	t.Run("Error_Usage", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		assert.Equal(t, 2, run(nil, &stdout, &stderr))
+		assert.Contains(t, stderr.String(), "usage:")
+
+		assert.Equal(t, 2, run([]string{"-unknown", "bench.vol"}, &stdout, &stderr))
+
+		stderr.Reset()
+		assert.Equal(t, 2, run([]string{filepath.Join(t.TempDir(), "missing.vol")}, &stdout, &stderr))
+		assert.Contains(t, stderr.String(), "volfsck:")
+	})
+
+	t.Run("Success_RepairTornTail", func(t *testing.T) {
+		path := writeVolume(t, 3)
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+
+		// the start of a needle whose header never made it
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		require.NoError(t, err)
+		_, err = f.Write(b[storage.SuperBlockSize : storage.SuperBlockSize+20])
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		var stdout, stderr bytes.Buffer
+		assert.Equal(t, 1, run([]string{"-q", path}, &stdout, &stderr))
+		assert.Contains(t, stdout.String(), "20 torn bytes")
+		torn, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, fi.Size()+20, torn.Size(), "a check only reads the volume")
+
+		stdout.Reset()
+		assert.Equal(t, 0, run([]string{"-q", "-repair", path}, &stdout, &stderr))
+		assert.Contains(t, stdout.String(), "repair: cut 20 torn bytes")
+		repaired, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, fi.Size(), repaired.Size())
+
+		readBack(t, path, 3)
+	})
+
+	t.Run("Success_RepairIndex", func(t *testing.T) {
+		path := writeVolume(t, 3)
+		idx := indexFile(path)
+		good, err := os.ReadFile(idx)
+		require.NoError(t, err)
+
+		// the volume is intact, only its index file is damaged
+		require.NoError(t, os.WriteFile(idx, bytes.Repeat([]byte{0xff}, len(good)), 0600))
+
+		var stdout, stderr bytes.Buffer
+		assert.Equal(t, 0, run([]string{"-q", "-repair", path}, &stdout, &stderr))
+		assert.Contains(t, stdout.String(), "repair: cut 0 torn bytes")
+		assert.Empty(t, stderr.String())
+
+		rebuilt, err := os.ReadFile(idx)
+		require.NoError(t, err)
+		assert.Len(t, rebuilt, len(good))
+		assert.Equal(t, good[:8], rebuilt[:8], "magic and version")
+
+		readBack(t, path, 3)
+	})
+}
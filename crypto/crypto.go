@@ -70,3 +70,35 @@ func CopyDeCrypto(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	stream := cipher.NewCTR(block, iv)
 	return copyCryptoStream(stream, block.BlockSize(), src, dst)
 }
+
+// CopyDeCryptoRange decrypts n bytes starting at off of what CopyEnCrypto wrote
+// to src into dst. The CTR stream is seeked to off, only the range is read.
+func CopyDeCryptoRange(key []byte, src io.ReaderAt, off, n int64, dst io.Writer) (int64, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+
+	bs := int64(block.BlockSize())
+	iv := make([]byte, bs)
+	if _, err := src.ReadAt(iv, 0); err != nil {
+		return 0, err
+	}
+
+	// the counter of the block off falls into, then the part of it before off
+	addCounter(iv, uint64(off/bs))
+	stream := cipher.NewCTR(block, iv)
+	skip := make([]byte, off%bs)
+	stream.XORKeyStream(skip, skip)
+
+	return io.Copy(dst, cipher.StreamReader{S: stream, R: io.NewSectionReader(src, bs+off, n)})
+}
+
+// addCounter adds blocks to the big-endian counter iv the way CTR increments it.
+func addCounter(iv []byte, blocks uint64) {
+	for i := len(iv) - 1; i >= 0 && blocks > 0; i-- {
+		sum := uint64(iv[i]) + blocks&0xff
+		iv[i] = byte(sum)
+		blocks = blocks>>8 + sum>>8
+	}
+}
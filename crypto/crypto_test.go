@@ -27,3 +27,32 @@ func TestCrypto(t *testing.T) {
 		t.Errorf("decode wrong: got %s, want %s", out.String(), payload)
 	}
 }
+
+func TestCryptoRange(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef-"), 100)
+	key := utils.NewEncryptionKey()
+
+	enc := new(bytes.Buffer)
+	if _, err := CopyEnCrypto(key, bytes.NewReader(payload), enc); err != nil {
+		t.Fatal(err)
+	}
+
+	// an IV about to carry over into the upper bytes
+	src := enc.Bytes()
+	copy(src[8:16], bytes.Repeat([]byte{0xff}, 8))
+	full := new(bytes.Buffer)
+	if _, err := CopyDeCrypto(key, bytes.NewReader(src), full); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range [][2]int64{{0, 10}, {5, 40}, {16, 16}, {33, 1000}, {1690, 10}, {1700, 0}} {
+		out := new(bytes.Buffer)
+		n, err := CopyDeCryptoRange(key, bytes.NewReader(src), r[0], r[1], out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := full.Bytes()[r[0] : r[0]+r[1]]; n != r[1] || !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("range %v: got %q, want %q", r, out.Bytes(), want)
+		}
+	}
+}
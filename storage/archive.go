@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	errtype "github.com/peterouob/file_system/type"
+)
+
+/*
+A volume archive is a tar stream
+
+	manifest.json   the archive format, the superblock and every needle in order
+	needles/0000000 the needles as stored, header, attributes, payload, footer
+	needles/0000001 and padding included
+	...
+
+so a needle keeps its cookie, flags, append time and attributes, compressed
+and encrypted payloads move as they are. Only the needles a compaction would
+keep are archived, the older versions of a versioned volume and the blobs of a
+dedup volume included, followed by the tombstones of deleted keys whose blobs
+or versions have to stay deleted.
+*/
+const (
+	archiveFormat   = 1
+	archiveManifest = "manifest.json"
+)
+
+type manifest struct {
+	Format     int             `json:"format"`
+	SuperBlock []byte          `json:"superblock"`
+	Needles    []archiveNeedle `json:"needles"`
+}
+
+type archiveNeedle struct {
+	Key      uint64 `json:"key"`
+	AltKey   uint32 `json:"alt_key"`
+	Size     uint32 `json:"size"`
+	AttrSize uint16 `json:"attr_size"`
+	Version  uint8  `json:"version"`
+}
+
+func (n archiveNeedle) meta(offset int64) NeedleMeta {
+	return NeedleMeta{Offset: offset, Size: n.Size, AttrSize: n.AttrSize, Version: n.Version}
+}
+
+func archiveName(i int) string {
+	return fmt.Sprintf("needles/%07d", i)
+}
+
+// Export writes the live needles of the volume to w as a volume archive, every
+// needle is checked against its CRC before it is written. Reads and writes go
+// on meanwhile, the archive holds the needles live when Export started.
+func (v *Volume) Export(w io.Writer) error {
+	v.mu.RLock()
+	var versions *versionIndex
+	if v.versions != nil {
+		versions = v.versions.clone()
+	}
+	live := liveNeedles(v.index, v.content, versions)
+	tombstones := append(v.content.tombstones(v.index), versions.tombstones(v.index)...)
+	super := v.super.Bytes()
+	src, release := v.holdData()
+	v.mu.RUnlock()
+	defer release()
+
+	m := manifest{Format: archiveFormat, SuperBlock: super, Needles: make([]archiveNeedle, 0, len(live)+len(tombstones))}
+	for _, n := range live {
+		m.Needles = append(m.Needles, archiveNeedle{
+			Key:      n.key.Key,
+			AltKey:   n.key.AltKey,
+			Size:     n.meta.Size,
+			AttrSize: n.meta.AttrSize,
+			Version:  n.meta.Version,
+		})
+	}
+	for _, t := range tombstones {
+		m.Needles = append(m.Needles, archiveNeedle{
+			Key:      t.Header.Key,
+			AltKey:   t.Header.AlternateKey,
+			AttrSize: uint16(attributesSize(t.Attrs)),
+			Version:  NeedleVersion2,
+		})
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("export error: %w", err)
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writeArchiveEntry(tw, archiveManifest, int64(len(b))); err != nil {
+		return err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return fmt.Errorf("export error: %w", err)
+	}
+
+	chunk, err := v.bufferPool.Get(largeSize)
+	if err != nil {
+		return err
+	}
+	defer v.bufferPool.Put(chunk)
+	buf := chunk.B[:cap(chunk.B)]
+
+	for i, n := range live {
+		if err := checkNeedle(src, n.key, n.meta, buf); err != nil {
+			return fmt.Errorf("export %v at %d: %w", n.key, n.meta.Offset, err)
+		}
+
+		if err := writeArchiveEntry(tw, archiveName(i), n.meta.length()); err != nil {
+			return err
+		}
+		if _, err := copyRange(tw, src, n.meta.Offset, n.meta.length(), buf); err != nil {
+			return fmt.Errorf("export error: %w", err)
+		}
+	}
+
+	for i, t := range tombstones {
+		if err := writeArchiveTombstone(tw, archiveName(len(live)+i), t, v.bufferPool); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("export error: %w", err)
+	}
+	return nil
+}
+
+func writeArchiveEntry(tw *tar.Writer, name string, size int64) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0600,
+		Size:     size,
+	}); err != nil {
+		return fmt.Errorf("export error: %w", err)
+	}
+	return nil
+}
+
+func writeArchiveTombstone(tw *tar.Writer, name string, t Needle, bp *BufferPool) error {
+	buf := t.Bytes(bp)
+	defer bp.Put(buf)
+
+	if err := writeArchiveEntry(tw, name, int64(len(buf.B))); err != nil {
+		return err
+	}
+	if _, err := tw.Write(buf.B); err != nil {
+		return fmt.Errorf("export error: %w", err)
+	}
+	return nil
+}
+
+/*
+ImportVolume rebuilds the volume archived in r into the empty dataFile and
+opens it with options, the superblock comes from the archive. Every needle is
+checked against the manifest and its CRC, a damaged archive reports
+ErrArchive or the error of the needle and leaves dataFile empty again.
+
+The needles are appended back to back, the volume is as compact as it gets.
+*/
+func ImportVolume(r io.Reader, dataFile *os.File, options ...VolumeOption) (*Volume, error) {
+	fi, err := dataFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("import error: %w", err)
+	}
+	if fi.Size() != 0 {
+		return nil, fmt.Errorf("%w: import needs an empty data file", errtype.ErrArchive)
+	}
+
+	if err := importNeedles(tar.NewReader(r), dataFile); err != nil {
+		return nil, errors.Join(err, dataFile.Truncate(0))
+	}
+
+	// an index file left behind by an older volume at the same path must not
+	// be taken for the index of this one
+	if err := os.Remove(indexPath(dataFile.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("import error: %w", err)
+	}
+
+	return NewVolume(dataFile, options...)
+}
+
+func importNeedles(tr *tar.Reader, dataFile *os.File) error {
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != archiveManifest {
+		return fmt.Errorf("%w: archive doesn't start with its manifest", errtype.ErrArchive)
+	}
+
+	var m manifest
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return fmt.Errorf("%w: manifest: %v", errtype.ErrArchive, err)
+	}
+	if m.Format != archiveFormat {
+		return fmt.Errorf("%w: archive format %d", errtype.ErrArchive, m.Format)
+	}
+
+	// checks the CRC of the superblock and that this build knows its features
+	if _, err := ParseSuperBlock(m.SuperBlock); err != nil {
+		return err
+	}
+	if _, err := dataFile.WriteAt(m.SuperBlock, 0); err != nil {
+		return fmt.Errorf("import error: %w", err)
+	}
+
+	buf := make([]byte, largeSize)
+	offset := int64(SuperBlockSize)
+
+	for i, n := range m.Needles {
+		hdr, err := tr.Next()
+		if err != nil {
+			return fmt.Errorf("%w: needle %d: %v", errtype.ErrArchive, i, err)
+		}
+
+		meta := n.meta(offset)
+		if hdr.Name != archiveName(i) || hdr.Size != meta.length() {
+			return fmt.Errorf("%w: entry %s of %d bytes where needle %d was expected", errtype.ErrArchive, hdr.Name, hdr.Size, i)
+		}
+
+		if _, err := io.CopyN(io.NewOffsetWriter(dataFile, offset), tr, hdr.Size); err != nil {
+			return fmt.Errorf("%w: needle %d: %v", errtype.ErrArchive, i, err)
+		}
+
+		key := KeyPair{Key: n.Key, AltKey: n.AltKey}
+		if err := checkNeedle(dataFile, key, meta, buf); err != nil {
+			return fmt.Errorf("import %v: %w", key, err)
+		}
+		offset += hdr.Size
+	}
+
+	if _, err := tr.Next(); !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: entries after the last needle", errtype.ErrArchive)
+	}
+
+	return dataFile.Sync()
+}
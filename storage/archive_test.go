@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolume_Archive(t *testing.T) {
+	target := func(t *testing.T) *os.File {
+		t.Helper()
+		f, err := os.Create(filepath.Join(t.TempDir(), "imported.vol"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = f.Close()
+		})
+		return f
+	}
+
+	t.Run("Success_RoundTrip", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithVolumeID(7), WithCompression(FlateCodec))
+		require.NoError(t, err)
+
+		large := string(bytes.Repeat([]byte("compressible "), 100))
+		n := newNeedle(1, large)
+		n.SetName("large.txt")
+		require.NoError(t, v.Write(n))
+		require.NoError(t, v.Write(newNeedle(2, "old")))
+		require.NoError(t, v.Write(newNeedle(2, "new")))
+		require.NoError(t, v.Write(newNeedle(3, "deleted")))
+		require.NoError(t, v.Delete(KeyPair{Key: 3}, 30))
+
+		archive := new(bytes.Buffer)
+		require.NoError(t, v.Export(archive))
+
+		imported, err := ImportVolume(archive, target(t))
+		require.NoError(t, err)
+		assert.Equal(t, uint32(7), imported.SuperBlock().VolumeID)
+		assert.Len(t, imported.index, 2)
+		assert.Zero(t, imported.garbage)
+		assert.Less(t, imported.writeOffset, v.writeOffset)
+
+		got, err := imported.ReadNeedle(KeyPair{Key: 1}, 10)
+		require.NoError(t, err)
+		assert.Equal(t, large, string(got.Data))
+		assert.Equal(t, "large.txt", got.Name())
+		assert.NotZero(t, got.Header.Flag&CompressFlag)
+
+		data, err := imported.Read(KeyPair{Key: 2}, 20)
+		require.NoError(t, err)
+		assert.Equal(t, "new", string(data))
+
+		_, err = imported.Read(KeyPair{Key: 3}, 30)
+		assert.ErrorIs(t, err, errtype.ErrNotFound)
+	})
+
+	t.Run("Success_Hidden", func(t *testing.T) {
+		payload := string(bytes.Repeat([]byte("shared "), 100))
+
+		f := setup(t)
+		defer teardown(f, t)
+		v, err := NewVolume(f, WithDedup())
+		require.NoError(t, err)
+		require.NoError(t, v.Write(newNeedle(1, payload)))
+		require.NoError(t, v.Write(newNeedle(2, payload)))
+		require.NoError(t, v.Delete(KeyPair{Key: 1}, 10))
+
+		archive := new(bytes.Buffer)
+		require.NoError(t, v.Export(archive))
+		imported, err := ImportVolume(archive, target(t))
+		require.NoError(t, err)
+
+		// the blob of the deleted key travels with its reference, the key stays
+		// deleted
+		data, err := imported.Read(KeyPair{Key: 2}, 20)
+		require.NoError(t, err)
+		assert.Equal(t, payload, string(data))
+		_, err = imported.Read(KeyPair{Key: 1}, 10)
+		assert.ErrorIs(t, err, errtype.ErrNotFound)
+		require.NoError(t, imported.Reload())
+		_, err = imported.Read(KeyPair{Key: 1}, 10)
+		assert.ErrorIs(t, err, errtype.ErrNotFound)
+
+		g := setup(t)
+		defer teardown(g, t)
+		v, err = NewVolume(g, WithVersioning(Retention{Versions: 2}))
+		require.NoError(t, err)
+		require.NoError(t, v.Write(newNeedle(1, "first")))
+		require.NoError(t, v.Write(newNeedle(1, "second")))
+
+		archive.Reset()
+		require.NoError(t, v.Export(archive))
+		imported, err = ImportVolume(archive, target(t))
+		require.NoError(t, err)
+		assert.Equal(t, []uint64{1, 2}, imported.Versions(KeyPair{Key: 1}))
+	})
+
+	t.Run("Error_CorruptVolume", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		require.NoError(t, v.Write(newNeedle(1, "payload")))
+		require.NoError(t, v.Write(newNeedle(2, "payload")))
+		corruptNeedles(t, v, f)
+
+		err := v.Export(new(bytes.Buffer))
+		assert.ErrorIs(t, err, errtype.ErrCrcNotValid)
+	})
+
+	t.Run("Error_CorruptArchive", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+		require.NoError(t, v.Write(newNeedle(1, "payload")))
+
+		archive := new(bytes.Buffer)
+		require.NoError(t, v.Export(archive))
+		b := archive.Bytes()
+		i := bytes.LastIndex(b, []byte("payload"))
+		require.Positive(t, i)
+		b[i] ^= 0xff
+
+		dst := target(t)
+		_, err := ImportVolume(bytes.NewReader(b), dst)
+		assert.ErrorIs(t, err, errtype.ErrCrcNotValid)
+
+		fi, err := dst.Stat()
+		require.NoError(t, err)
+		assert.Zero(t, fi.Size(), "a failed import leaves the data file empty")
+
+		_, err = ImportVolume(bytes.NewReader(b[:len(b)/2]), dst)
+		assert.ErrorIs(t, err, errtype.ErrArchive)
+	})
+
+	t.Run("Error_NotEmpty", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		archive := new(bytes.Buffer)
+		require.NoError(t, v.Export(archive))
+
+		_, err := ImportVolume(archive, f)
+		assert.ErrorIs(t, err, errtype.ErrArchive)
+	})
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	errtype "github.com/peterouob/file_system/type"
+)
+
+// AttrType identifies an attribute of a v2 needle.
+type AttrType uint16
+
+const (
+	AttrName         AttrType = iota + 1 // file name
+	AttrMimeType                         // MIME type of the data
+	AttrLastModified                     // last modified time, 8 byte big endian unix nano
+	AttrTTL                              // time to live after the append time, 8 byte big endian nanoseconds
+	AttrCodec                            // codec ID and 8 byte big endian uncompressed size of a compressed needle
+	AttrCipher                           // 4 byte big endian key ID and nonce of an encrypted needle
+	AttrHash                             // SHA-256 of the payload a dedup volume shares between keys, an HMAC when encrypted
+	AttrVersion                          // 8 byte big endian version of the key on a versioned volume
+)
+
+// AttrUser is the first attribute type left to applications, types from here
+// on are never used by the storage package itself.
+const AttrUser AttrType = 0x8000
+
+// MaxAttrSize is the largest attribute section a needle can carry.
+const MaxAttrSize = math.MaxUint16
+
+const attrHeaderSize = 4
+
+/*
+Attribute is one entry of the attribute section of a v2 needle
+
++------+--------+-------+
+| Type | Length | Value |
+| 2    | 2      | n     |
++------+--------+-------+
+
+Attributes are kept in the order they were set, types a reader doesn't know
+are read back and passed on untouched.
+*/
+type Attribute struct {
+	Value []byte
+	Type  AttrType
+}
+
+// attributesSize returns the number of bytes attrs take on disk.
+func attributesSize(attrs []Attribute) int {
+	n := 0
+	for _, a := range attrs {
+		n += attrHeaderSize + len(a.Value)
+	}
+	return n
+}
+
+// validAttributes checks that attrs fit into the attribute section.
+func validAttributes(attrs []Attribute) error {
+	if n := attributesSize(attrs); n > MaxAttrSize {
+		return fmt.Errorf("%w: %d bytes of attributes, at most %d", errtype.ErrAttribute, n, MaxAttrSize)
+	}
+	return nil
+}
+
+func appendAttributes(b []byte, attrs []Attribute) []byte {
+	for _, a := range attrs {
+		b = binary.BigEndian.AppendUint16(b, uint16(a.Type))
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.Value)))
+		b = append(b, a.Value...)
+	}
+	return b
+}
+
+// parseAttributes decodes an attribute section, the values point into b.
+func parseAttributes(b []byte) ([]Attribute, error) {
+	var attrs []Attribute
+
+	for len(b) > 0 {
+		if len(b) < attrHeaderSize {
+			return nil, fmt.Errorf("%w: truncated attribute header", errtype.ErrAttribute)
+		}
+
+		t := AttrType(binary.BigEndian.Uint16(b[0:2]))
+		n := int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < attrHeaderSize+n {
+			return nil, fmt.Errorf("%w: truncated attribute %d", errtype.ErrAttribute, t)
+		}
+
+		attrs = append(attrs, Attribute{Type: t, Value: b[attrHeaderSize : attrHeaderSize+n]})
+		b = b[attrHeaderSize+n:]
+	}
+
+	return attrs, nil
+}
+
+// Attr returns the value of the attribute of type t.
+func (n *Needle) Attr(t AttrType) ([]byte, bool) {
+	for _, a := range n.Attrs {
+		if a.Type == t {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+// SetAttr sets the attribute of type t, replacing the value it had.
+func (n *Needle) SetAttr(t AttrType, value []byte) {
+	for i := range n.Attrs {
+		if n.Attrs[i].Type == t {
+			n.Attrs[i].Value = value
+			return
+		}
+	}
+	n.Attrs = append(n.Attrs, Attribute{Type: t, Value: value})
+}
+
+// DelAttr removes the attribute of type t.
+func (n *Needle) DelAttr(t AttrType) {
+	n.Attrs = slices.DeleteFunc(n.Attrs, func(a Attribute) bool {
+		return a.Type == t
+	})
+}
+
+func (n *Needle) Name() string {
+	v, _ := n.Attr(AttrName)
+	return string(v)
+}
+
+func (n *Needle) SetName(name string) {
+	n.SetAttr(AttrName, []byte(name))
+}
+
+func (n *Needle) MimeType() string {
+	v, _ := n.Attr(AttrMimeType)
+	return string(v)
+}
+
+func (n *Needle) SetMimeType(mime string) {
+	n.SetAttr(AttrMimeType, []byte(mime))
+}
+
+// LastModified returns the AttrLastModified time, the zero time when unset.
+func (n *Needle) LastModified() time.Time {
+	v, ok := n.Attr(AttrLastModified)
+	if !ok || len(v) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+}
+
+func (n *Needle) SetLastModified(t time.Time) {
+	n.SetAttr(AttrLastModified, binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano())))
+}
+
+// AppendTime returns when the volume appended the needle, the zero time for
+// v1 needles which don't record it.
+func (n *Needle) AppendTime() time.Time {
+	if n.Header.AppendAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n.Header.AppendAt)
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reopenVolume opens the volume file of f again through a new file, which also
+// sees the file a compaction swapped in.
+func reopenVolume(t *testing.T, f *os.File) *Volume {
+	t.Helper()
+
+	reopened, err := os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = reopened.Close()
+	})
+
+	v, err := NewVolume(reopened)
+	require.NoError(t, err)
+	return v
+}
+
+func TestAttributes(t *testing.T) {
+	n := &Needle{}
+	n.SetName("cat.png")
+	n.SetMimeType("image/png")
+	n.SetAttr(AttrUser, []byte("owner=alice"))
+	n.SetName("dog.png")
+
+	b := appendAttributes(nil, n.Attrs)
+	assert.Len(t, b, attributesSize(n.Attrs))
+
+	attrs, err := parseAttributes(b)
+	require.NoError(t, err)
+	assert.Equal(t, n.Attrs, attrs)
+	assert.Equal(t, "dog.png", n.Name())
+
+	n.DelAttr(AttrName)
+	_, ok := n.Attr(AttrName)
+	assert.False(t, ok)
+
+	t.Run("Error_Truncated", func(t *testing.T) {
+		_, err := parseAttributes(b[:len(b)-1])
+		assert.ErrorIs(t, err, errtype.ErrAttribute)
+	})
+
+	t.Run("Error_TooLarge", func(t *testing.T) {
+		big := []Attribute{{Type: AttrUser, Value: make([]byte, MaxAttrSize)}}
+		assert.ErrorIs(t, validAttributes(big), errtype.ErrAttribute)
+	})
+}
+
+func TestVolume_NeedleV2(t *testing.T) {
+	newAttrNeedle := func(key uint64, payload string) *Needle {
+		n := newNeedle(key, payload)
+		n.SetName("file.txt")
+		n.SetMimeType("text/plain")
+		n.SetLastModified(time.Unix(1700000000, 0))
+		n.SetAttr(AttrUser+1, []byte("meta"))
+		return n
+	}
+
+	t.Run("Success_Attributes", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		before := time.Now()
+		want := newAttrNeedle(1, "hello")
+		require.NoError(t, v.Write(want))
+		assert.Zero(t, want.Header.AppendAt, "the caller's needle is left alone")
+
+		check := func(v *Volume) {
+			t.Helper()
+			got, err := v.ReadNeedle(KeyPair{Key: 1}, 10)
+			require.NoError(t, err)
+
+			assert.Equal(t, NeedleVersion2, got.Header.Version())
+			assert.Equal(t, []byte("hello"), got.Data)
+			assert.Equal(t, want.Attrs, got.Attrs)
+			assert.Equal(t, "file.txt", got.Name())
+			assert.Equal(t, "text/plain", got.MimeType())
+			assert.True(t, got.LastModified().Equal(time.Unix(1700000000, 0)))
+			assert.False(t, got.AppendTime().Before(before))
+		}
+
+		check(v)
+
+		require.NoError(t, v.Close())
+		require.NoError(t, os.Remove(indexPath(f.Name())))
+		check(reopenVolume(t, f))
+	})
+
+	t.Run("Success_StreamAttributes", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+
+		payload := newPayload(xlargeSize + 1)
+		attrs := []Attribute{{Type: AttrName, Value: []byte("big.bin")}}
+		require.NoError(t, v.WriteFrom(NeedleHeader{Key: 1}, bytes.NewReader(payload), uint32(len(payload)), attrs...))
+
+		got, err := v.ReadNeedle(KeyPair{Key: 1}, 0)
+		require.NoError(t, err)
+		assert.Equal(t, "big.bin", got.Name())
+		assert.Equal(t, payload, got.Data)
+	})
+
+	t.Run("Success_ReadV1", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		require.NoError(t, v.Close())
+
+		// needles written before the v2 layout
+		var legacy []byte
+		for key := range uint64(3) {
+			legacy = append(legacy, newNeedle(key, "legacy").Bytes(v.bufferPool).B...)
+		}
+		_, err := f.WriteAt(legacy, SuperBlockSize)
+		require.NoError(t, err)
+
+		v = reopenVolume(t, f)
+		require.NoError(t, v.Write(newAttrNeedle(3, "new")))
+		require.NoError(t, v.Write(newAttrNeedle(0, "overwrite")))
+
+		_, err = v.Compact()
+		require.NoError(t, err)
+
+		got, err := v.ReadNeedle(KeyPair{Key: 1}, 10)
+		require.NoError(t, err)
+		assert.Equal(t, NeedleVersion1, got.Header.Version())
+		assert.Equal(t, []byte("legacy"), got.Data)
+		assert.Empty(t, got.Attrs)
+		assert.True(t, got.AppendTime().IsZero())
+
+		require.NoError(t, v.Delete(KeyPair{Key: 2}, 20))
+		require.NoError(t, v.Close())
+
+		v = reopenVolume(t, f)
+		assert.Len(t, v.index, 3)
+		data, err := v.Read(KeyPair{Key: 3}, 30)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("new"), data)
+	})
+
+	t.Run("Error_AttributesTooLarge", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+
+		n := newNeedle(1, "x")
+		n.SetAttr(AttrUser, make([]byte, MaxAttrSize))
+		assert.ErrorIs(t, v.Write(n), errtype.ErrAttribute)
+		assert.Empty(t, v.index)
+	})
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/peterouob/file_system/utils"
+)
+
+const (
+	// BatchFlag marks the marker opening a batch, its Key holds the number of
+	// needles in the batch.
+	BatchFlag byte = 1 << 4
+	// CommitFlag marks the marker closing a batch, with the same Key.
+	CommitFlag byte = 1 << 5
+
+	batchMarkers = BatchFlag | CommitFlag
+)
+
+/*
+WriteBatch appends the needles as one batch, they are encoded into a single
+write under one lock and turn visible together. In the data file the batch is
+framed by two empty marker needles
+
+	+-------+--------+--------+-----+--------+--------+
+	| begin | needle | needle | ... | needle | commit |
+	+-------+--------+--------+-----+--------+--------+
+
+and recovery applies its needles only once it finds the commit marker, a batch
+torn by a crash is cut off as a whole. The index file logs the markers as
+well, so an index whose log ends inside a batch falls back to the data file.
+
+The needles are compressed and sealed like Write does, a dedup volume doesn't
+share the payloads of a batch. A batch is written whole from memory, one
+larger than xlargeSize reports ErrToLarge.
+*/
+func (v *Volume) WriteBatch(needles []*Needle) error {
+	if len(needles) == 0 {
+		return nil
+	}
+
+	batch := make([]Needle, len(needles))
+	for i, n := range needles {
+		w, err := v.prepareNeedle(n)
+		if err != nil {
+			return err
+		}
+
+		release, err := v.encodeNeedle(&w)
+		defer release()
+		if err != nil {
+			return err
+		}
+		batch[i] = w
+	}
+
+	begin, commit := batchMarker(BatchFlag, len(batch)), batchMarker(CommitFlag, len(batch))
+	size := begin.Header.length() + commit.Header.length()
+	for i := range batch {
+		batch[i].Header.AttrSize = uint16(attributesSize(batch[i].Attrs))
+		n, err := utils.CIU32(len(batch[i].Data))
+		if err != nil {
+			return fmt.Errorf("%w: payload of %d bytes", errtype.ErrToLarge, len(batch[i].Data))
+		}
+		batch[i].Header.Size = n
+		size += batch[i].Header.length()
+	}
+
+	if size > xlargeSize {
+		return fmt.Errorf("%w: batch of %d bytes", errtype.ErrToLarge, size)
+	}
+
+	b := make([]byte, 0, size)
+	for _, n := range slices.Concat([]Needle{begin}, batch, []Needle{commit}) {
+		buf := n.Bytes(v.bufferPool)
+		b = append(b, buf.B...)
+		v.bufferPool.Put(buf)
+	}
+
+	p, err := v.writeBatch(batch, b)
+	if err != nil {
+		return err
+	}
+
+	return v.commit(p)
+}
+
+// batchMarker returns the marker with flag of a batch of count needles.
+func batchMarker(flag byte, count int) Needle {
+	return Needle{
+		Header: NeedleHeader{
+			MagicHeader: MagicHeaderV2,
+			Key:         uint64(count),
+			AppendAt:    time.Now().UnixNano(),
+			Flag:        flag,
+		},
+		Footer: NeedleFooter{
+			MagicFooter: MagicFooter,
+		},
+	}
+}
+
+// writeBatch appends the encoded batch b holding the needles of batch between
+// its markers, and points their keys at them.
+func (v *Volume) writeBatch(batch []Needle, b []byte) (commitPoint, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.writable(int64(len(b))); err != nil {
+		return commitPoint{}, err
+	}
+
+	if n, err := v.dataFile.WriteAt(b, v.writeOffset); err != nil || n != len(b) {
+		return commitPoint{}, fmt.Errorf("write error: %v", err)
+	}
+
+	count := KeyPair{Key: uint64(len(batch))}
+	begin, commit := batchMarker(BatchFlag, len(batch)).Header, batchMarker(CommitFlag, len(batch)).Header
+	entries := make([]indexEntry, 0, len(batch)+2)
+	entries = append(entries, indexEntry{Key: count, NeedleMeta: begin.meta(v.writeOffset), Flag: BatchFlag})
+
+	offset := v.writeOffset + begin.length()
+	for _, n := range batch {
+		key := KeyPair{Key: n.Header.Key, AltKey: n.Header.AlternateKey}
+
+		meta := n.Header.meta(offset)
+		meta.ExpireAt = v.expireAt(n.Header, n.Attrs)
+		v.garbage += linkNeedle(v.index, v.content, v.versions, key, n.Header, meta, n.Attrs)
+
+		entries = append(entries, indexEntry{Key: key, NeedleMeta: meta, Flag: n.Header.Flag})
+		v.supersede(key, offset)
+		offset += n.Header.length()
+	}
+
+	entries = append(entries, indexEntry{Key: count, NeedleMeta: commit.meta(offset), Flag: CommitFlag})
+	v.garbage += begin.length() + commit.length()
+	v.writeOffset += int64(len(b))
+
+	for _, e := range entries {
+		if err := v.idx.append(e); err != nil {
+			return commitPoint{}, fmt.Errorf("index append error: %w", err)
+		}
+	}
+
+	if v.idx.needCheckpoint() {
+		return v.point(v.writeOffset), v.checkpoint()
+	}
+
+	return v.point(v.writeOffset), nil
+}
+
+/*
+batchLog holds the needles of a batch back while the needle log is replayed
+
+	begin marker   the needles that follow are held back
+	commit marker  they are applied when there are as many as the markers say
+
+A batch still open once the log ends never committed, recovery cuts the log
+off at its begin marker so no needle is ever appended behind it.
+*/
+type batchLog struct {
+	pending []needleRecord
+	count   uint64
+	start   int64
+	open    bool
+}
+
+func (b *batchLog) add(rec needleRecord, apply func(needleRecord)) {
+	switch {
+	case rec.Header.Flag&BatchFlag != 0:
+		b.pending, b.count, b.start, b.open = b.pending[:0], rec.Header.Key, rec.Offset, true
+	case rec.Header.Flag&CommitFlag != 0:
+		if b.open && uint64(len(b.pending)) == b.count {
+			for _, p := range b.pending {
+				apply(p)
+			}
+		}
+		b.pending, b.open = b.pending[:0], false
+	case b.open:
+		// the attributes of rec are only valid during the callback
+		rec.Attrs = cloneAttributes(rec.Attrs)
+		b.pending = append(b.pending, rec)
+	default:
+		apply(rec)
+	}
+}
+
+func cloneAttributes(attrs []Attribute) []Attribute {
+	clone := make([]Attribute, len(attrs))
+	for i, a := range attrs {
+		clone[i] = Attribute{Type: a.Type, Value: slices.Clone(a.Value)}
+	}
+	return clone
+}
+
+// indexBatch holds the entries of a batch back while the index log is loaded,
+// like batchLog does for the needle log. The begin marker counts as pending.
+type indexBatch struct {
+	pending []indexEntry
+}
+
+func (b *indexBatch) add(e indexEntry, apply func(indexEntry)) {
+	switch {
+	case e.Flag&BatchFlag != 0:
+		b.pending = append(b.pending[:0], e)
+	case e.Flag&CommitFlag != 0:
+		if len(b.pending) > 0 && uint64(len(b.pending)-1) == e.Key.Key {
+			for _, p := range b.pending {
+				apply(p)
+			}
+			apply(e)
+		}
+		b.pending = b.pending[:0]
+	case len(b.pending) > 0:
+		b.pending = append(b.pending, e)
+	default:
+		apply(e)
+	}
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolume_WriteBatch(t *testing.T) {
+	batch := func(from, to uint64) []*Needle {
+		var needles []*Needle
+		for key := from; key < to; key++ {
+			needles = append(needles, newNeedle(key, fmt.Sprintf("batched %d", key)))
+		}
+		return needles
+	}
+
+	readAll := func(t *testing.T, v *Volume, from, to uint64) {
+		t.Helper()
+		for key := from; key < to; key++ {
+			data, err := v.Read(KeyPair{Key: key}, key*10)
+			require.NoError(t, err, "key %d", key)
+			assert.Equal(t, fmt.Sprintf("batched %d", key), string(data))
+		}
+	}
+
+	markers := batchMarker(BatchFlag, 0).Header.length() + batchMarker(CommitFlag, 0).Header.length()
+
+	t.Run("Success", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithCompression(FlateCodec))
+		require.NoError(t, err)
+
+		require.NoError(t, v.WriteBatch(batch(1, 101)))
+		readAll(t, v, 1, 101)
+		assert.Equal(t, markers, v.garbage)
+		require.NoError(t, v.Close())
+
+		// from the index file, then from the data file alone
+		v = reopenVolume(t, f)
+		readAll(t, v, 1, 101)
+		require.NoError(t, v.Reload())
+		readAll(t, v, 1, 101)
+		assert.Equal(t, markers, v.garbage)
+
+		require.NoError(t, v.WriteBatch(batch(1, 51)))
+		_, err = v.Compact()
+		require.NoError(t, err)
+		assert.Zero(t, v.garbage)
+		readAll(t, v, 1, 101)
+	})
+
+	t.Run("Success_TornData", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f)
+		require.NoError(t, err)
+		require.NoError(t, v.Write(newNeedle(1, "batched 1")))
+		before := v.writeOffset
+
+		require.NoError(t, v.WriteBatch(batch(2, 10)))
+		commit := batchMarker(CommitFlag, 0).Header.length()
+		require.NoError(t, f.Truncate(v.writeOffset-commit))
+		require.NoError(t, v.Close())
+
+		// the whole batch is gone, not just the missing marker
+		v = reopenVolume(t, f)
+		readAll(t, v, 1, 2)
+		for key := uint64(2); key < 10; key++ {
+			_, err := v.Read(KeyPair{Key: key}, key*10)
+			assert.ErrorIs(t, err, errtype.ErrNotFound)
+		}
+		assert.Equal(t, before, v.writeOffset)
+
+		fi, err := os.Stat(f.Name())
+		require.NoError(t, err)
+		assert.Equal(t, before, fi.Size())
+	})
+
+	t.Run("Success_TornIndex", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f)
+		require.NoError(t, err)
+		require.NoError(t, v.Write(newNeedle(1, "batched 1")))
+		require.NoError(t, v.WriteBatch(batch(2, 10)))
+
+		// crash before the commit entry made it to the index, the data file
+		// has the whole batch
+		require.NoError(t, v.idx.flush())
+		idx := indexPath(f.Name())
+		fi, err := os.Stat(idx)
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(idx, fi.Size()-indexEntrySize))
+
+		reopened, err := os.OpenFile(f.Name(), os.O_RDWR, 0600)
+		require.NoError(t, err)
+		defer func() {
+			_ = reopened.Close()
+		}()
+		v, err = NewVolume(reopened)
+		require.NoError(t, err)
+		readAll(t, v, 1, 10)
+
+		require.NoError(t, v.Write(newNeedle(10, "batched 10")))
+		require.NoError(t, v.Close())
+		v = reopenVolume(t, f)
+		readAll(t, v, 1, 11)
+	})
+
+	t.Run("Error_CallerFlag", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f)
+		require.NoError(t, err)
+
+		for _, flag := range []byte{BatchFlag, CommitFlag, DeleteFlag} {
+			n := newNeedle(1, "flagged")
+			n.Header.Flag = flag
+			assert.ErrorIs(t, v.Write(n), errtype.ErrNeedleFlag)
+			assert.ErrorIs(t, v.WriteBatch([]*Needle{newNeedle(2, "batched 2"), n}), errtype.ErrNeedleFlag)
+			assert.ErrorIs(t, v.WriteFrom(n.Header, bytes.NewReader(n.Data), n.Header.Size), errtype.ErrNeedleFlag)
+		}
+		assert.Empty(t, v.index)
+
+		// nothing opens a batch the log is cut off at
+		require.NoError(t, v.WriteBatch(batch(4, 8)))
+		end := v.writeOffset
+		require.NoError(t, v.Close())
+
+		v = reopenVolume(t, f)
+		require.NoError(t, v.Reload())
+		assert.Equal(t, end, v.writeOffset)
+		readAll(t, v, 4, 8)
+	})
+
+	t.Run("Error_TooLarge", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+
+		payload := string(newPayload(xlargeSize / 2))
+		err := v.WriteBatch([]*Needle{newNeedle(1, payload), newNeedle(2, payload)})
+		assert.ErrorIs(t, err, errtype.ErrToLarge)
+		assert.Empty(t, v.index)
+	})
+}
@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	errtype "github.com/peterouob/file_system/type"
+)
+
+// NeedleState is what CheckVolume found at an offset of the needle log.
+type NeedleState uint8
+
+const (
+	NeedleLive      NeedleState = iota // intact and not deleted when it was written
+	NeedleDeleted                      // intact, deleted in place
+	NeedleTombstone                    // intact tombstone
+	NeedleCorrupt                      // a run of bytes no intact needle could be read from
+	NeedleMarker                       // intact marker opening or closing a batch
+)
+
+func (s NeedleState) String() string {
+	switch s {
+	case NeedleLive:
+		return "ok"
+	case NeedleDeleted:
+		return "deleted"
+	case NeedleTombstone:
+		return "tombstone"
+	case NeedleCorrupt:
+		return "corrupt"
+	case NeedleMarker:
+		return "marker"
+	}
+	return fmt.Sprintf("NeedleState(%d)", s)
+}
+
+// CheckedNeedle describes one needle, or one corrupt run of bytes, of the log.
+type CheckedNeedle struct {
+	Key     KeyPair
+	Offset  int64
+	Length  int64 // bytes taken on disk with the padding
+	Size    uint32
+	Flag    byte
+	Version uint8
+	State   NeedleState
+}
+
+// CheckReport sums up a CheckVolume pass.
+type CheckReport struct {
+	Super        SuperBlock
+	Legacy       bool // the log starts at 0, the file was written before superblocks
+	Needles      int  // intact needles, tombstones included
+	Live         int  // keys the log leaves pointing at a needle
+	Deleted      int  // needles deleted in place
+	Tombstones   int
+	Corrupt      int   // runs of bytes no intact needle could be read from
+	LiveBytes    int64 // bytes of the needles a reload keeps, older versions and shared blobs included
+	GarbageBytes int64 // bytes of intact needles a compaction drops
+	CorruptBytes int64
+	End          int64 // offset right after the last intact needle, or the start of the log
+	TornBytes    int64 // bytes of the incomplete needle or uncommitted batch after End
+}
+
+/*
+CheckVolume walks the volume in r of the given size without writing to it and
+calls fn for every needle it finds, in file order. Unlike the reload of a
+volume it goes on after a needle whose framing is broken: the corrupt bytes up
+to the next 8 byte aligned offset holding a needle magic are reported as one
+NeedleCorrupt run.
+
+The live needles are worked out like a reload does, so the report of a dedup
+or versioned volume counts what its indexes keep alive.
+*/
+func CheckVolume(r io.ReaderAt, size int64, fn func(CheckedNeedle)) (CheckReport, error) {
+	report, _, err := checkVolume(r, size, fn)
+	return report, err
+}
+
+// checkVolume is CheckVolume, it also returns the index a reload builds.
+func checkVolume(r io.ReaderAt, size int64, fn func(CheckedNeedle)) (CheckReport, map[KeyPair]NeedleMeta, error) {
+	var report CheckReport
+
+	start := int64(SuperBlockSize)
+	if size >= 4 {
+		var buf [SuperBlockSize]byte
+		n, err := r.ReadAt(buf[:min(size, SuperBlockSize)], 0)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return report, nil, err
+		}
+
+		if binary.BigEndian.Uint32(buf[0:4]) == MagicHeader {
+			report.Legacy = true
+			start = 0
+		} else if report.Super, err = ParseSuperBlock(buf[:n]); err != nil {
+			return report, nil, err
+		}
+	}
+
+	v := &Volume{super: report.Super}
+	index := make(map[KeyPair]NeedleMeta)
+	var content *contentIndex
+	if report.Super.Features&FeatureDedup != 0 {
+		content = newContentIndex()
+	}
+	var versions *versionIndex
+	if report.Super.Features&FeatureVersions != 0 {
+		versions = newVersionIndex(report.Super.Retention)
+	}
+
+	bp := NewBufferPool()
+	next := start
+	report.End = start
+
+	var (
+		intact int64
+		batch  batchLog
+	)
+	corrupt := func(to int64) {
+		if to <= next {
+			return
+		}
+		report.Corrupt++
+		report.CorruptBytes += to - next
+		fn(CheckedNeedle{Offset: next, Length: to - next, State: NeedleCorrupt})
+	}
+
+	for off := start; off < size; {
+		res, err := scanNeedles(r, off, size, bp, func(rec needleRecord) error {
+			// needles failing their checksum are skipped by the scan
+			corrupt(rec.Offset)
+
+			c := CheckedNeedle{
+				Key:     KeyPair{Key: rec.Header.Key, AltKey: rec.Header.AlternateKey},
+				Offset:  rec.Offset,
+				Length:  rec.Length,
+				Size:    rec.Header.Size,
+				Flag:    rec.Header.Flag,
+				Version: rec.Header.Version(),
+			}
+
+			switch {
+			case rec.Header.Flag&batchMarkers != 0:
+				c.State = NeedleMarker
+			case rec.Header.Flag&DeleteFlag == 0:
+				c.State = NeedleLive
+			case rec.Header.Size == 0 && !slices.ContainsFunc(rec.Attrs, func(a Attribute) bool { return a.Type != AttrVersion }):
+				c.State = NeedleTombstone
+				report.Tombstones++
+			default:
+				c.State = NeedleDeleted
+				report.Deleted++
+			}
+
+			report.Needles++
+			intact += rec.Length
+			batch.add(rec, func(rec needleRecord) {
+				v.applyRecord(index, content, versions, rec)
+			})
+			next = rec.Offset + rec.Length
+			report.End = next
+			fn(c)
+			return nil
+		})
+
+		if err == nil {
+			corrupt(res.End)
+			if res.Torn {
+				report.TornBytes = size - res.End
+			}
+			break
+		}
+
+		if !errors.Is(err, errtype.ErrCorruptVolume) {
+			return report, nil, err
+		}
+
+		// resync on the next needle magic, the needle found there is checked
+		// like any other
+		off, err = nextMagic(r, res.End+8, size)
+		if err != nil {
+			return report, nil, err
+		}
+		corrupt(off)
+		next = off
+	}
+
+	// a reload cuts off a batch that never committed
+	if batch.open {
+		report.TornBytes += report.End - batch.start
+		intact -= report.End - batch.start
+		report.End = batch.start
+	}
+
+	report.Live = len(index)
+	report.LiveBytes = content.liveBytes(index) + versions.historyBytes()
+	report.GarbageBytes = intact - report.LiveBytes
+	return report, index, nil
+}
+
+// nextMagic returns the first 8 byte aligned offset from off on holding a
+// needle magic, size when there is none.
+func nextMagic(r io.ReaderAt, off, size int64) (int64, error) {
+	var magic [4]byte
+	for ; off+NeedleHeaderSize <= size; off += 8 {
+		if _, err := r.ReadAt(magic[:], off); err != nil {
+			return off, err
+		}
+		if validMagic(binary.BigEndian.Uint32(magic[:])) {
+			return off, nil
+		}
+	}
+	return size, nil
+}
+
+/*
+RepairVolume cuts the torn tail off the volume in f and rebuilds its index file
+from one scan, without opening the volume: a legacy volume isn't migrated and
+no option decides what is kept. The index file of a legacy volume is removed,
+opening it migrates the volume and rebuilds the index anyway. It returns the
+report of the scan, taken before the tail was cut.
+*/
+func RepairVolume(f *os.File) (CheckReport, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return CheckReport{}, err
+	}
+
+	report, index, err := checkVolume(f, fi.Size(), func(CheckedNeedle) {})
+	if err != nil {
+		return report, err
+	}
+
+	if report.TornBytes > 0 {
+		if err := f.Truncate(report.End); err != nil {
+			return report, err
+		}
+		if err := f.Sync(); err != nil {
+			return report, err
+		}
+	}
+
+	path := indexPath(f.Name())
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return report, err
+	}
+	if report.Legacy {
+		return report, nil
+	}
+
+	ix, err := openIndexFile(path, false)
+	if err != nil {
+		return report, err
+	}
+	return report, errors.Join(ix.checkpoint(index, report.End), ix.close())
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckVolume(t *testing.T) {
+	fill := func(t *testing.T, v *Volume) {
+		t.Helper()
+		for key := uint64(1); key <= 4; key++ {
+			require.NoError(t, v.Write(newNeedle(key, "needle")))
+		}
+		require.NoError(t, v.Write(newNeedle(3, "overwritten")))
+		require.NoError(t, v.Delete(KeyPair{Key: 4}, 40))
+	}
+
+	check := func(t *testing.T, f *os.File) (CheckReport, []CheckedNeedle) {
+		t.Helper()
+		fi, err := f.Stat()
+		require.NoError(t, err)
+
+		var needles []CheckedNeedle
+		report, err := CheckVolume(f, fi.Size(), func(n CheckedNeedle) {
+			needles = append(needles, n)
+		})
+		require.NoError(t, err)
+		return report, needles
+	}
+
+	t.Run("Success_Clean", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		fill(t, v)
+
+		report, needles := check(t, f)
+		assert.Equal(t, 6, report.Needles)
+		assert.Equal(t, 3, report.Live)
+		assert.Equal(t, 1, report.Deleted)
+		assert.Equal(t, 1, report.Tombstones)
+		assert.Zero(t, report.Corrupt)
+		assert.Zero(t, report.TornBytes)
+		assert.Equal(t, v.writeOffset, report.End)
+		assert.Equal(t, v.garbage, report.GarbageBytes)
+		assert.Equal(t, liveBytes(v.index), report.LiveBytes)
+
+		require.Len(t, needles, 6)
+		assert.Equal(t, NeedleDeleted, needles[3].State)
+		assert.Equal(t, NeedleTombstone, needles[5].State)
+	})
+
+	t.Run("Success_Corrupt", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		fill(t, v)
+		corruptNeedles(t, v, f)
+		end := v.writeOffset
+
+		// a needle cut off by a crash
+		_, err := f.WriteAt(newNeedle(5, "torn").Bytes(v.bufferPool).B[:20], end)
+		require.NoError(t, err)
+
+		before, err := os.ReadFile(f.Name())
+		require.NoError(t, err)
+
+		report, needles := check(t, f)
+		assert.Equal(t, 1, report.Corrupt, "the needles of key 1 and 2 are one run")
+		assert.Equal(t, 4, report.Needles)
+		assert.Equal(t, 1, report.Live)
+		assert.Equal(t, end, report.End)
+		assert.Equal(t, int64(20), report.TornBytes)
+
+		require.Len(t, needles, 5)
+		assert.Equal(t, NeedleCorrupt, needles[0].State)
+		assert.Equal(t, int64(SuperBlockSize), needles[0].Offset)
+		assert.Equal(t, KeyPair{Key: 3}, needles[1].Key)
+		assert.Equal(t, needles[1].Offset, needles[0].Offset+needles[0].Length)
+
+		after, err := os.ReadFile(f.Name())
+		require.NoError(t, err)
+		assert.Equal(t, before, after, "checking never writes")
+	})
+}
+
+func TestRepairVolume(t *testing.T) {
+	t.Run("Success_Legacy", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "legacy.vol")
+		pool := NewBufferPool()
+		legacy := append(newNeedle(1, "legacy").Bytes(pool).B, newNeedle(2, "torn").Bytes(pool).B[:20]...)
+		require.NoError(t, os.WriteFile(path, legacy, 0600))
+		require.NoError(t, os.WriteFile(indexPath(path), []byte("stale"), 0600))
+
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		require.NoError(t, err)
+		defer func() {
+			_ = f.Close()
+		}()
+
+		report, err := RepairVolume(f)
+		require.NoError(t, err)
+		assert.True(t, report.Legacy)
+		assert.Equal(t, int64(20), report.TornBytes)
+
+		// the tail is cut without the volume being migrated
+		onDisk, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, legacy[:len(legacy)-20], onDisk)
+		assert.NoFileExists(t, indexPath(path))
+	})
+}
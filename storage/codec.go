@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/peterouob/file_system/utils"
+)
+
+// CompressFlag marks a needle whose payload is stored compressed.
+const CompressFlag byte = 1 << 1
+
+/*
+Codec compresses needle payloads. A compressed needle keeps
+
+	Size      the number of compressed bytes stored on disk
+	CRC       the checksum over the compressed bytes, so a volume is verified
+	          without decompressing it
+	AttrCodec the codec ID and the uncompressed size
+
+Codecs are found by their ID when a needle is read, a codec other than the
+built in ones must be registered with RegisterCodec before its needles are read.
+*/
+type Codec interface {
+	ID() uint8
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+const (
+	CodecFlate uint8 = iota + 1
+	CodecGzip
+)
+
+// compressMinSize is the smallest payload worth compressing.
+const compressMinSize = 128
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[uint8]Codec{
+		CodecFlate: FlateCodec,
+		CodecGzip:  GzipCodec,
+	}
+
+	FlateCodec Codec = &flateCodec{level: flate.DefaultCompression}
+	GzipCodec  Codec = &gzipCodec{level: gzip.DefaultCompression}
+
+	errNoGain = errors.New("compressed payload not smaller")
+)
+
+// RegisterCodec makes c available for reading needles, it panics when another
+// codec took its ID.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	if old, ok := codecs[c.ID()]; ok && old != c {
+		panic(fmt.Sprintf("storage: codec id %d registered twice", c.ID()))
+	}
+	codecs[c.ID()] = c
+}
+
+func codecByID(id uint8) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown codec %d", errtype.ErrCodec, id)
+	}
+	return c, nil
+}
+
+// codecAttr encodes AttrCodec, the codec ID followed by the uncompressed size.
+func codecAttr(id uint8, rawSize int) Attribute {
+	v := append([]byte{id}, binary.BigEndian.AppendUint64(nil, uint64(rawSize))...)
+	return Attribute{Type: AttrCodec, Value: v}
+}
+
+func parseCodecAttr(attrs []Attribute) (Codec, uint64, error) {
+	for _, a := range attrs {
+		if a.Type != AttrCodec {
+			continue
+		}
+		if len(a.Value) != 9 {
+			return nil, 0, fmt.Errorf("%w: codec attribute", errtype.ErrAttribute)
+		}
+		c, err := codecByID(a.Value[0])
+		return c, binary.BigEndian.Uint64(a.Value[1:]), err
+	}
+	return nil, 0, fmt.Errorf("%w: compressed needle without codec", errtype.ErrAttribute)
+}
+
+// boundedWriter appends to b and fails once more than limit bytes are written.
+type boundedWriter struct {
+	b     []byte
+	limit int
+}
+
+func (w *boundedWriter) Write(p []byte) (int, error) {
+	if len(w.b)+len(p) > w.limit {
+		return 0, errNoGain
+	}
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+// compress encodes data with c into buf. It reports false when the result
+// doesn't save at least an eighth of data, the payload is stored raw then.
+func compress(c Codec, data, buf []byte) ([]byte, bool, error) {
+	out := &boundedWriter{b: buf[:0], limit: len(data) - len(data)/8}
+
+	zw, err := c.NewWriter(out)
+	if err != nil {
+		return nil, false, err
+	}
+
+	_, err = zw.Write(data)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+
+	if errors.Is(err, errNoGain) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("compress error: %w", err)
+	}
+
+	return out.b, true, nil
+}
+
+// compressNeedle replaces the payload of n with its compressed form written
+// into buf, when the volume has a codec and the payload compresses well.
+func (v *Volume) compressNeedle(n *Needle, buf []byte) error {
+	data, ok, err := compress(v.opts.Codec, n.Data, buf)
+	if err != nil || !ok {
+		return err
+	}
+
+	attrs := append(slices.Clone(n.Attrs), codecAttr(v.opts.Codec.ID(), len(n.Data)))
+	if err := validAttributes(attrs); err != nil {
+		return err
+	}
+
+	size, err := utils.CIU32(len(data))
+	if err != nil {
+		return fmt.Errorf("%w: payload of %d bytes", errtype.ErrToLarge, len(data))
+	}
+
+	n.Data = data
+	n.Attrs = attrs
+	n.Header.Size = size
+	n.Header.Flag |= CompressFlag
+	return nil
+}
+
+// decompress restores the payload of a compressed needle read back whole.
+func decompress(n *Needle) ([]byte, error) {
+	out := new(bytes.Buffer)
+	if _, err := decompressTo(n.Attrs, bytes.NewReader(n.Data), out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// decompressTo writes the uncompressed payload read from r into w.
+func decompressTo(attrs []Attribute, r io.Reader, w io.Writer) (int64, error) {
+	c, rawSize, err := parseCodecAttr(attrs)
+	if err != nil {
+		return 0, err
+	}
+
+	if b, ok := w.(*bytes.Buffer); ok && rawSize <= xlargeSize {
+		b.Grow(int(rawSize))
+	}
+
+	zr, err := c.NewReader(r)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errtype.ErrCodec, err)
+	}
+	defer func() {
+		_ = zr.Close()
+	}()
+
+	// a damaged stream must not inflate without bound
+	n, err := io.Copy(w, io.LimitReader(zr, int64(rawSize)+1))
+	if err != nil {
+		return n, fmt.Errorf("%w: %v", errtype.ErrCodec, err)
+	}
+
+	if uint64(n) != rawSize {
+		return n, fmt.Errorf("%w: decompressed %d bytes, want %d", errtype.ErrCodec, n, rawSize)
+	}
+
+	return n, nil
+}
+
+// flateCodec and gzipCodec reuse their writers, a new flate writer allocates
+// several hundred KB.
+type flateCodec struct {
+	pool  sync.Pool
+	level int
+}
+
+func (c *flateCodec) ID() uint8 {
+	return CodecFlate
+}
+
+func (c *flateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if zw, ok := c.pool.Get().(*flate.Writer); ok {
+		zw.Reset(w)
+		return &pooledWriter{WriteCloser: zw, put: func() { c.pool.Put(zw) }}, nil
+	}
+
+	zw, err := flate.NewWriter(w, c.level)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledWriter{WriteCloser: zw, put: func() { c.pool.Put(zw) }}, nil
+}
+
+func (c *flateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+type gzipCodec struct {
+	pool  sync.Pool
+	level int
+}
+
+func (c *gzipCodec) ID() uint8 {
+	return CodecGzip
+}
+
+func (c *gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if zw, ok := c.pool.Get().(*gzip.Writer); ok {
+		zw.Reset(w)
+		return &pooledWriter{WriteCloser: zw, put: func() { c.pool.Put(zw) }}, nil
+	}
+
+	zw, err := gzip.NewWriterLevel(w, c.level)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledWriter{WriteCloser: zw, put: func() { c.pool.Put(zw) }}, nil
+}
+
+func (c *gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// pooledWriter hands its writer back to the pool once closed.
+type pooledWriter struct {
+	io.WriteCloser
+	put func()
+}
+
+func (w *pooledWriter) Close() error {
+	err := w.WriteCloser.Close()
+	w.put()
+	return err
+}
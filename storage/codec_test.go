@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unregisteredCodec compresses like flate under an ID no reader knows.
+type unregisteredCodec struct {
+	Codec
+}
+
+func (unregisteredCodec) ID() uint8 {
+	return 250
+}
+
+func TestCompress(t *testing.T) {
+	text := bytes.Repeat([]byte("haystack needle "), 100)
+	buf := make([]byte, 0, len(text))
+
+	got, ok, err := compress(FlateCodec, text, buf)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Less(t, len(got), len(text))
+
+	random := make([]byte, 4096)
+	_, _ = rand.Read(random)
+	_, ok, err = compress(GzipCodec, random, make([]byte, 0, len(random)))
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestVolume_Compression(t *testing.T) {
+	text := bytes.Repeat([]byte("haystack needle "), 1000)
+
+	for _, codec := range []Codec{FlateCodec, GzipCodec} {
+		t.Run(fmt.Sprintf("Success_RoundTrip_%d", codec.ID()), func(t *testing.T) {
+			f := setup(t)
+			defer teardown(f, t)
+
+			v, err := NewVolume(f, WithCompression(codec))
+			require.NoError(t, err)
+
+			n := newNeedle(1, string(text))
+			n.SetName("text.txt")
+			require.NoError(t, v.Write(n))
+			assert.Equal(t, uint32(len(text)), n.Header.Size, "the caller's needle is left alone")
+
+			meta := v.index[KeyPair{Key: 1}]
+			assert.Less(t, meta.Size, uint32(len(text)))
+
+			got, err := v.ReadNeedle(KeyPair{Key: 1}, 10)
+			require.NoError(t, err)
+			assert.Equal(t, text, got.Data)
+			assert.Equal(t, "text.txt", got.Name())
+			assert.NotZero(t, got.Header.Flag&CompressFlag)
+			assert.Equal(t, meta.Size, got.Header.Size)
+
+			out := new(bytes.Buffer)
+			written, err := v.ReadTo(KeyPair{Key: 1}, 10, out)
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(text)), written)
+			assert.Equal(t, text, out.Bytes())
+
+			_, err = v.Compact()
+			require.NoError(t, err)
+			require.NoError(t, v.Close())
+
+			// a volume without codec still reads compressed needles
+			reopened := reopenVolume(t, f)
+			data, err := reopened.Read(KeyPair{Key: 1}, 10)
+			require.NoError(t, err)
+			assert.Equal(t, text, data)
+		})
+	}
+
+	t.Run("Success_StoreRaw", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithCompression(FlateCodec))
+		require.NoError(t, err)
+
+		random := make([]byte, 4096)
+		_, _ = rand.Read(random)
+		require.NoError(t, v.Write(newNeedle(1, string(random))))
+		require.NoError(t, v.Write(newNeedle(2, "short")))
+
+		for key, size := range map[uint64]int{1: len(random), 2: len("short")} {
+			got, err := v.ReadNeedle(KeyPair{Key: key}, key*10)
+			require.NoError(t, err)
+			assert.Zero(t, got.Header.Flag&CompressFlag)
+			assert.Equal(t, uint32(size), got.Header.Size)
+			assert.Empty(t, got.Attrs)
+		}
+	})
+
+	t.Run("Error_CRC", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithCompression(FlateCodec))
+		require.NoError(t, err)
+		require.NoError(t, v.Write(newNeedle(1, string(text))))
+
+		meta := v.index[KeyPair{Key: 1}]
+		_, err = f.WriteAt([]byte{0xff, 0xff}, meta.Offset+headerSize(meta.Version)+int64(meta.AttrSize)+int64(meta.Size)/2)
+		require.NoError(t, err)
+
+		_, err = v.Read(KeyPair{Key: 1}, 10)
+		assert.ErrorIs(t, err, errtype.ErrCrcNotValid)
+		_, err = v.ReadTo(KeyPair{Key: 1}, 10, io.Discard)
+		assert.ErrorIs(t, err, errtype.ErrCrcNotValid)
+	})
+
+	t.Run("Error_UnknownCodec", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithCompression(unregisteredCodec{FlateCodec}))
+		require.NoError(t, err)
+		require.NoError(t, v.Write(newNeedle(1, string(text))))
+
+		_, err = v.Read(KeyPair{Key: 1}, 10)
+		assert.ErrorIs(t, err, errtype.ErrCodec)
+	})
+}
@@ -0,0 +1,381 @@
+package storage
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	errtype "github.com/peterouob/file_system/type"
+)
+
+// compactPath returns the path the compacted copy of a data file is built at.
+func compactPath(dataPath string) string {
+	return strings.TrimSuffix(dataPath, filepath.Ext(dataPath)) + ".cpt"
+}
+
+// GarbageRatio returns the share of the data file taken by overwritten needles
+// and tombstones, the space Compact can reclaim.
+func (v *Volume) GarbageRatio() float64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	if v.writeOffset == SuperBlockSize {
+		return 0
+	}
+
+	return float64(v.garbage) / float64(v.writeOffset-SuperBlockSize)
+}
+
+// CompactIfNeeded compacts the volume once its garbage ratio reaches the
+// configured CompactThreshold, it returns the bytes reclaimed.
+func (v *Volume) CompactIfNeeded() (int64, error) {
+	if v.opts.CompactThreshold <= 0 || v.GarbageRatio() < v.opts.CompactThreshold {
+		return 0, nil
+	}
+
+	return v.Compact()
+}
+
+/*
+Compact copies the live needles into a new data file and swaps it in place of
+the old one, it returns the bytes reclaimed. Reads and writes keep going while
+the live needles are copied, WriteFrom waits:
+
+ 1. under v.mu take a snapshot of the index and remember the write offset
+ 2. without the lock copy every needle of the snapshot into the new file
+ 3. under v.mu copy the needles appended since the snapshot, swap the files
+    and install the new index
+
+Needles overwritten or deleted during step 2 are fixed up by the log tail
+replayed in step 3, as the later needle or tombstone wins.
+*/
+func (v *Volume) Compact() (int64, error) {
+	if v.opts.ReadOnly {
+		return 0, errtype.ErrReadOnly
+	}
+
+	v.compactMu.Lock()
+	defer v.compactMu.Unlock()
+
+	// a range WriteFrom reserved isn't in the snapshot, new ones wait for the
+	// swap
+	v.streams.Lock()
+	defer v.streams.Unlock()
+
+	v.mu.RLock()
+	v.scrub.mu.Lock()
+	quarantine := maps.Clone(v.scrub.quarantine)
+	v.scrub.mu.Unlock()
+
+	var content *contentIndex
+	if v.content != nil {
+		content = v.content.clone()
+	}
+
+	var versions *versionIndex
+	if v.versions != nil {
+		versions = v.versions.clone()
+	}
+
+	snapshot := liveNeedles(v.index, content, versions)
+	src, release := v.holdData()
+	start := v.writeOffset
+	v.mu.RUnlock()
+	defer release()
+
+	tmpPath := compactPath(v.path)
+	dst, err := os.OpenFile(filepath.Clean(tmpPath), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("compact error: %w", err)
+	}
+
+	abort := func(err error) (int64, error) {
+		_ = dst.Close()
+		_ = os.Remove(tmpPath)
+		return 0, fmt.Errorf("compact error: %w", err)
+	}
+
+	chunk, err := v.bufferPool.Get(largeSize)
+	if err != nil {
+		return abort(err)
+	}
+	defer v.bufferPool.Put(chunk)
+
+	var (
+		w       = bufio.NewWriterSize(dst, mediumSize)
+		index   = make(map[KeyPair]NeedleMeta, len(snapshot))
+		moved   = make(map[KeyPair]int64)
+		offsets = make(map[int64]int64) // old to new offset of every needle a blob or an older version may sit at
+		buf     = chunk.B[:cap(chunk.B)]
+		written int64
+	)
+
+	n, err := w.Write(v.super.Bytes())
+	if err != nil {
+		return abort(err)
+	}
+	written += int64(n)
+
+	for _, live := range snapshot {
+		n, err := copyRange(w, src, live.meta.Offset, live.meta.length(), buf)
+		if err != nil {
+			return abort(err)
+		}
+
+		if e, ok := quarantine[live.key]; ok && e.Offset == live.meta.Offset {
+			moved[live.key] = written
+		}
+
+		if content != nil || versions != nil {
+			offsets[live.meta.Offset] = written
+		}
+
+		meta := live.meta
+		meta.Offset = written
+		if !live.hidden {
+			index[live.key] = meta
+		}
+		written += n
+	}
+
+	// behind every needle of the snapshot, so they keep the keys of orphans
+	// deleted without dropping a reference, and the versions of deleted keys
+	// handed out
+	for _, t := range append(content.tombstones(index), versions.tombstones(index)...) {
+		tb := t.Bytes(v.bufferPool)
+		n, err := w.Write(tb.B)
+		v.bufferPool.Put(tb)
+		if err != nil {
+			return abort(err)
+		}
+		written += int64(n)
+	}
+
+	if err := w.Flush(); err != nil {
+		return abort(err)
+	}
+
+	// flush the bulk of the copy before blocking writers
+	if err := dst.Sync(); err != nil {
+		return abort(err)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	tailStart := written
+	tail, err := copyRange(w, src, start, v.writeOffset-start, buf)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err != nil {
+		return abort(err)
+	}
+	written += tail
+
+	if content != nil {
+		for _, b := range content.blobs {
+			b.meta.Offset = offsets[b.meta.Offset]
+		}
+	}
+	if versions != nil {
+		for _, h := range versions.keys {
+			for i := range h.old {
+				h.old[i].Offset = offsets[h.old[i].Offset]
+			}
+		}
+	}
+
+	// the snapshot is stale, the log tail decides which of its needles survive
+	var batch batchLog
+	if _, err := scanNeedles(dst, tailStart, written, v.bufferPool, func(rec needleRecord) error {
+		batch.add(rec, func(rec needleRecord) {
+			v.applyRecord(index, content, versions, rec)
+		})
+		return nil
+	}); err != nil {
+		return abort(err)
+	}
+
+	if err := os.Rename(tmpPath, v.path); err != nil {
+		return abort(err)
+	}
+
+	if err := syncDir(filepath.Dir(v.path)); err != nil {
+		return 0, fmt.Errorf("compact error: %w", err)
+	}
+
+	reclaimed := v.writeOffset - written
+
+	v.retireData()
+	v.dataFile = dst
+	v.ownsData = true
+	v.index = index
+	if content != nil {
+		// Write checks v.content without the lock, the pointer stays put
+		*v.content = *content
+	}
+	if versions != nil {
+		*v.versions = *versions
+	}
+	v.writeOffset = written
+	v.garbage = written - SuperBlockSize - content.liveBytes(index) - versions.historyBytes()
+	v.scrub.compacted(moved, index)
+
+	// the new file was synced above, writers waiting on the old one are done
+	v.group.reset(written)
+
+	if err := v.idx.checkpoint(v.index, v.writeOffset); err != nil {
+		return reclaimed, fmt.Errorf("compact error: %w", err)
+	}
+
+	return reclaimed, nil
+}
+
+// liveNeedles returns the needles of index and the ones content and versions
+// keep hidden, in file order so the data file is read sequentially. The
+// histories of versions are trimmed to the retention on the way.
+func liveNeedles(index map[KeyPair]NeedleMeta, content *contentIndex, versions *versionIndex) []liveNeedle {
+	live := make([]liveNeedle, 0, len(index))
+	for key, meta := range index {
+		live = append(live, liveNeedle{key: key, meta: meta})
+	}
+
+	if content != nil {
+		live = append(live, content.orphans(index)...)
+	}
+	if versions != nil {
+		live = append(live, versions.retained(time.Now().UnixNano())...)
+	}
+
+	slices.SortFunc(live, func(a, b liveNeedle) int {
+		return cmp.Compare(a.meta.Offset, b.meta.Offset)
+	})
+	return live
+}
+
+// liveNeedle is a needle of the index taken out of the lock.
+type liveNeedle struct {
+	key    KeyPair
+	meta   NeedleMeta
+	hidden bool // copied, but not part of the index: a blob kept for its references or an older version
+}
+
+// copyRange copies n bytes of r starting at off into w through buf.
+func copyRange(w io.Writer, r io.ReaderAt, off, n int64, buf []byte) (int64, error) {
+	var copied int64
+
+	for copied < n {
+		chunk := buf[:min(n-copied, int64(len(buf)))]
+		if _, err := r.ReadAt(chunk, off+copied); err != nil {
+			return copied, err
+		}
+
+		if _, err := w.Write(chunk); err != nil {
+			return copied, err
+		}
+		copied += int64(len(chunk))
+	}
+
+	return copied, nil
+}
+
+/*
+fileRefs closes the data files compaction and migration replaced once no read
+holds them any more
+
+	holds    reads holding each data file
+	retired  replaced data files closed by the last release
+
+A read takes its hold under v.mu, so the file it got can't be retired before
+the hold is counted.
+*/
+type fileRefs struct {
+	mu      sync.Mutex
+	holds   map[*os.File]int
+	retired map[*os.File]bool
+}
+
+func (r *fileRefs) hold(f *os.File) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.holds == nil {
+		r.holds = make(map[*os.File]int)
+	}
+	r.holds[f]++
+}
+
+func (r *fileRefs) release(f *os.File) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.holds[f]--; r.holds[f] > 0 {
+		return
+	}
+	delete(r.holds, f)
+
+	if r.retired[f] {
+		delete(r.retired, f)
+		_ = f.Close()
+	}
+}
+
+// retire closes f now when no read holds it, or leaves it to the last release.
+func (r *fileRefs) retire(f *os.File) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.holds[f] == 0 {
+		_ = f.Close()
+		return
+	}
+
+	if r.retired == nil {
+		r.retired = make(map[*os.File]bool)
+	}
+	r.retired[f] = true
+}
+
+// close closes the retired files reads still hold, the volume is closing.
+func (r *fileRefs) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var errs []error
+	for f := range r.retired {
+		errs = append(errs, f.Close())
+	}
+	r.retired = nil
+	return errors.Join(errs...)
+}
+
+// holdData returns the data file and keeps it open until release is called, a
+// compaction swapping it meanwhile leaves closing it to release. v.mu must be
+// held.
+func (v *Volume) holdData() (*os.File, func()) {
+	f := v.dataFile
+	v.files.hold(f)
+	return f, func() { v.files.release(f) }
+}
+
+// retireData hands the data file about to be replaced to v.files, which closes
+// it once the reads holding it are done. A data file the caller opened is left
+// open. v.mu must be held for writing.
+func (v *Volume) retireData() {
+	if v.ownsData {
+		v.files.retire(v.dataFile)
+	}
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolume_Compact(t *testing.T) {
+	t.Run("Success_ReclaimOverwrites", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		for i := range 10 {
+			require.NoError(t, v.Write(newRandomNeedle(uint64(i), 100)))
+		}
+		for i := range 5 {
+			require.NoError(t, v.Write(newRandomNeedle(uint64(i), 200)))
+		}
+		assert.Greater(t, v.GarbageRatio(), 0.0)
+
+		before := v.writeOffset
+		reclaimed, err := v.Compact()
+		require.NoError(t, err)
+
+		assert.Equal(t, 5*needleLength(NeedleVersion2, 0, 100), reclaimed)
+		assert.Equal(t, before-reclaimed, v.writeOffset)
+		assert.Equal(t, 0.0, v.GarbageRatio())
+
+		for i := range 10 {
+			got, err := v.Read(KeyPair{Key: uint64(i)}, 0)
+			require.NoError(t, err)
+			assert.Equal(t, byte(i), got[0])
+		}
+
+		fi, err := os.Stat(f.Name())
+		require.NoError(t, err)
+		assert.Equal(t, v.writeOffset, fi.Size())
+
+		_, err = os.Stat(compactPath(f.Name()))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		require.NoError(t, v.Close())
+
+		reopened, err := os.OpenFile(f.Name(), os.O_RDWR, 0600)
+		require.NoError(t, err)
+		defer func() {
+			_ = reopened.Close()
+		}()
+
+		reloaded, err := NewVolume(reopened)
+		require.NoError(t, err)
+		assert.Equal(t, v.index, reloaded.index)
+	})
+
+	t.Run("Success_ConcurrentWrites", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+
+		for i := range 100 {
+			require.NoError(t, v.Write(newRandomNeedle(uint64(i), 512)))
+			require.NoError(t, v.Write(newRandomNeedle(uint64(i), 512)))
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 100; i < 200; i++ {
+				assert.NoError(t, v.Write(newRandomNeedle(uint64(i), 512)))
+			}
+		}()
+
+		_, err := v.Compact()
+		require.NoError(t, err)
+		wg.Wait()
+
+		assert.Len(t, v.index, 200)
+		for i := range 200 {
+			got, err := v.Read(KeyPair{Key: uint64(i)}, 0)
+			require.NoError(t, err)
+			assert.Equal(t, byte(i), got[0])
+		}
+	})
+
+	t.Run("Success_ClosesRetiredFile", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		for i := range 10 {
+			require.NoError(t, v.Write(newRandomNeedle(uint64(i), 100)))
+		}
+
+		// the file the caller passed in stays open, the volume didn't open it
+		_, err := v.Compact()
+		require.NoError(t, err)
+		_, err = f.Stat()
+		require.NoError(t, err)
+
+		// a file no read holds is closed right away
+		first := v.dataFile
+		_, err = v.Compact()
+		require.NoError(t, err)
+		_, err = first.Stat()
+		assert.ErrorIs(t, err, os.ErrClosed)
+
+		// a file a read holds is closed by the release of the last hold
+		v.mu.RLock()
+		held, release := v.holdData()
+		_, release2 := v.holdData()
+		v.mu.RUnlock()
+
+		_, err = v.Compact()
+		require.NoError(t, err)
+		_, err = held.Stat()
+		require.NoError(t, err)
+
+		release()
+		_, err = held.Stat()
+		require.NoError(t, err)
+		release2()
+		_, err = held.Stat()
+		assert.ErrorIs(t, err, os.ErrClosed)
+		assert.Empty(t, v.files.holds)
+		assert.Empty(t, v.files.retired)
+
+		for i := range 10 {
+			got, err := v.Read(KeyPair{Key: uint64(i)}, 0)
+			require.NoError(t, err)
+			assert.Equal(t, byte(i), got[0])
+		}
+		require.NoError(t, v.Close())
+	})
+
+	t.Run("Success_CompactIfNeeded", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+		v.opts.CompactThreshold = 0.4
+
+		for i := range 4 {
+			require.NoError(t, v.Write(newRandomNeedle(uint64(i), 100)))
+		}
+		require.NoError(t, v.Write(newRandomNeedle(0, 100)))
+
+		reclaimed, err := v.CompactIfNeeded()
+		require.NoError(t, err)
+		assert.Zero(t, reclaimed)
+
+		require.NoError(t, v.Write(newRandomNeedle(1, 100)))
+		require.NoError(t, v.Write(newRandomNeedle(2, 100)))
+
+		reclaimed, err = v.CompactIfNeeded()
+		require.NoError(t, err)
+		assert.Equal(t, 3*needleLength(NeedleVersion2, 0, 100), reclaimed)
+	})
+}
@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"cmp"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"slices"
+
+	errtype "github.com/peterouob/file_system/type"
+)
+
+// RefFlag marks a reference needle, it carries no payload and reads the content
+// of the needle with the same AttrHash instead.
+const RefFlag byte = 1 << 3
+
+// dedupMinSize is the smallest payload worth sharing, a reference needle costs
+// about as much as a payload below it.
+const dedupMinSize = 128
+
+type contentHash [sha256.Size]byte
+
+/*
+contentIndex keeps the payloads a dedup volume shares between keys
+
+	blobs the needle holding each content, with the number of keys referring to it
+	keys  the content each key refers to
+
+A blob outlives the key it was written under as long as other keys refer to it,
+it turns into garbage once the last reference is gone. The content index isn't
+kept in the index file, a dedup volume rebuilds it from a scan of its data file
+on open.
+*/
+type contentIndex struct {
+	blobs map[contentHash]*blob
+	keys  map[KeyPair]contentHash
+}
+
+type blob struct {
+	meta   NeedleMeta
+	key    KeyPair // the key the needle was written under
+	cookie uint64
+	refs   int
+}
+
+func newContentIndex() *contentIndex {
+	return &contentIndex{
+		blobs: make(map[contentHash]*blob),
+		keys:  make(map[KeyPair]contentHash),
+	}
+}
+
+func attrHash(attrs []Attribute) (contentHash, bool) {
+	for _, a := range attrs {
+		if a.Type == AttrHash && len(a.Value) == sha256.Size {
+			return contentHash(a.Value), true
+		}
+	}
+	return contentHash{}, false
+}
+
+// clone copies c, compaction moves the blobs of the copy.
+func (c *contentIndex) clone() *contentIndex {
+	cc := &contentIndex{
+		blobs: make(map[contentHash]*blob, len(c.blobs)),
+		keys:  make(map[KeyPair]contentHash, len(c.keys)),
+	}
+	for sum, b := range c.blobs {
+		bb := *b
+		cc.blobs[sum] = &bb
+	}
+	for key, sum := range c.keys {
+		cc.keys[key] = sum
+	}
+	return cc
+}
+
+// apply links key to the content of the needle h at meta it now points at. A
+// needle with AttrHash holds the content, or refers to it with RefFlag.
+func (c *contentIndex) apply(key KeyPair, h NeedleHeader, meta NeedleMeta, attrs []Attribute) {
+	if c == nil {
+		return
+	}
+
+	sum, ok := attrHash(attrs)
+	if !ok {
+		return
+	}
+
+	b, ok := c.blobs[sum]
+	if !ok {
+		if h.Flag&RefFlag != 0 {
+			// the content is gone, reading the key reports it
+			return
+		}
+		b = &blob{meta: meta, key: key, cookie: h.Cookie}
+		c.blobs[sum] = b
+	}
+
+	b.refs++
+	c.keys[key] = sum
+}
+
+// link points key at the needle h at meta, away from the needle at old when it
+// had one, and returns the bytes that turned into garbage. The new reference is
+// taken before the old one is dropped, so content written again under its own
+// key is never let go in between.
+func (c *contentIndex) link(key KeyPair, h NeedleHeader, meta NeedleMeta, attrs []Attribute, old *NeedleMeta) int64 {
+	if old == nil {
+		c.apply(key, h, meta, attrs)
+		return 0
+	}
+
+	if c == nil {
+		return old.length()
+	}
+
+	prev, linked := c.keys[key]
+	delete(c.keys, key)
+	c.apply(key, h, meta, attrs)
+
+	if !linked {
+		return old.length()
+	}
+	return c.unref(prev, *old)
+}
+
+// release drops the reference of key, whose needle at meta is deleted, and
+// returns the bytes that turned into garbage.
+func (c *contentIndex) release(key KeyPair, meta NeedleMeta) int64 {
+	if c == nil {
+		return meta.length()
+	}
+
+	sum, ok := c.keys[key]
+	if !ok {
+		return meta.length()
+	}
+	delete(c.keys, key)
+
+	return c.unref(sum, meta)
+}
+
+// unref drops one reference to sum held through the needle at meta.
+func (c *contentIndex) unref(sum contentHash, meta NeedleMeta) int64 {
+	b := c.blobs[sum]
+	b.refs--
+
+	var garbage int64
+	if meta.Offset != b.meta.Offset {
+		garbage += meta.length()
+	}
+	if b.refs == 0 {
+		delete(c.blobs, sum)
+		garbage += b.meta.length()
+	}
+
+	return garbage
+}
+
+// shared reports whether the needle of key at meta holds content other keys
+// still refer to.
+func (c *contentIndex) shared(key KeyPair, meta NeedleMeta) bool {
+	if c == nil {
+		return false
+	}
+
+	sum, ok := c.keys[key]
+	if !ok {
+		return false
+	}
+	b := c.blobs[sum]
+	return b.meta.Offset == meta.Offset && b.refs > 1
+}
+
+// orphans returns the blobs whose needle index no longer points at, they are
+// only kept alive by references.
+func (c *contentIndex) orphans(index map[KeyPair]NeedleMeta) []liveNeedle {
+	var orphans []liveNeedle
+	for _, b := range c.blobs {
+		if meta, ok := index[b.key]; !ok || meta.Offset != b.meta.Offset {
+			orphans = append(orphans, liveNeedle{key: b.key, meta: b.meta, hidden: true})
+		}
+	}
+	return orphans
+}
+
+/*
+tombstones returns a tombstone for every orphan whose key is deleted. An orphan
+copied on its own still carries the key it was written under, replaying it
+would bring the key back, so the tombstone has to follow it and every reference
+to it.
+*/
+func (c *contentIndex) tombstones(index map[KeyPair]NeedleMeta) []Needle {
+	if c == nil {
+		return nil
+	}
+
+	var deleted []*blob
+	for _, b := range c.blobs {
+		if _, ok := index[b.key]; !ok {
+			deleted = append(deleted, b)
+		}
+	}
+	slices.SortFunc(deleted, func(a, b *blob) int {
+		return cmp.Compare(a.meta.Offset, b.meta.Offset)
+	})
+
+	tombstones := make([]Needle, len(deleted))
+	for i, b := range deleted {
+		tombstones[i] = tombstoneNeedle(b.key, b.cookie)
+	}
+	return tombstones
+}
+
+// liveBytes returns the bytes taken by the needles of index and the blobs only
+// kept alive by references.
+func (c *contentIndex) liveBytes(index map[KeyPair]NeedleMeta) int64 {
+	n := liveBytes(index)
+	if c == nil {
+		return n
+	}
+
+	for _, o := range c.orphans(index) {
+		n += o.meta.length()
+	}
+	return n
+}
+
+// contentSum returns the hash AttrHash keeps of data. On an encrypted volume it
+// is an HMAC keyed from the current volume key, a plain SHA-256 stored in the
+// clear would tell anyone holding a guess at the payload whether it is right.
+// Content written under an older key isn't shared with content written after
+// a key rotation.
+func contentSum(keys KeyProvider, data []byte) (contentHash, error) {
+	if keys == nil {
+		return sha256.Sum256(data), nil
+	}
+
+	_, key, err := keys.CurrentKey()
+	if err != nil {
+		return contentHash{}, fmt.Errorf("%w: %v", errtype.ErrEncryption, err)
+	}
+
+	hashKey, err := hkdf.Key(sha256.New, key, nil, "content hash", sha256.Size)
+	if err != nil {
+		return contentHash{}, fmt.Errorf("%w: %v", errtype.ErrEncryption, err)
+	}
+
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write(data)
+	return contentHash(mac.Sum(nil)), nil
+}
+
+// dedup tags n with the hash of its payload and appends a reference needle in
+// its place when the volume already holds the same content. It reports whether
+// the reference was written, n is written as usual otherwise.
+func (v *Volume) dedup(n *Needle) (bool, error) {
+	sum, err := contentSum(v.opts.Keys, n.Data)
+	if err != nil {
+		return false, err
+	}
+	n.Attrs = slices.Clone(n.Attrs)
+	n.SetAttr(AttrHash, sum[:])
+
+	if err := validAttributes(n.Attrs); err != nil {
+		return false, err
+	}
+
+	ref := *n
+	ref.Data = nil
+	ref.Header.Size = 0
+	ref.Header.Flag |= RefFlag
+
+	buf := ref.Bytes(v.bufferPool)
+	defer v.bufferPool.Put(buf)
+
+	p, ok, err := func() (commitPoint, bool, error) {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+
+		if _, ok := v.content.blobs[sum]; !ok {
+			return commitPoint{}, false, nil
+		}
+
+		p, err := v.writeLocked(&ref, buf)
+		return p, true, err
+	}()
+
+	if err != nil || !ok {
+		return false, err
+	}
+
+	return true, v.commit(p)
+}
+
+// resolve finds the needle holding the content a reference needle refers to
+// and the data file it is in, which stays open until release is called.
+func (v *Volume) resolve(ref *Needle) (blob, *os.File, func(), error) {
+	sum, ok := attrHash(ref.Attrs)
+	if !ok {
+		return blob{}, nil, nil, fmt.Errorf("%w: reference needle without hash", errtype.ErrAttribute)
+	}
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	if v.content == nil {
+		return blob{}, nil, nil, fmt.Errorf("%w: reference needle in a volume without dedup", errtype.ErrCorruptVolume)
+	}
+
+	b, ok := v.content.blobs[sum]
+	if !ok {
+		return blob{}, nil, nil, fmt.Errorf("%w: content %x of key %d is gone", errtype.ErrCorruptVolume, sum[:8], ref.Header.Key)
+	}
+
+	f, release := v.holdData()
+	return *b, f, release, nil
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"testing"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolume_Dedup(t *testing.T) {
+	payload := string(bytes.Repeat([]byte("shared blob "), 100))
+
+	readAll := func(t *testing.T, v *Volume, keys ...uint64) {
+		t.Helper()
+		for _, key := range keys {
+			data, err := v.Read(KeyPair{Key: key}, key*10)
+			require.NoError(t, err, "key %d", key)
+			assert.Equal(t, payload, string(data))
+
+			out := new(bytes.Buffer)
+			_, err = v.ReadTo(KeyPair{Key: key}, key*10, out)
+			require.NoError(t, err, "key %d", key)
+			assert.Equal(t, payload, out.String())
+		}
+	}
+
+	t.Run("Success_Shared", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithDedup(), WithCompression(FlateCodec))
+		require.NoError(t, err)
+
+		require.NoError(t, v.Write(newNeedle(1, payload)))
+		first := v.writeOffset
+
+		n := newNeedle(2, payload)
+		n.SetName("copy.txt")
+		require.NoError(t, v.Write(n))
+		require.NoError(t, v.Write(newNeedle(3, payload)))
+		assert.Less(t, v.writeOffset-first, 2*(first-SuperBlockSize), "duplicates are stored as references")
+		assert.Len(t, v.content.blobs, 1)
+
+		got, err := v.ReadNeedle(KeyPair{Key: 2}, 20)
+		require.NoError(t, err)
+		assert.Equal(t, "copy.txt", got.Name())
+		assert.NotZero(t, got.Header.Flag&RefFlag)
+		readAll(t, v, 1, 2, 3)
+
+		// the content outlives the key it was written under
+		require.NoError(t, v.Delete(KeyPair{Key: 1}, 10))
+		_, err = v.Read(KeyPair{Key: 1}, 10)
+		assert.ErrorIs(t, err, errtype.ErrNotFound)
+		readAll(t, v, 2, 3)
+		require.NoError(t, v.Close())
+
+		v = reopenVolume(t, f)
+		readAll(t, v, 2, 3)
+		for _, b := range v.content.blobs {
+			assert.Equal(t, 2, b.refs)
+		}
+
+		_, err = v.Compact()
+		require.NoError(t, err)
+		readAll(t, v, 2, 3)
+		// all that is left is the tombstone keeping key 1 deleted
+		assert.Equal(t, tombstoneNeedle(KeyPair{Key: 1}, 10).Header.length(), v.garbage)
+
+		// the last reference lets the content go
+		require.NoError(t, v.Delete(KeyPair{Key: 2}, 20))
+		require.NoError(t, v.Delete(KeyPair{Key: 3}, 30))
+		assert.Empty(t, v.content.blobs)
+		assert.Equal(t, v.writeOffset-SuperBlockSize, v.garbage)
+
+		_, err = v.Compact()
+		require.NoError(t, err)
+		assert.Equal(t, int64(SuperBlockSize), v.writeOffset)
+	})
+
+	t.Run("Success_DeletedOwnerStaysDeleted", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithDedup())
+		require.NoError(t, err)
+		require.NoError(t, v.Write(newNeedle(1, payload)))
+		require.NoError(t, v.Write(newNeedle(2, payload)))
+		require.NoError(t, v.Delete(KeyPair{Key: 1}, 10))
+
+		_, err = v.Compact()
+		require.NoError(t, err)
+		require.NoError(t, v.Close())
+
+		// the blob is copied under key 1, its tombstone comes along
+		for _, reopen := range []func() *Volume{
+			func() *Volume { return reopenVolume(t, f) },
+			func() *Volume {
+				v := reopenVolume(t, f)
+				require.NoError(t, v.Reload())
+				return v
+			},
+		} {
+			v = reopen()
+			_, err = v.Read(KeyPair{Key: 1}, 10)
+			assert.ErrorIs(t, err, errtype.ErrNotFound)
+			readAll(t, v, 2)
+		}
+
+		// written again the key is back, the old tombstone doesn't delete it
+		require.NoError(t, v.Write(newNeedle(1, "again")))
+		_, err = v.Compact()
+		require.NoError(t, err)
+		require.NoError(t, v.Reload())
+		data, err := v.Read(KeyPair{Key: 1}, 10)
+		require.NoError(t, err)
+		assert.Equal(t, "again", string(data))
+		readAll(t, v, 2)
+	})
+
+	t.Run("Success_RewriteSameKey", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithDedup())
+		require.NoError(t, err)
+
+		require.NoError(t, v.Write(newNeedle(1, payload)))
+		require.NoError(t, v.Write(newNeedle(1, payload)))
+		readAll(t, v, 1)
+		require.NoError(t, v.Close())
+
+		v = reopenVolume(t, f)
+		readAll(t, v, 1)
+
+		require.NoError(t, v.Write(newNeedle(1, "other")))
+		assert.Empty(t, v.content.blobs)
+		assert.Equal(t, v.writeOffset-SuperBlockSize-v.index[KeyPair{Key: 1}].length(), v.garbage)
+	})
+
+	t.Run("Success_Encrypted", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		keys := StaticKey(bytes.Repeat([]byte{7}, 32))
+		v, err := NewVolume(f, WithDedup(), WithEncryption(keys))
+		require.NoError(t, err)
+		require.NoError(t, v.Write(newNeedle(1, payload)))
+		require.NoError(t, v.Write(newNeedle(2, payload)))
+		assert.Len(t, v.content.blobs, 1)
+		readAll(t, v, 1, 2)
+		require.NoError(t, v.Close())
+
+		// the plain hash of the payload never reaches the disk
+		sum := sha256.Sum256([]byte(payload))
+		b, err := os.ReadFile(f.Name())
+		require.NoError(t, err)
+		assert.False(t, bytes.Contains(b, sum[:]))
+
+		reopened, err := os.OpenFile(f.Name(), os.O_RDWR, 0600)
+		require.NoError(t, err)
+		defer func() {
+			_ = reopened.Close()
+		}()
+		v, err = NewVolume(reopened, WithEncryption(keys))
+		require.NoError(t, err)
+		readAll(t, v, 1, 2)
+		require.NoError(t, v.Write(newNeedle(3, payload)))
+		assert.Len(t, v.content.blobs, 1)
+		readAll(t, v, 1, 2, 3)
+	})
+
+	t.Run("Success_Feature", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithDedup())
+		require.NoError(t, err)
+		require.NoError(t, v.Write(newNeedle(1, payload)))
+		require.NoError(t, v.Write(newNeedle(2, payload)))
+		require.NoError(t, v.Close())
+
+		// the superblock keeps the volume in dedup mode
+		v = reopenVolume(t, f)
+		assert.NotZero(t, v.super.Features&FeatureDedup)
+		readAll(t, v, 1, 2)
+
+		plain, _ := setupTestVolume(t)
+		require.NoError(t, plain.Write(newNeedle(1, payload)))
+		require.NoError(t, plain.Write(newNeedle(2, payload)))
+		assert.Nil(t, plain.content)
+	})
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Durability decides when an acknowledged Write or Delete is on stable storage.
+type Durability uint8
+
+const (
+	// DurabilityNone leaves flushing to the OS, a power loss can lose acknowledged writes.
+	DurabilityNone Durability = iota
+	// DurabilitySync fdatasyncs the data file before every write returns.
+	DurabilitySync
+	// DurabilityGroupCommit lets the writers queued behind each other share one fdatasync.
+	DurabilityGroupCommit
+)
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityNone:
+		return "none"
+	case DurabilitySync:
+		return "sync"
+	case DurabilityGroupCommit:
+		return "group"
+	default:
+		return fmt.Sprintf("Durability(%d)", d)
+	}
+}
+
+// commitPoint is where a write ended in the data file it was appended to.
+type commitPoint struct {
+	file *os.File
+	end  int64
+	gen  uint64
+}
+
+/*
+groupCommit batches fdatasync calls of concurrent writers. The first writer to
+wait becomes the leader and syncs the data file up to the current write offset,
+every writer that appended in the meantime is covered by that one call and only
+waits for it. Writers that arrive while a sync is running are covered by the
+next one.
+
+Compaction swaps the data file and syncs the new one itself, it bumps gen so
+writers waiting on the old file return and a sync of the old file that is still
+running doesn't count for the new one.
+*/
+type groupCommit struct {
+	cond    *sync.Cond
+	mu      sync.Mutex
+	synced  int64 // the data file is durable up to here
+	gen     uint64
+	syncs   uint64 // number of fdatasync calls, for observing the batching
+	syncing bool
+}
+
+func newGroupCommit() *groupCommit {
+	g := &groupCommit{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// wait returns once the data file is durable up to p. sync flushes the current
+// data file and returns the offset it is durable up to.
+func (g *groupCommit) wait(p commitPoint, sync func() (int64, error)) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for g.gen == p.gen && g.synced < p.end {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+
+		g.syncing = true
+		gen := g.gen
+		g.mu.Unlock()
+
+		end, err := sync()
+
+		g.mu.Lock()
+		g.syncing = false
+		g.syncs++
+		if err == nil && g.gen == gen && end > g.synced {
+			g.synced = end
+		}
+		g.cond.Broadcast()
+
+		if err != nil {
+			return fmt.Errorf("group commit error: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// reset starts a new generation for a data file that is durable up to synced.
+func (g *groupCommit) reset(synced int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.gen++
+	g.synced = synced
+	g.cond.Broadcast()
+}
+
+// rewind lowers what is durable to end after the data file was cut back there,
+// the needles appended next have to be synced again.
+func (g *groupCommit) rewind(end int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.synced = min(g.synced, end)
+}
+
+// point returns the commit point of a write that ended at end. v.mu must be held.
+func (v *Volume) point(end int64) commitPoint {
+	v.group.mu.Lock()
+	defer v.group.mu.Unlock()
+
+	return commitPoint{file: v.dataFile, end: end, gen: v.group.gen}
+}
+
+// commit returns once the write ending at p is durable under the volume's
+// durability policy.
+func (v *Volume) commit(p commitPoint) error {
+	// nothing was appended
+	if p.file == nil {
+		return nil
+	}
+
+	switch v.opts.Durability {
+	case DurabilitySync:
+		return v.syncPoint(p)
+	case DurabilityGroupCommit:
+		return v.group.wait(p, v.syncData)
+	default:
+		return nil
+	}
+}
+
+// syncPoint syncs the data file the write ending at p went to. A compaction
+// that swapped the file since synced the copy the write was moved to.
+func (v *Volume) syncPoint(p commitPoint) error {
+	v.mu.RLock()
+	f, release := v.holdData()
+	v.mu.RUnlock()
+	defer release()
+
+	if f != p.file {
+		return nil
+	}
+
+	if err := fdatasync(f); err != nil {
+		return fmt.Errorf("sync error: %w", err)
+	}
+	return nil
+}
+
+func (v *Volume) syncData() (int64, error) {
+	v.mu.RLock()
+	f, release := v.holdData()
+	end := v.writeOffset
+	v.mu.RUnlock()
+	defer release()
+
+	return end, fdatasync(f)
+}
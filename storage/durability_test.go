@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolume_Durability(t *testing.T) {
+	for _, d := range []Durability{DurabilityNone, DurabilitySync, DurabilityGroupCommit} {
+		t.Run(d.String(), func(t *testing.T) {
+			v, _, cleanup := setupTempVolume(t, WithDurability(d))
+			defer cleanup()
+
+			var wg sync.WaitGroup
+			for w := range 8 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range 20 {
+						assert.NoError(t, v.Write(newRandomNeedle(uint64(w*100+i), 256)))
+					}
+				}()
+			}
+			wg.Wait()
+
+			assert.Len(t, v.index, 160)
+			for key := range v.index {
+				got, err := v.Read(key, 0)
+				require.NoError(t, err)
+				assert.Equal(t, byte(key.Key), got[0])
+			}
+
+			if d == DurabilityGroupCommit {
+				// how many writes share a sync depends on the scheduler, see
+				// TestGroupCommit for the batching itself
+				assert.Equal(t, v.writeOffset, v.group.synced)
+				assert.NotZero(t, v.group.syncs)
+			}
+		})
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	t.Run("Success_SyncOnce", func(t *testing.T) {
+		g := newGroupCommit()
+
+		calls := 0
+		sync := func() (int64, error) {
+			calls++
+			return 200, nil
+		}
+
+		require.NoError(t, g.wait(commitPoint{end: 100}, sync))
+		require.NoError(t, g.wait(commitPoint{end: 200}, sync))
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, int64(200), g.synced)
+	})
+
+	t.Run("Success_Batched", func(t *testing.T) {
+		g := newGroupCommit()
+		const writers = 50
+
+		var arrived, calls atomic.Int64
+		flush := func() (int64, error) {
+			calls.Add(1)
+			// every writer appended before it waits, the leader syncs all of
+			// it while they wait
+			for arrived.Load() < writers {
+				runtime.Gosched()
+			}
+			return writers * 100, nil
+		}
+
+		var wg sync.WaitGroup
+		for w := range writers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				arrived.Add(1)
+				assert.NoError(t, g.wait(commitPoint{end: int64(w+1) * 100}, flush))
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, int64(1), calls.Load())
+		assert.Equal(t, uint64(1), g.syncs)
+		assert.Equal(t, int64(writers*100), g.synced)
+	})
+
+	t.Run("Success_StaleGeneration", func(t *testing.T) {
+		g := newGroupCommit()
+		g.reset(10)
+
+		err := g.wait(commitPoint{end: 100}, func() (int64, error) {
+			t.Fatal("a write of an old generation must not sync")
+			return 0, nil
+		})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Error_Sync", func(t *testing.T) {
+		g := newGroupCommit()
+		errSync := errors.New("disk gone")
+
+		err := g.wait(commitPoint{end: 100}, func() (int64, error) {
+			return 0, errSync
+		})
+		assert.ErrorIs(t, err, errSync)
+		assert.Zero(t, g.synced)
+	})
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/peterouob/file_system/utils"
+)
+
+// EncryptFlag marks a needle whose payload is sealed with AES-GCM.
+const EncryptFlag byte = 1 << 2
+
+/*
+KeyProvider hands out the AES keys needles are sealed with, 16, 24 or 32 bytes
+for AES-128, AES-192 or AES-256. An encrypted needle keeps
+
+	Size       the sealed size, the payload plus the GCM tag
+	CRC        the checksum over the sealed bytes, so a volume is verified
+	           without its keys
+	AttrCipher the ID of the key and the nonce
+
+the header and the attributes are bound as associated data with the DeleteFlag
+masked out, so a needle is deleted in place without breaking its seal. A key
+rotated out must stay available through Key until no needle uses it anymore.
+*/
+type KeyProvider interface {
+	// CurrentKey returns the key new needles are sealed with and its ID.
+	CurrentKey() (uint32, []byte, error)
+	// Key returns the key with the given ID.
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKey is a KeyProvider with a single key under ID 0.
+type StaticKey []byte
+
+func (k StaticKey) CurrentKey() (uint32, []byte, error) {
+	return 0, k, nil
+}
+
+func (k StaticKey) Key(id uint32) ([]byte, error) {
+	if id != 0 {
+		return nil, fmt.Errorf("%w: unknown key %d", errtype.ErrEncryption, id)
+	}
+	return k, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errtype.ErrEncryption, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// cipherAttr encodes AttrCipher, the key ID followed by the nonce.
+func cipherAttr(id uint32, nonce []byte) Attribute {
+	return Attribute{Type: AttrCipher, Value: append(binary.BigEndian.AppendUint32(nil, id), nonce...)}
+}
+
+func parseCipherAttr(attrs []Attribute) (uint32, []byte, error) {
+	for _, a := range attrs {
+		if a.Type != AttrCipher {
+			continue
+		}
+		if len(a.Value) < 4 {
+			return 0, nil, fmt.Errorf("%w: cipher attribute", errtype.ErrAttribute)
+		}
+		return binary.BigEndian.Uint32(a.Value), a.Value[4:], nil
+	}
+	return 0, nil, fmt.Errorf("%w: encrypted needle without cipher", errtype.ErrAttribute)
+}
+
+// sealedData returns the associated data of the needle h with attrs, its
+// header and attributes as stored with the DeleteFlag masked out.
+func sealedData(h NeedleHeader, attrs []Attribute) []byte {
+	h.Flag &^= DeleteFlag
+	h.AttrSize = uint16(attributesSize(attrs))
+	return appendAttributes(appendNeedleHeader(nil, h), attrs)
+}
+
+// sealNeedle replaces the payload of n with its sealed form, it has to run
+// after everything else about the header of n is settled.
+func sealNeedle(keys KeyProvider, n *Needle) error {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errtype.ErrEncryption, err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	attrs := append(slices.Clone(n.Attrs), cipherAttr(id, nonce))
+	if err := validAttributes(attrs); err != nil {
+		return err
+	}
+
+	size, err := utils.CIU32(len(n.Data) + gcm.Overhead())
+	if err != nil {
+		return fmt.Errorf("%w: payload of %d bytes", errtype.ErrToLarge, len(n.Data))
+	}
+
+	n.Attrs = attrs
+	n.Header.Flag |= EncryptFlag
+	n.Header.Size = size
+	n.Data = gcm.Seal(nil, nonce, n.Data, sealedData(n.Header, attrs))
+	return nil
+}
+
+// openNeedle replaces the payload of an encrypted needle with its plain form.
+func openNeedle(keys KeyProvider, n *Needle) error {
+	if keys == nil {
+		return fmt.Errorf("%w: encrypted needle without key provider", errtype.ErrEncryption)
+	}
+
+	id, nonce, err := parseCipherAttr(n.Attrs)
+	if err != nil {
+		return err
+	}
+
+	key, err := keys.Key(id)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errtype.ErrEncryption, err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	if len(nonce) != gcm.NonceSize() {
+		return fmt.Errorf("%w: nonce of %d bytes", errtype.ErrEncryption, len(nonce))
+	}
+
+	data, err := gcm.Open(n.Data[:0], nonce, n.Data, sealedData(n.Header, n.Attrs))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errtype.ErrEncryption, err)
+	}
+
+	n.Data = data
+	return nil
+}
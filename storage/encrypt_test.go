@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/peterouob/file_system/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// keyRing is a KeyProvider whose current key can be rotated.
+type keyRing struct {
+	keys    map[uint32][]byte
+	current uint32
+}
+
+func (r *keyRing) CurrentKey() (uint32, []byte, error) {
+	return r.current, r.keys[r.current], nil
+}
+
+func (r *keyRing) Key(id uint32) ([]byte, error) {
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %d", id)
+	}
+	return key, nil
+}
+
+func TestVolume_Encryption(t *testing.T) {
+	secret := "top secret payload"
+	key := StaticKey(utils.NewEncryptionKey())
+
+	for name, options := range map[string][]VolumeOption{
+		"Plain":      {WithEncryption(key)},
+		"Compressed": {WithEncryption(key), WithCompression(FlateCodec)},
+	} {
+		t.Run("Success_RoundTrip_"+name, func(t *testing.T) {
+			f := setup(t)
+			defer teardown(f, t)
+
+			v, err := NewVolume(f, options...)
+			require.NoError(t, err)
+
+			payload := bytes.Repeat([]byte(secret), 100)
+			n := newNeedle(1, string(payload))
+			n.SetName("secret.txt")
+			require.NoError(t, v.Write(n))
+			require.NoError(t, v.Write(newNeedle(2, "deleted")))
+			require.NoError(t, v.Delete(KeyPair{Key: 2}, 20))
+
+			raw, err := os.ReadFile(f.Name())
+			require.NoError(t, err)
+			assert.NotContains(t, string(raw), secret)
+
+			got, err := v.ReadNeedle(KeyPair{Key: 1}, 10)
+			require.NoError(t, err)
+			assert.Equal(t, payload, got.Data)
+			assert.Equal(t, "secret.txt", got.Name())
+			assert.NotZero(t, got.Header.Flag&EncryptFlag)
+
+			out := new(bytes.Buffer)
+			written, err := v.ReadTo(KeyPair{Key: 1}, 10, out)
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(payload)), written)
+			assert.Equal(t, payload, out.Bytes())
+
+			_, err = v.Compact()
+			require.NoError(t, err)
+			require.NoError(t, v.Close())
+
+			// scrubbing needs no key
+			reopened := reopenVolume(t, f)
+			report, err := reopened.Scrub(t.Context())
+			require.NoError(t, err)
+			assert.Empty(t, report.Corrupt)
+
+			_, err = reopened.Read(KeyPair{Key: 1}, 10)
+			assert.ErrorIs(t, err, errtype.ErrEncryption)
+		})
+	}
+
+	t.Run("Success_KeyRotation", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		ring := &keyRing{keys: map[uint32][]byte{1: utils.NewEncryptionKey()}, current: 1}
+		v, err := NewVolume(f, WithEncryption(ring))
+		require.NoError(t, err)
+		require.NoError(t, v.Write(newNeedle(1, "old key")))
+
+		ring.keys[2] = utils.NewEncryptionKey()
+		ring.current = 2
+		require.NoError(t, v.Write(newNeedle(2, "new key")))
+
+		for key, want := range map[uint64]string{1: "old key", 2: "new key"} {
+			data, err := v.Read(KeyPair{Key: key}, key*10)
+			require.NoError(t, err)
+			assert.Equal(t, want, string(data))
+		}
+
+		delete(ring.keys, 1)
+		_, err = v.Read(KeyPair{Key: 1}, 10)
+		assert.ErrorIs(t, err, errtype.ErrEncryption)
+	})
+
+	t.Run("Success_Large", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithEncryption(key))
+		require.NoError(t, err)
+
+		payload := newPayload(xlargeSize + 1)
+		require.NoError(t, v.Write(newNeedle(1, string(payload))))
+
+		data, err := v.Read(KeyPair{Key: 1}, 10)
+		require.NoError(t, err)
+		assert.Equal(t, payload, data)
+	})
+
+	t.Run("Error_WrongKey", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithEncryption(key))
+		require.NoError(t, err)
+		require.NoError(t, v.Write(newNeedle(1, secret)))
+		require.NoError(t, v.Close())
+
+		v, err = NewVolume(f, WithEncryption(StaticKey(utils.NewEncryptionKey())))
+		require.NoError(t, err)
+		_, err = v.Read(KeyPair{Key: 1}, 10)
+		assert.ErrorIs(t, err, errtype.ErrEncryption)
+	})
+
+	t.Run("Error_HeaderBound", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		v.opts.Keys = key
+		require.NoError(t, v.Write(newNeedle(1, secret)))
+
+		// swap in another cookie behind a valid CRC, only the seal notices
+		meta := v.index[KeyPair{Key: 1}]
+		b := make([]byte, meta.length())
+		_, err := f.ReadAt(b, meta.Offset)
+		require.NoError(t, err)
+
+		binary.BigEndian.PutUint64(b[4:12], 99)
+		end := headerSize(meta.Version) + int64(meta.AttrSize) + int64(meta.Size)
+		binary.BigEndian.PutUint32(b[end:], needleCRC(b[:end]).Value())
+		_, err = f.WriteAt(b, meta.Offset)
+		require.NoError(t, err)
+
+		_, err = v.Read(KeyPair{Key: 1}, 99)
+		assert.ErrorIs(t, err, errtype.ErrEncryption)
+	})
+
+	t.Run("Error_WriteFrom", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithEncryption(key))
+		require.NoError(t, err)
+
+		err = v.WriteFrom(NeedleHeader{Key: 1}, bytes.NewReader([]byte(secret)), uint32(len(secret)))
+		assert.ErrorIs(t, err, errtype.ErrEncryption)
+		assert.Empty(t, v.index)
+	})
+}
@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// fdatasync flushes the data of f without forcing a metadata update the data
+// doesn't need, such as the modification time.
+func fdatasync(f *os.File) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.Fdatasync(int(fd))
+	}); err != nil {
+		return err
+	}
+
+	return serr
+}
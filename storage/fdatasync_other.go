@@ -0,0 +1,10 @@
+//go:build !linux
+
+package storage
+
+import "os"
+
+// fdatasync falls back to a full fsync where fdatasync isn't available.
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// syncDir flushes the directory entries of dir, so a rename inside it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(filepath.Clean(dir))
+	if err != nil {
+		return err
+	}
+	return syncClose(d)
+}
+
+// syncDirIn is syncDir for the directory dir under root.
+func syncDirIn(root *os.Root, dir string) error {
+	d, err := root.Open(dir)
+	if err != nil {
+		return err
+	}
+	return syncClose(d)
+}
+
+func syncClose(d *os.File) error {
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+
+	return d.Close()
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package storage
+
+import "os"
+
+// syncDir is a no-op on windows, directories can't be opened for flushing and
+// NTFS journals the rename itself.
+func syncDir(string) error {
+	return nil
+}
+
+// syncDirIn is a no-op on windows like syncDir.
+func syncDirIn(*os.Root, string) error {
+	return nil
+}
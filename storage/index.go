@@ -0,0 +1,340 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	errtype "github.com/peterouob/file_system/type"
+)
+
+/*
+index file (.idx) sits next to the volume data file
+
+	+------------------------------------------+-------------+-------------+-----+
+	| checkpoint header | entry | entry | ...  | log entry   | log entry   | ... |
+	+------------------------------------------+-------------+-------------+-----+
+
+checkpoint header
++-------+---------+---------+---------+-------+
+| Magic | Version | Entries | Covered | CRC   |
+| 4     | 4       | 8       | 8       | 4     |
++-------+---------+---------+---------+-------+
+
+entry
++-----+--------+------+--------+------+----------+---------+----------+
+| Key | AltKey | Flag | Offset | Size | AttrSize | Version | ExpireAt |
+| 8   | 4      | 1    | 8      | 4    | 2        | 1       | 8        |
++-----+--------+------+--------+------+----------+---------+----------+
+
+The checkpoint is a snapshot of the whole index covering the data file up to
+Covered, the CRC protects the header and the snapshot entries. Every Write and
+Delete after the checkpoint appends one log entry, a log entry with DeleteFlag
+removes its key again. A range WriteFrom reserves is logged with indexReserved
+before its payload streams in, entries of the needles written behind it may
+reach the file before the entry of the streamed needle does.
+*/
+
+const (
+	indexMagic      = 0x49445846
+	indexVersion    = 4
+	indexHeaderSize = 28
+	indexEntrySize  = 36
+
+	defaultCheckpointInterval = 1 << 16
+
+	// indexReserved flags the log entry of a range WriteFrom reserved, the
+	// index doesn't cover the data file past it until the needle is logged.
+	indexReserved byte = 1 << 7
+)
+
+type indexEntry struct {
+	Key KeyPair
+	NeedleMeta
+	Flag byte
+}
+
+type indexFile struct {
+	f        *os.File
+	w        *bufio.Writer
+	path     string
+	appended int  // log entries appended since the last checkpoint
+	interval int  // checkpoint after this many log entries
+	readOnly bool // the index is only loaded, never written
+}
+
+// indexPath returns the index file path of a volume data file, bench.vol -> bench.idx.
+func indexPath(dataPath string) string {
+	return strings.TrimSuffix(dataPath, filepath.Ext(dataPath)) + ".idx"
+}
+
+// openIndexFile opens the index file at path. A read only index file that
+// doesn't exist is not created, loading it falls back to scanning the volume.
+func openIndexFile(path string, readOnly bool) (*indexFile, error) {
+	ix := &indexFile{
+		path:     path,
+		interval: defaultCheckpointInterval,
+		readOnly: readOnly,
+	}
+
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+
+	f, err := os.OpenFile(filepath.Clean(path), flag, 0600)
+	if err != nil {
+		if readOnly && errors.Is(err, os.ErrNotExist) {
+			return ix, nil
+		}
+		return nil, err
+	}
+
+	ix.f = f
+	return ix, nil
+}
+
+func encodeIndexEntry(b []byte, e indexEntry) []byte {
+	b = binary.BigEndian.AppendUint64(b, e.Key.Key)
+	b = binary.BigEndian.AppendUint32(b, e.Key.AltKey)
+	b = append(b, e.Flag)
+	b = binary.BigEndian.AppendUint64(b, uint64(e.Offset))
+	b = binary.BigEndian.AppendUint32(b, e.Size)
+	b = binary.BigEndian.AppendUint16(b, e.AttrSize)
+	b = append(b, e.Version)
+	b = binary.BigEndian.AppendUint64(b, uint64(e.ExpireAt))
+	return b
+}
+
+func decodeIndexEntry(b []byte) indexEntry {
+	return indexEntry{
+		Key: KeyPair{
+			Key:    binary.BigEndian.Uint64(b[0:8]),
+			AltKey: binary.BigEndian.Uint32(b[8:12]),
+		},
+		NeedleMeta: NeedleMeta{
+			Offset:   int64(binary.BigEndian.Uint64(b[13:21])),
+			Size:     binary.BigEndian.Uint32(b[21:25]),
+			AttrSize: binary.BigEndian.Uint16(b[25:27]),
+			Version:  b[27],
+			ExpireAt: int64(binary.BigEndian.Uint64(b[28:36])),
+		},
+		Flag: b[12],
+	}
+}
+
+// load reads the checkpoint and replays the log entries appended after it. It
+// returns the index, the data offset the index covers and the entry pointing at
+// the highest offset, which the caller uses to check the index against the
+// data file. The covered offset stops at the first range still reserved, a
+// crash may have taken the entry of its needle. A missing or damaged
+// checkpoint reports ErrCorruptVolume.
+func (ix *indexFile) load() (map[KeyPair]NeedleMeta, int64, *indexEntry, error) {
+	if ix.f == nil {
+		return nil, 0, nil, fmt.Errorf("%w: index file missing", errtype.ErrCorruptVolume)
+	}
+
+	if _, err := ix.f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, nil, err
+	}
+
+	r := bufio.NewReader(ix.f)
+
+	var header [indexHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, 0, nil, fmt.Errorf("%w: index header: %v", errtype.ErrCorruptVolume, err)
+	}
+
+	if binary.BigEndian.Uint32(header[0:4]) != indexMagic ||
+		binary.BigEndian.Uint32(header[4:8]) != indexVersion {
+		return nil, 0, nil, fmt.Errorf("%w: index magic or version mismatch", errtype.ErrCorruptVolume)
+	}
+
+	count := binary.BigEndian.Uint64(header[8:16])
+	covered := int64(binary.BigEndian.Uint64(header[16:24]))
+	crc := NewCRC(header[:24])
+
+	var (
+		index    = make(map[KeyPair]NeedleMeta)
+		reserved = make(map[int64]bool)
+		last     *indexEntry
+		buf      [indexEntrySize]byte
+	)
+
+	ix.appended = 0
+
+	apply := func(e indexEntry) {
+		if e.Flag&indexReserved != 0 {
+			reserved[e.Offset] = true
+			return
+		}
+		delete(reserved, e.Offset)
+
+		switch {
+		case e.Flag&batchMarkers != 0:
+		case e.Flag&DeleteFlag != 0:
+			delete(index, e.Key)
+		default:
+			index[e.Key] = e.NeedleMeta
+		}
+
+		if end := e.Offset + e.length(); end > covered {
+			covered = end
+		}
+
+		if last == nil || e.Offset >= last.Offset {
+			last = &e
+		}
+	}
+
+	for range count {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, 0, nil, fmt.Errorf("%w: index checkpoint: %v", errtype.ErrCorruptVolume, err)
+		}
+		crc = crc.Update(buf[:])
+		apply(decodeIndexEntry(buf[:]))
+	}
+
+	if crc.Value() != binary.BigEndian.Uint32(header[24:28]) {
+		return nil, 0, nil, fmt.Errorf("%w: index checkpoint crc", errtype.ErrCorruptVolume)
+	}
+
+	// a log entry cut short by a crash is dropped, the data file tail replay
+	// picks the needle up again, so are the entries of a batch whose commit
+	// didn't make it
+	var batch indexBatch
+	for {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return nil, 0, nil, err
+		}
+		batch.add(decodeIndexEntry(buf[:]), apply)
+		ix.appended++
+	}
+
+	// the log is cut at an open batch, entries appended from now on must not
+	// end up in it
+	ix.appended -= len(batch.pending)
+
+	for offset := range reserved {
+		covered = min(covered, offset)
+	}
+
+	if ix.readOnly {
+		return index, covered, last, nil
+	}
+
+	end := int64(indexHeaderSize) + (int64(count)+int64(ix.appended))*indexEntrySize
+	if err := ix.f.Truncate(end); err != nil {
+		return nil, 0, nil, err
+	}
+	if _, err := ix.f.Seek(end, io.SeekStart); err != nil {
+		return nil, 0, nil, err
+	}
+	ix.w = bufio.NewWriter(ix.f)
+
+	return index, covered, last, nil
+}
+
+// append adds a log entry, it is buffered and only reaches the file on the next
+// flush, checkpoint or close.
+func (ix *indexFile) append(e indexEntry) error {
+	if ix.w == nil {
+		ix.w = bufio.NewWriter(ix.f)
+	}
+
+	var buf [indexEntrySize]byte
+	if _, err := ix.w.Write(encodeIndexEntry(buf[:0], e)); err != nil {
+		return err
+	}
+
+	ix.appended++
+	return nil
+}
+
+func (ix *indexFile) needCheckpoint() bool {
+	return ix.appended >= ix.interval
+}
+
+// checkpoint writes a snapshot of index covering the data file up to covered
+// into a temporary file, syncs it and renames it over the index file, so a
+// crash leaves either the old or the new checkpoint behind.
+func (ix *indexFile) checkpoint(index map[KeyPair]NeedleMeta, covered int64) error {
+	if ix.readOnly {
+		return nil
+	}
+
+	tmpPath := ix.path + ".tmp"
+	tmp, err := os.OpenFile(filepath.Clean(tmpPath), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+
+	header := make([]byte, 0, indexHeaderSize)
+	header = binary.BigEndian.AppendUint32(header, indexMagic)
+	header = binary.BigEndian.AppendUint32(header, indexVersion)
+	header = binary.BigEndian.AppendUint64(header, uint64(len(index)))
+	header = binary.BigEndian.AppendUint64(header, uint64(covered))
+	crc := NewCRC(header)
+
+	entries := make([]byte, 0, indexEntrySize*len(index))
+	for key, meta := range index {
+		entries = encodeIndexEntry(entries, indexEntry{Key: key, NeedleMeta: meta})
+	}
+	crc = crc.Update(entries)
+	header = binary.BigEndian.AppendUint32(header, crc.Value())
+
+	_, err = w.Write(header)
+	if err == nil {
+		_, err = w.Write(entries)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("index checkpoint error: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, ix.path); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("index checkpoint error: %w", err)
+	}
+
+	_ = ix.f.Close()
+	ix.f = tmp
+	ix.w = bufio.NewWriter(tmp)
+	ix.appended = 0
+
+	if err := syncDir(filepath.Dir(ix.path)); err != nil {
+		return fmt.Errorf("index checkpoint error: %w", err)
+	}
+	return nil
+}
+
+func (ix *indexFile) flush() error {
+	if ix.w == nil {
+		return nil
+	}
+	return ix.w.Flush()
+}
+
+func (ix *indexFile) close() error {
+	if ix.f == nil {
+		return nil
+	}
+	return errors.Join(ix.flush(), ix.f.Close())
+}
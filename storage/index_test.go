@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexPath(t *testing.T) {
+	assert.Equal(t, "data/1.idx", indexPath("data/1.vol"))
+	assert.Equal(t, "data/noext.idx", indexPath("data/noext"))
+}
+
+func TestIndexFile_CheckpointAndLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.idx")
+
+	ix, err := openIndexFile(path, false)
+	require.NoError(t, err)
+
+	index := map[KeyPair]NeedleMeta{
+		{Key: 1}:            {Offset: 0, Size: 10},
+		{Key: 2, AltKey: 7}: {Offset: 48, Size: 20},
+	}
+	require.NoError(t, ix.checkpoint(index, 112))
+
+	require.NoError(t, ix.append(indexEntry{Key: KeyPair{Key: 3}, NeedleMeta: NeedleMeta{Offset: 112, Size: 5, Version: NeedleVersion2}}))
+	require.NoError(t, ix.append(indexEntry{Key: KeyPair{Key: 1}, NeedleMeta: NeedleMeta{Offset: 160, Version: NeedleVersion2}, Flag: DeleteFlag}))
+	require.NoError(t, ix.close())
+
+	ix, err = openIndexFile(path, false)
+	require.NoError(t, err)
+	defer func() {
+		_ = ix.close()
+	}()
+
+	got, covered, last, err := ix.load()
+	require.NoError(t, err)
+
+	assert.Equal(t, map[KeyPair]NeedleMeta{
+		{Key: 2, AltKey: 7}: {Offset: 48, Size: 20},
+		{Key: 3}:            {Offset: 112, Size: 5, Version: NeedleVersion2},
+	}, got)
+	assert.Equal(t, 160+needleLength(NeedleVersion2, 0, 0), covered)
+	assert.Equal(t, KeyPair{Key: 1}, last.Key)
+	assert.Equal(t, 2, ix.appended)
+}
+
+func TestIndexFile_Load(t *testing.T) {
+	t.Run("Error_Empty", func(t *testing.T) {
+		ix, err := openIndexFile(filepath.Join(t.TempDir(), "test.idx"), false)
+		require.NoError(t, err)
+
+		_, _, _, err = ix.load()
+		assert.ErrorIs(t, err, errtype.ErrCorruptVolume)
+	})
+
+	t.Run("Error_CheckpointCRC", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.idx")
+		ix, err := openIndexFile(path, false)
+		require.NoError(t, err)
+
+		require.NoError(t, ix.checkpoint(map[KeyPair]NeedleMeta{{Key: 1}: {Size: 1}}, 48))
+		_, err = ix.f.WriteAt([]byte{0xff}, indexHeaderSize+1)
+		require.NoError(t, err)
+
+		_, _, _, err = ix.load()
+		assert.ErrorIs(t, err, errtype.ErrCorruptVolume)
+	})
+
+	t.Run("Success_DropTornLogEntry", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "test.idx")
+		ix, err := openIndexFile(path, false)
+		require.NoError(t, err)
+
+		require.NoError(t, ix.checkpoint(map[KeyPair]NeedleMeta{}, 0))
+		require.NoError(t, ix.append(indexEntry{Key: KeyPair{Key: 1}, NeedleMeta: NeedleMeta{Size: 1}}))
+		require.NoError(t, ix.flush())
+		_, err = ix.f.Write([]byte{1, 2, 3})
+		require.NoError(t, err)
+
+		got, _, _, err := ix.load()
+		require.NoError(t, err)
+		assert.Len(t, got, 1)
+
+		fi, err := ix.f.Stat()
+		require.NoError(t, err)
+		assert.Equal(t, int64(indexHeaderSize+indexEntrySize), fi.Size())
+	})
+}
+
+func TestVolume_OpenWithIndex(t *testing.T) {
+	write := func(t *testing.T, v *Volume, key uint64) {
+		t.Helper()
+		n := newRandomNeedle(key, 100)
+		require.NoError(t, v.Write(n))
+	}
+
+	t.Run("Success_LoadCheckpoint", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		for i := range 10 {
+			write(t, v, uint64(i))
+		}
+		require.NoError(t, v.Close())
+
+		reloaded, err := NewVolume(f)
+		require.NoError(t, err)
+		assert.Equal(t, v.index, reloaded.index)
+		assert.Equal(t, v.writeOffset, reloaded.writeOffset)
+	})
+
+	t.Run("Success_ReplayDataTail", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		for i := range 5 {
+			write(t, v, uint64(i))
+		}
+		require.NoError(t, v.Close())
+
+		v, err := NewVolume(f)
+		require.NoError(t, err)
+		for i := 5; i < 10; i++ {
+			write(t, v, uint64(i))
+		}
+
+		// the log entries of the last writes are still buffered, only the data
+		// file knows about them
+		reloaded, err := NewVolume(f)
+		require.NoError(t, err)
+		assert.Len(t, reloaded.index, 10)
+		assert.Equal(t, v.index, reloaded.index)
+		assert.Equal(t, v.writeOffset, reloaded.writeOffset)
+	})
+
+	t.Run("Success_PeriodicCheckpoint", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		v.idx.interval = 4
+
+		for i := range 6 {
+			write(t, v, uint64(i))
+		}
+		assert.Equal(t, 2, v.idx.appended)
+
+		reloaded, err := NewVolume(f)
+		require.NoError(t, err)
+		assert.Len(t, reloaded.index, 6)
+	})
+
+	t.Run("Success_FallbackOnMismatch", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		for i := range 4 {
+			write(t, v, uint64(i))
+		}
+		require.NoError(t, v.Close())
+
+		// the data file lost its last needle behind the index file's back
+		last := v.index[KeyPair{Key: 3}]
+		require.NoError(t, f.Truncate(last.Offset))
+
+		reloaded, err := NewVolume(f)
+		require.NoError(t, err)
+		assert.Len(t, reloaded.index, 3)
+		assert.Equal(t, last.Offset, reloaded.writeOffset)
+
+		_, err = os.Stat(indexPath(f.Name()) + ".tmp")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("Success_FallbackOnEarlierMismatch", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		for i := range 4 {
+			write(t, v, uint64(i))
+		}
+		require.NoError(t, v.Close())
+
+		// an entry before the last one points at a needle that isn't its own
+		_, err := f.WriteAt([]byte{0xff}, v.index[KeyPair{Key: 1}].Offset+12)
+		require.NoError(t, err)
+
+		reloaded, err := NewVolume(f)
+		require.NoError(t, err)
+		assert.NotContains(t, reloaded.index, KeyPair{Key: 1})
+		assert.Len(t, reloaded.index, 3)
+		assert.Equal(t, v.writeOffset, reloaded.writeOffset)
+	})
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"cmp"
+	"errors"
+	"iter"
+	"slices"
+	"time"
+)
+
+// errStopIter stops a scan once the caller of Needles is done.
+var errStopIter = errors.New("stop iteration")
+
+// NeedleInfo describes a needle Needles came across.
+type NeedleInfo struct {
+	Key    KeyPair
+	Offset int64
+	Size   uint32 // payload bytes as stored, compressed or sealed payloads keep their stored size
+	Flag   byte
+	Live   bool // the index points at the needle, false for tombstones and needles overwritten since
+}
+
+type iterOpts struct {
+	tombstones bool
+	markers    bool
+	disk       bool
+	from, to   uint64
+	flags      byte
+}
+
+type IterOption func(*iterOpts)
+
+// WithTombstones also yields tombstones and needles deleted in place, they are
+// only found on disk so the option implies FromDisk.
+func WithTombstones() IterOption {
+	return func(opts *iterOpts) {
+		opts.tombstones = true
+		opts.disk = true
+	}
+}
+
+// WithMarkers also yields the markers opening and closing a batch and the ones
+// an aborted WriteFrom left behind, they are only found on disk so the option
+// implies FromDisk.
+func WithMarkers() IterOption {
+	return func(opts *iterOpts) {
+		opts.markers = true
+		opts.disk = true
+	}
+}
+
+// WithKeyRange only yields the needles whose Key is in [from, to).
+func WithKeyRange(from, to uint64) IterOption {
+	return func(opts *iterOpts) {
+		opts.from, opts.to = from, to
+	}
+}
+
+// WithFlags only yields the needles with every bit of flags set.
+func WithFlags(flags byte) IterOption {
+	return func(opts *iterOpts) {
+		opts.flags = flags
+	}
+}
+
+// FromDisk scans the data file instead of the index, every intact needle of
+// the log but the markers is yielded, Live tells the ones the index points at.
+func FromDisk() IterOption {
+	return func(opts *iterOpts) {
+		opts.disk = true
+	}
+}
+
+func (o iterOpts) match(info NeedleInfo) bool {
+	if info.Key.Key < o.from || (o.to != 0 && info.Key.Key >= o.to) {
+		return false
+	}
+	if info.Flag&DeleteFlag != 0 && !o.tombstones {
+		return false
+	}
+	if info.Flag&batchMarkers != 0 && !o.markers {
+		return false
+	}
+	return info.Flag&o.flags == o.flags
+}
+
+/*
+Needles iterates the needles of the volume in file order, by default the live
+ones of the index without the expired. The volume is not locked while the
+caller handles a needle, so it may read or write the volume, but the iteration
+works on what the volume held when it started:
+
+	index     the needles the index pointed at, their flags are read from disk
+	FromDisk  the needles of the data file up to the write offset back then
+
+An error ends the iteration, it is yielded with an empty NeedleInfo.
+*/
+func (v *Volume) Needles(options ...IterOption) iter.Seq2[NeedleInfo, error] {
+	var opts iterOpts
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	return func(yield func(NeedleInfo, error) bool) {
+		if opts.disk {
+			v.scanFrom(opts, yield)
+			return
+		}
+		v.iterIndex(opts, yield)
+	}
+}
+
+// iterIndex yields the needles of a snapshot of the index.
+func (v *Volume) iterIndex(opts iterOpts, yield func(NeedleInfo, error) bool) {
+	now := time.Now().UnixNano()
+
+	v.mu.RLock()
+	snapshot := make([]liveNeedle, 0, len(v.index))
+	for key, meta := range v.index {
+		if key.Key >= opts.from && (opts.to == 0 || key.Key < opts.to) && !meta.expired(now) {
+			snapshot = append(snapshot, liveNeedle{key: key, meta: meta})
+		}
+	}
+	f, release := v.holdData()
+	v.mu.RUnlock()
+	defer release()
+
+	slices.SortFunc(snapshot, func(a, b liveNeedle) int {
+		return cmp.Compare(a.meta.Offset, b.meta.Offset)
+	})
+
+	var flag [1]byte
+	for _, live := range snapshot {
+		if _, err := f.ReadAt(flag[:], live.meta.Offset+24); err != nil {
+			yield(NeedleInfo{}, err)
+			return
+		}
+
+		info := NeedleInfo{
+			Key:    live.key,
+			Offset: live.meta.Offset,
+			Size:   live.meta.Size,
+			Flag:   flag[0],
+			Live:   true,
+		}
+
+		if opts.match(info) && !yield(info, nil) {
+			return
+		}
+	}
+}
+
+// scanFrom yields the needles found by a scan of the data file.
+func (v *Volume) scanFrom(opts iterOpts, yield func(NeedleInfo, error) bool) {
+	v.mu.RLock()
+	f, release := v.holdData()
+	end := v.writeOffset
+	v.mu.RUnlock()
+	defer release()
+
+	_, err := scanNeedles(f, SuperBlockSize, end, v.bufferPool, func(rec needleRecord) error {
+		info := NeedleInfo{
+			Key:    KeyPair{Key: rec.Header.Key, AltKey: rec.Header.AlternateKey},
+			Offset: rec.Offset,
+			Size:   rec.Header.Size,
+			Flag:   rec.Header.Flag,
+		}
+
+		if !opts.match(info) {
+			return nil
+		}
+
+		v.mu.RLock()
+		meta, ok := v.index[info.Key]
+		info.Live = ok && meta.Offset == rec.Offset && v.dataFile == f
+		v.mu.RUnlock()
+
+		if !yield(info, nil) {
+			return errStopIter
+		}
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, errStopIter) {
+		yield(NeedleInfo{}, err)
+	}
+}
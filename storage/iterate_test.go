@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolume_Needles(t *testing.T) {
+	collect := func(t *testing.T, v *Volume, options ...IterOption) []NeedleInfo {
+		t.Helper()
+		var infos []NeedleInfo
+		for info, err := range v.Needles(options...) {
+			require.NoError(t, err)
+			infos = append(infos, info)
+		}
+		return infos
+	}
+
+	keys := func(infos []NeedleInfo) []uint64 {
+		var keys []uint64
+		for _, info := range infos {
+			keys = append(keys, info.Key.Key)
+		}
+		return keys
+	}
+
+	v, _ := setupTestVolume(t)
+	v.opts.Codec = FlateCodec
+
+	for key := uint64(1); key <= 5; key++ {
+		require.NoError(t, v.Write(newNeedle(key, "payload")))
+	}
+	require.NoError(t, v.Write(newNeedle(2, "overwritten")))
+	require.NoError(t, v.Write(newNeedle(6, string(newPayload(compressMinSize*4)))))
+	require.NoError(t, v.Delete(KeyPair{Key: 4}, 40))
+
+	t.Run("Success_Index", func(t *testing.T) {
+		infos := collect(t, v)
+		assert.Equal(t, []uint64{1, 3, 5, 2, 6}, keys(infos), "in file order")
+		for _, info := range infos {
+			assert.True(t, info.Live)
+			assert.Equal(t, v.index[info.Key].Offset, info.Offset)
+		}
+	})
+
+	t.Run("Success_Filters", func(t *testing.T) {
+		assert.Equal(t, []uint64{3, 2}, keys(collect(t, v, WithKeyRange(2, 4))))
+		assert.Equal(t, []uint64{6}, keys(collect(t, v, WithFlags(CompressFlag))))
+		assert.Equal(t, []uint64{6}, keys(collect(t, v, FromDisk(), WithFlags(CompressFlag))))
+	})
+
+	t.Run("Success_FromDisk", func(t *testing.T) {
+		infos := collect(t, v, FromDisk())
+		assert.Equal(t, []uint64{1, 2, 3, 5, 2, 6}, keys(infos))
+		assert.False(t, infos[1].Live, "overwritten")
+		assert.True(t, infos[4].Live)
+
+		infos = collect(t, v, WithTombstones(), WithKeyRange(4, 5))
+		require.Len(t, infos, 2)
+		for _, info := range infos {
+			assert.NotZero(t, info.Flag&DeleteFlag)
+			assert.False(t, info.Live)
+		}
+	})
+
+	t.Run("Success_FromDiskBatch", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+		require.NoError(t, v.Write(newNeedle(1, "payload")))
+		require.NoError(t, v.WriteBatch([]*Needle{newNeedle(2, "payload"), newNeedle(3, "payload")}))
+
+		infos := collect(t, v, FromDisk())
+		assert.Equal(t, []uint64{1, 2, 3}, keys(infos), "the batch markers are left out")
+		for _, info := range infos {
+			assert.Zero(t, info.Flag&batchMarkers)
+			assert.True(t, info.Live)
+		}
+
+		infos = collect(t, v, WithMarkers())
+		require.Len(t, infos, 5)
+		assert.NotZero(t, infos[1].Flag&BatchFlag)
+		assert.NotZero(t, infos[4].Flag&CommitFlag)
+		assert.False(t, infos[1].Live)
+		assert.Len(t, collect(t, v, WithMarkers(), WithFlags(CommitFlag)), 1)
+	})
+
+	t.Run("Success_Break", func(t *testing.T) {
+		for _, options := range [][]IterOption{nil, {FromDisk()}} {
+			var n int
+			for range v.Needles(options...) {
+				n++
+				break
+			}
+			assert.Equal(t, 1, n)
+		}
+	})
+}
@@ -1,33 +1,66 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/binary"
+	"math"
 
 	errtype "github.com/peterouob/file_system/type"
 	"github.com/peterouob/file_system/utils"
 )
 
 const MagicHeader = 0x2DCF25 >> 1
+
+// MagicHeaderV2 starts a needle in the v2 layout, the version sits in the top byte.
+const MagicHeaderV2 = MagicHeader | 2<<24
+
 const MagicFooter = 0x2DCF25 << 1
 
+const (
+	NeedleVersion1 uint8 = 1
+	NeedleVersion2 uint8 = 2
+)
+
+// DeleteFlag marks a needle as deleted. Delete sets it in place on the deleted
+// needle and on the tombstone it appends, the bit is left out of the CRC so the
+// deleted needle stays intact.
+const DeleteFlag byte = 1
+
 /*
 NeedleHeader
 +---------------+----------+----------+--------------+------+--------+
 | MagicHeader   | Cookie   | Key      | AlternateKey | Flag | Size   |
 | 4 bytes       | 8 bytes  | 8 bytes  | 4 bytes      | 1    | 4 bytes|
 +---------------+----------+----------+--------------+------+--------+
+
+a v2 header starts with MagicHeaderV2 and carries the append time and the size
+of the attribute section behind the v1 fields
+
++-------------------------------+----------+----------+
+| v1 fields                     | AppendAt | AttrSize |
+| 29 bytes                      | 8 bytes  | 2 bytes  |
++-------------------------------+----------+----------+
+
+the needle on disk, the CRC covers the header, the attributes and the data
+
++--------+------------+------+--------+---------+
+| header | attributes | data | footer | padding |
++--------+------------+------+--------+---------+
 */
 type NeedleHeader struct {
 	Cookie       uint64
 	Key          uint64
+	AppendAt     int64 // unix nano time the needle was appended, v2 only
 	MagicHeader  uint32
 	AlternateKey uint32
 	Size         uint32
+	AttrSize     uint16 // bytes of the attribute section, v2 only
 	Flag         byte
 }
 
 type Needle struct {
 	Data   []byte
+	Attrs  []Attribute // only stored by the v2 layout
 	Header NeedleHeader
 	Footer NeedleFooter
 }
@@ -46,37 +79,123 @@ type NeedleFooter struct {
 }
 
 const NeedleHeaderSize = 29
+const NeedleHeaderV2Size = NeedleHeaderSize + 10
 const NeedleFooterSize = 8
 
+// MaxNeedleSize is the largest payload a volume takes, the needle framing it
+// with the largest attributes and the cipher overhead still fits a uint32.
+const MaxNeedleSize = math.MaxUint32 - NeedleHeaderV2Size - MaxAttrSize - NeedleFooterSize - 64
+
+// validMagic reports whether m starts a needle of a known version.
+func validMagic(m uint32) bool {
+	return m == MagicHeader || m == MagicHeaderV2
+}
+
+// Version returns the layout version the header is encoded in.
+func (h NeedleHeader) Version() uint8 {
+	if h.MagicHeader == MagicHeaderV2 {
+		return NeedleVersion2
+	}
+	return NeedleVersion1
+}
+
+func (h NeedleHeader) length() int64 {
+	return needleLength(h.Version(), h.AttrSize, h.Size)
+}
+
+// meta returns the index entry of the needle h stored at offset.
+func (h NeedleHeader) meta(offset int64) NeedleMeta {
+	return NeedleMeta{
+		Offset:   offset,
+		Size:     h.Size,
+		AttrSize: h.AttrSize,
+		Version:  h.Version(),
+	}
+}
+
+// headerSize returns the size of a needle header of the given version.
+func headerSize(version uint8) int64 {
+	if version == NeedleVersion2 {
+		return NeedleHeaderV2Size
+	}
+	return NeedleHeaderSize
+}
+
+// needleLength is the number of bytes a needle takes on disk, including the
+// padding that keeps every needle 8 byte aligned.
+func needleLength(version uint8, attrSize uint16, size uint32) int64 {
+	n := headerSize(version) + int64(attrSize) + int64(size) + NeedleFooterSize
+	return n + (8-n%8)%8
+}
+
+// Bytes encodes the needle in the layout its MagicHeader asks for, the
+// attributes are only written in the v2 layout.
 func (n *Needle) Bytes(bp *BufferPool) *Buffer {
-	totalSize := NeedleHeaderSize + len(n.Data) + NeedleFooterSize
+	if n.Header.Version() == NeedleVersion2 {
+		n.Header.AttrSize = uint16(attributesSize(n.Attrs))
+	}
+
+	totalSize := headerSize(n.Header.Version()) + int64(n.Header.AttrSize) + int64(len(n.Data)) + NeedleFooterSize
 
 	size := utils.Must(utils.CIU32(totalSize))
 
-	buf, _ := bp.Get(size)
+	buf, err := bp.Get(size)
+	if err != nil {
+		// too large for the pool, Put drops a buffer it doesn't own
+		buf = &Buffer{B: make([]byte, 0, totalSize+needleAlignment)}
+	}
+
+	buf.B = appendNeedleHeader(buf.B, n.Header)
 
-	buf.B = binary.BigEndian.AppendUint32(buf.B, n.Header.MagicHeader)
-	buf.B = binary.BigEndian.AppendUint64(buf.B, n.Header.Cookie)
-	buf.B = binary.BigEndian.AppendUint64(buf.B, n.Header.Key)
-	buf.B = binary.BigEndian.AppendUint32(buf.B, n.Header.AlternateKey)
-	buf.B = append(buf.B, n.Header.Flag)
-	buf.B = binary.BigEndian.AppendUint32(buf.B, n.Header.Size)
+	if n.Header.Version() == NeedleVersion2 {
+		buf.B = appendAttributes(buf.B, n.Attrs)
+	}
 
 	buf.B = append(buf.B, n.Data...)
 
-	n.Footer.Checksum = NewCRC(buf.B).Value()
-	buf.B = binary.BigEndian.AppendUint32(buf.B, n.Footer.Checksum)
-	buf.B = binary.BigEndian.AppendUint32(buf.B, n.Footer.MagicFooter)
+	n.Footer.Checksum = needleCRC(buf.B).Value()
+	buf.B = appendNeedleFooter(buf.B, n.Footer)
 
-	paddingLen := (8 - (len(buf.B) % 8)) % 8
+	return buf
+}
+
+// needleCRC computes the checksum over a needle header and the data following
+// it in b, with the DeleteFlag bit masked out.
+func needleCRC(b []byte) CRC {
+	flag := [1]byte{b[24] &^ DeleteFlag}
+	crc := NewCRC(b[:24]).Update(flag[:])
+	return crc.Update(b[25:])
+}
+
+func appendNeedleHeader(b []byte, h NeedleHeader) []byte {
+	b = binary.BigEndian.AppendUint32(b, h.MagicHeader)
+	b = binary.BigEndian.AppendUint64(b, h.Cookie)
+	b = binary.BigEndian.AppendUint64(b, h.Key)
+	b = binary.BigEndian.AppendUint32(b, h.AlternateKey)
+	b = append(b, h.Flag)
+	b = binary.BigEndian.AppendUint32(b, h.Size)
+	if h.Version() == NeedleVersion2 {
+		b = binary.BigEndian.AppendUint64(b, uint64(h.AppendAt))
+		b = binary.BigEndian.AppendUint16(b, h.AttrSize)
+	}
+	return b
+}
+
+// appendNeedleFooter appends the footer and the zero padding that aligns the
+// needle, b must hold the whole needle so far.
+func appendNeedleFooter(b []byte, f NeedleFooter) []byte {
+	b = binary.BigEndian.AppendUint32(b, f.Checksum)
+	b = binary.BigEndian.AppendUint32(b, f.MagicFooter)
+
+	paddingLen := (8 - (len(b) % 8)) % 8
 
 	if paddingLen > 0 {
 		for range paddingLen {
-			buf.B = append(buf.B, 0)
+			b = append(b, 0)
 		}
 	}
 
-	return buf
+	return b
 }
 
 func ValidNeedleBlock(buf []byte, cookie uint64) error {
@@ -84,7 +203,7 @@ func ValidNeedleBlock(buf []byte, cookie uint64) error {
 		return errtype.ErrBufferTooSmall
 	}
 
-	if binary.BigEndian.Uint32(buf[:4]) != MagicHeader {
+	if !validMagic(binary.BigEndian.Uint32(buf[:4])) {
 		return errtype.ErrMagicNumber
 	}
 
@@ -92,23 +211,67 @@ func ValidNeedleBlock(buf []byte, cookie uint64) error {
 		return errtype.ErrCookie
 	}
 
-	if buf[24] == 1 {
+	if buf[24]&DeleteFlag != 0 {
 		return errtype.ErrDataDeleted
 	}
 
 	return nil
 }
 
-func GetNeedleBlockInfo(totalSize, metaSize uint32, buf []byte) ([]byte, error) {
-	dataWithHeader := buf[:NeedleHeaderSize+metaSize]
-	footer := buf[totalSize-NeedleFooterSize:]
-	crc := binary.BigEndian.Uint32(footer[0:4])
+// decodeNeedleHeader decodes a header, the v2 fields are only read when buf
+// holds a whole v2 header.
+func decodeNeedleHeader(buf []byte) NeedleHeader {
+	h := NeedleHeader{
+		MagicHeader:  binary.BigEndian.Uint32(buf[0:4]),
+		Cookie:       binary.BigEndian.Uint64(buf[4:12]),
+		Key:          binary.BigEndian.Uint64(buf[12:20]),
+		AlternateKey: binary.BigEndian.Uint32(buf[20:24]),
+		Flag:         buf[24],
+		Size:         binary.BigEndian.Uint32(buf[25:29]),
+	}
+
+	if h.Version() == NeedleVersion2 && len(buf) >= NeedleHeaderV2Size {
+		h.AppendAt = int64(binary.BigEndian.Uint64(buf[29:37]))
+		h.AttrSize = binary.BigEndian.Uint16(buf[37:39])
+	}
+
+	return h
+}
+
+// decodeNeedle checks the needle at the start of buf against cookie and its
+// CRC and decodes it. Data and Attrs are copied out of buf.
+func decodeNeedle(buf []byte, cookie uint64) (*Needle, error) {
+	if err := ValidNeedleBlock(buf, cookie); err != nil {
+		return nil, err
+	}
 
-	if NewCRC(dataWithHeader).Value() != crc {
+	h := decodeNeedleHeader(buf)
+	hs := headerSize(h.Version())
+	end := hs + int64(h.AttrSize) + int64(h.Size)
+
+	if int64(len(buf)) < end+NeedleFooterSize {
+		return nil, errtype.ErrBufferTooSmall
+	}
+
+	footer := NeedleFooter{
+		Checksum:    binary.BigEndian.Uint32(buf[end : end+4]),
+		MagicFooter: binary.BigEndian.Uint32(buf[end+4 : end+8]),
+	}
+
+	if needleCRC(buf[:end]).Value() != footer.Checksum {
 		return nil, errtype.ErrCrcNotValid
 	}
 
-	data := dataWithHeader[NeedleHeaderSize : NeedleHeaderSize+metaSize]
+	body := bytes.Clone(buf[hs:end])
+	attrs, err := parseAttributes(body[:h.AttrSize])
+	if err != nil {
+		return nil, err
+	}
 
-	return data, nil
+	return &Needle{
+		Header: h,
+		Attrs:  attrs,
+		Data:   body[h.AttrSize:],
+		Footer: footer,
+	}, nil
 }
@@ -1,8 +1,13 @@
 package storage
 
+import "time"
+
 type Opts struct {
 	PathTransformFunc PathTransformFunc
 	Root              string
+	// SweepGrace is how old a temp file has to be before Sweep removes it, a
+	// younger one may belong to a write still going on.
+	SweepGrace time.Duration
 }
 
 type Option func(opts *Opts)
@@ -18,3 +23,129 @@ func WithPathTransformFunc(pathTransform PathTransformFunc) Option {
 		opts.PathTransformFunc = pathTransform
 	}
 }
+
+func WithSweepGrace(grace time.Duration) Option {
+	return func(opts *Opts) {
+		opts.SweepGrace = grace
+	}
+}
+
+type VolumeOpts struct {
+	// CompactThreshold is the garbage ratio at which CompactIfNeeded compacts.
+	CompactThreshold float64
+	// MaxSize is the size a new volume may grow to before it is sealed.
+	MaxSize int64
+	// VolumeID is written to the superblock of a new volume.
+	VolumeID uint32
+	// ReadOnly opens the volume without ever writing to its files.
+	ReadOnly bool
+	// Durability decides when a write is acknowledged, see Durability.
+	Durability Durability
+	// TTL is written to the superblock of a new volume, every needle of the
+	// volume expires once it is older than TTL.
+	TTL time.Duration
+	// ReapInterval runs Reap in the background at this interval, 0 disables it.
+	ReapInterval time.Duration
+	// ScrubInterval runs Scrub in the background at this interval, 0 disables it.
+	ScrubInterval time.Duration
+	// ScrubRate is the number of bytes per second Scrub reads at most, 0 for
+	// no limit.
+	ScrubRate int64
+	// Codec compresses the payload of needles passed to Write, nil stores
+	// them raw.
+	Codec Codec
+	// Dedup is written to the superblock of a new volume, Write stores a
+	// payload the volume already holds as a reference to it.
+	Dedup bool
+	// Versioning is written to the superblock of a new volume together with
+	// Retention, every Write to a key gets a new version and the older ones
+	// stay readable while Retention keeps them.
+	Versioning bool
+	Retention  Retention
+	// Keys encrypts the payload of needles passed to Write and decrypts them on
+	// read, nil stores them in plain.
+	Keys KeyProvider
+}
+
+type VolumeOption func(opts *VolumeOpts)
+
+const (
+	defaultCompactThreshold = 0.5
+	DefaultMaxVolumeSize    = 32 * 1024 * 1024 * 1024 // 32GB
+)
+
+func WithCompactThreshold(ratio float64) VolumeOption {
+	return func(opts *VolumeOpts) {
+		opts.CompactThreshold = ratio
+	}
+}
+
+func WithVolumeID(id uint32) VolumeOption {
+	return func(opts *VolumeOpts) {
+		opts.VolumeID = id
+	}
+}
+
+func WithMaxSize(size int64) VolumeOption {
+	return func(opts *VolumeOpts) {
+		opts.MaxSize = size
+	}
+}
+
+func WithReadOnly() VolumeOption {
+	return func(opts *VolumeOpts) {
+		opts.ReadOnly = true
+	}
+}
+
+func WithDurability(d Durability) VolumeOption {
+	return func(opts *VolumeOpts) {
+		opts.Durability = d
+	}
+}
+
+func WithTTL(ttl time.Duration) VolumeOption {
+	return func(opts *VolumeOpts) {
+		opts.TTL = ttl
+	}
+}
+
+func WithCompression(c Codec) VolumeOption {
+	return func(opts *VolumeOpts) {
+		opts.Codec = c
+	}
+}
+
+func WithDedup() VolumeOption {
+	return func(opts *VolumeOpts) {
+		opts.Dedup = true
+	}
+}
+
+func WithVersioning(r Retention) VolumeOption {
+	return func(opts *VolumeOpts) {
+		opts.Versioning = true
+		opts.Retention = r
+	}
+}
+
+func WithEncryption(keys KeyProvider) VolumeOption {
+	return func(opts *VolumeOpts) {
+		opts.Keys = keys
+	}
+}
+
+func WithReapInterval(interval time.Duration) VolumeOption {
+	return func(opts *VolumeOpts) {
+		opts.ReapInterval = interval
+	}
+}
+
+// WithScrubber scrubs the volume in the background every interval, reading at
+// most rate bytes per second.
+func WithScrubber(interval time.Duration, rate int64) VolumeOption {
+	return func(opts *VolumeOpts) {
+		opts.ScrubInterval = interval
+		opts.ScrubRate = rate
+	}
+}
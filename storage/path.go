@@ -1,6 +1,11 @@
 package storage
 
-import "fmt"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
 
 type PathKey struct {
 	FilePath string
@@ -9,7 +14,12 @@ type PathKey struct {
 
 type PathTransformFunc func(string) PathKey
 
+// FileTransform stores a key under a directory of its first two bytes, a key
+// without more than that has no FileName and isn't valid.
 func FileTransform(key string) PathKey {
+	if len(key) < 2 {
+		return PathKey{FilePath: key}
+	}
 	return PathKey{
 		FilePath: key[:2],
 		FileName: key[2:],
@@ -17,5 +27,37 @@ func FileTransform(key string) PathKey {
 }
 
 func (p PathKey) GetFullPath() string {
+	if p.FilePath == "" {
+		return p.FileName
+	}
 	return fmt.Sprintf("%s/%s", p.FilePath, p.FileName)
 }
+
+/*
+CASPathTransformFunc returns a PathTransformFunc that stores a key under the
+hex SHA-256 of it, spread over depth directories of width hex digits each
+
+	depth 2, width 2: "photo.jpg" -> 5f/2b/5f2b...e1
+
+so directories fan out evenly whatever the keys look like and no part of a key
+reaches the file system. depth*width is cut down to the 64 digits of the hash.
+*/
+func CASPathTransformFunc(depth, width int) PathTransformFunc {
+	width = max(width, 1)
+	depth = min(max(depth, 0), sha256.Size*2/width)
+
+	return func(key string) PathKey {
+		sum := sha256.Sum256([]byte(key))
+		name := hex.EncodeToString(sum[:])
+
+		dirs := make([]string, depth)
+		for i := range dirs {
+			dirs[i] = name[i*width : (i+1)*width]
+		}
+
+		return PathKey{
+			FilePath: strings.Join(dirs, "/"),
+			FileName: name,
+		}
+	}
+}
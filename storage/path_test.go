@@ -1,6 +1,14 @@
 package storage
 
-import "testing"
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
 
 func TestTransformKey(t *testing.T) {
 	key := "abcdefg"
@@ -21,4 +29,79 @@ func TestTransformKey(t *testing.T) {
 	if path.GetFullPath() != expectFullPaht {
 		t.Fatalf("expect GetFullPath %s, but got %s", expectFullPaht, path.GetFullPath())
 	}
+
+	// keys too short for a FileName don't panic
+	for _, key := range []string{"", "a", "ab"} {
+		if path := FileTransform(key); path.FileName != "" {
+			t.Errorf("expect no FileName for %q, but got %s", key, path.FileName)
+		}
+	}
+}
+
+func TestCASPathTransformFunc(t *testing.T) {
+	sum := sha256.Sum256([]byte("photo.jpg"))
+	name := hex.EncodeToString(sum[:])
+
+	path := CASPathTransformFunc(3, 2)("photo.jpg")
+	if path.FileName != name {
+		t.Fatalf("expect FileName %s, but got %s", name, path.FileName)
+	}
+	if want := name[0:2] + "/" + name[2:4] + "/" + name[4:6]; path.FilePath != want {
+		t.Fatalf("expect FilePath %s, but got %s", want, path.FilePath)
+	}
+
+	// short keys and a layout deeper than the hash don't panic
+	for _, key := range []string{"", "a", "../../etc/passwd"} {
+		path := CASPathTransformFunc(100, 8)(key)
+		if strings.Contains(path.GetFullPath(), "..") || len(strings.Split(path.FilePath, "/")) != 8 {
+			t.Errorf("unexpected path %s for key %q", path.GetFullPath(), key)
+		}
+	}
+}
+
+func TestDiskStore_WriteContent(t *testing.T) {
+	s, teardown := setupDiskTest(t)
+	defer teardown()
+	s.PathTransformFunc = CASPathTransformFunc(2, 2)
+
+	data := []byte("content addressed")
+	key, n, err := s.WriteContent(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(data)
+	if key != hex.EncodeToString(sum[:]) || n != int64(len(data)) {
+		t.Fatalf("expect key %x of %d bytes, but got %s of %d", sum, len(data), key, n)
+	}
+
+	again, _, err := s.WriteContent(bytes.NewReader(data))
+	if err != nil || again != key {
+		t.Fatalf("expect the same key %s, but got %s: %v", key, again, err)
+	}
+
+	_, r, err := s.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	b, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("read wrong: got %s: %v", b, err)
+	}
+
+	// one object, no temp file left behind
+	var objects int
+	if err := s.Walk("", func(ObjectInfo) error { objects++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(s.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objects != 1 || len(entries) != 2 {
+		t.Errorf("expect one object and no temp file, got %d objects and %d entries", objects, len(entries))
+	}
 }
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	errtype "github.com/peterouob/file_system/type"
+)
+
+// needleRecord is a needle found on disk while scanning the needle log.
+type needleRecord struct {
+	Attrs  []Attribute // only valid during the callback
+	Header NeedleHeader
+	Offset int64
+	Length int64
+}
+
+// scanResult describes where the intact part of a needle log ends.
+type scanResult struct {
+	End     int64 // offset right after the last intact needle
+	Corrupt int   // needles skipped because their checksum or size was bad
+	Torn    bool  // the log ends with an incomplete needle starting at End
+}
+
+/*
+scanNeedles walks the needle log in r from start to end and calls fn for every
+needle whose framing and checksum are valid. The payload is streamed through a
+pooled chunk, so needles of any size can be verified.
+
+	torn tail   -> the last needle is incomplete, scanning stops and Torn is set
+	bad crc     -> the needle is skipped and counted as Corrupt
+	bad size    -> the needle runs past end but an intact one follows, the bytes
+	               up to it are skipped and counted as Corrupt
+	bad framing -> a needle in the middle of the log can't be parsed, ErrCorruptVolume
+*/
+func scanNeedles(r io.ReaderAt, start, end int64, bp *BufferPool, fn func(rec needleRecord) error) (scanResult, error) {
+	res := scanResult{End: start}
+
+	chunk, err := bp.Get(largeSize)
+	if err != nil {
+		return res, err
+	}
+	defer bp.Put(chunk)
+
+	var (
+		header [NeedleHeaderV2Size]byte
+		footer [NeedleFooterSize]byte
+		attrs  []byte
+	)
+
+	for off := start; off < end; {
+		if end-off < NeedleHeaderSize {
+			res.Torn = true
+			return res, nil
+		}
+
+		if _, err := r.ReadAt(header[:NeedleHeaderSize], off); err != nil {
+			return res, err
+		}
+
+		magic := binary.BigEndian.Uint32(header[0:4])
+		if !validMagic(magic) {
+			zero, err := isZeroTail(r, off, end, chunk.B[:cap(chunk.B)])
+			if err != nil {
+				return res, err
+			}
+			if zero {
+				res.Torn = true
+				return res, nil
+			}
+			return res, fmt.Errorf("%w: bad magic header at offset %d", errtype.ErrCorruptVolume, off)
+		}
+
+		hs := int64(NeedleHeaderSize)
+		if magic == MagicHeaderV2 {
+			hs = NeedleHeaderV2Size
+			if end-off < hs {
+				res.Torn = true
+				return res, nil
+			}
+			if _, err := r.ReadAt(header[NeedleHeaderSize:hs], off+NeedleHeaderSize); err != nil {
+				return res, err
+			}
+		}
+
+		h := decodeNeedleHeader(header[:hs])
+		body := int64(h.AttrSize) + int64(h.Size)
+
+		length := h.length()
+		if off+length > end {
+			// a torn needle is the last thing in the log, a corrupt size isn't
+			next, err := nextFramed(r, off+8, end)
+			if err != nil {
+				return res, err
+			}
+			if next == end {
+				res.Torn = true
+				return res, nil
+			}
+			res.Corrupt++
+			off = next
+			res.End = off
+			continue
+		}
+
+		crc := needleCRC(header[:hs])
+		for pos, remain := off+hs, body; remain > 0; {
+			n := min(remain, int64(cap(chunk.B)))
+			buf := chunk.B[:n]
+			if _, err := r.ReadAt(buf, pos); err != nil {
+				return res, err
+			}
+			// the attributes are at most MaxAttrSize, they come with the first chunk
+			if pos == off+hs {
+				attrs = append(attrs[:0], buf[:h.AttrSize]...)
+			}
+			crc = crc.Update(buf)
+			pos += n
+			remain -= n
+		}
+
+		if _, err := r.ReadAt(footer[:], off+hs+body); err != nil {
+			return res, err
+		}
+
+		validFooter := binary.BigEndian.Uint32(footer[4:8]) == MagicFooter
+		validCrc := binary.BigEndian.Uint32(footer[0:4]) == crc.Value()
+
+		if !validFooter || !validCrc {
+			if off+length >= end {
+				res.Torn = true
+				return res, nil
+			}
+			if !validFooter {
+				return res, fmt.Errorf("%w: bad magic footer at offset %d", errtype.ErrCorruptVolume, off)
+			}
+			res.Corrupt++
+			off += length
+			res.End = off
+			continue
+		}
+
+		rec := needleRecord{Header: h, Offset: off, Length: length}
+		if h.AttrSize > 0 {
+			if rec.Attrs, err = parseAttributes(attrs); err != nil {
+				res.Corrupt++
+				off += length
+				res.End = off
+				continue
+			}
+		}
+
+		if err := fn(rec); err != nil {
+			return res, err
+		}
+
+		off += length
+		res.End = off
+	}
+
+	return res, nil
+}
+
+// isZeroTail reports whether every byte from off to end is zero, which is what a
+// crash leaves behind when the file was extended but the needle never hit disk.
+func isZeroTail(r io.ReaderAt, off, end int64, buf []byte) (bool, error) {
+	for off < end {
+		n := min(end-off, int64(len(buf)))
+		if _, err := r.ReadAt(buf[:n], off); err != nil {
+			return false, err
+		}
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		off += n
+	}
+	return true, nil
+}
+
+// nextFramed returns the first 8 byte aligned offset from off on holding a needle
+// whose header and footer magic both fit before end, end when there is none.
+func nextFramed(r io.ReaderAt, off, end int64) (int64, error) {
+	var (
+		header [NeedleHeaderV2Size]byte
+		footer [4]byte
+	)
+
+	for ; ; off += 8 {
+		next, err := nextMagic(r, off, end)
+		if err != nil || next == end {
+			return end, err
+		}
+		off = next
+
+		if _, err := r.ReadAt(header[:NeedleHeaderSize], off); err != nil {
+			return end, err
+		}
+		hs := int64(NeedleHeaderSize)
+		if binary.BigEndian.Uint32(header[:4]) == MagicHeaderV2 {
+			hs = NeedleHeaderV2Size
+			if off+hs > end {
+				continue
+			}
+			if _, err := r.ReadAt(header[NeedleHeaderSize:hs], off+NeedleHeaderSize); err != nil {
+				return end, err
+			}
+		}
+
+		h := decodeNeedleHeader(header[:hs])
+		if off+h.length() > end {
+			continue
+		}
+		at := off + hs + int64(h.AttrSize) + int64(h.Size) + 4
+		if _, err := r.ReadAt(footer[:], at); err != nil {
+			return end, err
+		}
+		if binary.BigEndian.Uint32(footer[:]) == MagicFooter {
+			return off, nil
+		}
+	}
+}
@@ -0,0 +1,421 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	errtype "github.com/peterouob/file_system/type"
+)
+
+/*
+scrub file (.scrub) sits next to the volume data file and keeps the scrubber
+progress across restarts
+
++-------+---------+--------+---------+-------+-------+-----+-----+
+| Magic | Version | Cursor | Entries | entry | entry | ... | CRC |
+| 4     | 4       | 8      | 4       |       |       |     | 4   |
++-------+---------+--------+---------+-------+-------+-----+-----+
+
+entry
++-----+--------+--------+------+
+| Key | AltKey | Offset | Code |
+| 8   | 4      | 8      | 1    |
++-----+--------+--------+------+
+
+Cursor is the data offset the next pass resumes at, the entries are the
+quarantined needles and the error they failed with. A missing or damaged file
+only costs a pass starting over.
+*/
+
+const (
+	scrubMagic      = 0x53435242
+	scrubVersion    = 1
+	scrubHeaderSize = 20
+	scrubEntrySize  = 21
+
+	scrubSaveInterval = time.Second
+)
+
+// scrubErrors maps the error code of a scrub file entry to its error, unknown
+// codes read back as ErrCorruptVolume.
+var scrubErrors = []error{errtype.ErrCorruptVolume, errtype.ErrMagicNumber, errtype.ErrCrcNotValid}
+
+// ScrubEntry is a needle the scrubber found corrupt.
+type ScrubEntry struct {
+	Err    error
+	Key    KeyPair
+	Offset int64
+}
+
+// ScrubReport sums up one call of Scrub.
+type ScrubReport struct {
+	Corrupt []ScrubEntry // needles found corrupt by this call
+	Checked int          // live needles checked
+	Bytes   int64        // bytes read from the data file
+	Done    bool         // the pass reached the end of the volume, the next one starts over
+}
+
+type scrubState struct {
+	mu         sync.Mutex
+	quarantine map[KeyPair]ScrubEntry
+	path       string
+	cursor     int64
+	gen        uint64 // bumped by compaction, which moves every needle
+}
+
+// scrubPath returns the scrub file path of a volume data file, bench.vol -> bench.scrub.
+func scrubPath(dataPath string) string {
+	return strings.TrimSuffix(dataPath, filepath.Ext(dataPath)) + ".scrub"
+}
+
+func scrubCode(err error) byte {
+	for i, e := range scrubErrors {
+		if errors.Is(err, e) {
+			return byte(i)
+		}
+	}
+	return 0
+}
+
+func scrubError(code byte) error {
+	if int(code) < len(scrubErrors) {
+		return scrubErrors[code]
+	}
+	return errtype.ErrCorruptVolume
+}
+
+// loadScrubState reads the scrub file at path, a missing or damaged file gives
+// a fresh state.
+func loadScrubState(path string) *scrubState {
+	s := &scrubState{path: path, quarantine: make(map[KeyPair]ScrubEntry)}
+
+	b, err := os.ReadFile(filepath.Clean(path))
+	if err != nil || len(b) < scrubHeaderSize+4 {
+		return s
+	}
+
+	body, sum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	entries := int(binary.BigEndian.Uint32(body[16:20]))
+
+	if binary.BigEndian.Uint32(body[0:4]) != scrubMagic ||
+		binary.BigEndian.Uint32(body[4:8]) != scrubVersion ||
+		len(body) != scrubHeaderSize+entries*scrubEntrySize ||
+		NewCRC(body).Value() != sum {
+		return s
+	}
+
+	s.cursor = int64(binary.BigEndian.Uint64(body[8:16]))
+	for e := body[scrubHeaderSize:]; len(e) > 0; e = e[scrubEntrySize:] {
+		key := KeyPair{Key: binary.BigEndian.Uint64(e[0:8]), AltKey: binary.BigEndian.Uint32(e[8:12])}
+		s.quarantine[key] = ScrubEntry{
+			Key:    key,
+			Offset: int64(binary.BigEndian.Uint64(e[12:20])),
+			Err:    scrubError(e[20]),
+		}
+	}
+
+	return s
+}
+
+// save writes the state to the scrub file through a temporary file, s.mu must
+// be held. Losing the latest progress to a crash is harmless, so it doesn't sync.
+func (s *scrubState) save() error {
+	b := binary.BigEndian.AppendUint32(nil, scrubMagic)
+	b = binary.BigEndian.AppendUint32(b, scrubVersion)
+	b = binary.BigEndian.AppendUint64(b, uint64(s.cursor))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s.quarantine)))
+
+	for _, e := range s.quarantine {
+		b = binary.BigEndian.AppendUint64(b, e.Key.Key)
+		b = binary.BigEndian.AppendUint32(b, e.Key.AltKey)
+		b = binary.BigEndian.AppendUint64(b, uint64(e.Offset))
+		b = append(b, scrubCode(e.Err))
+	}
+	b = binary.BigEndian.AppendUint32(b, NewCRC(b).Value())
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(filepath.Clean(tmpPath), b, 0600); err != nil {
+		return fmt.Errorf("scrub save error: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("scrub save error: %w", err)
+	}
+
+	return nil
+}
+
+// compacted moves the quarantined needles to the offsets compaction copied
+// them to and restarts the pass, the offsets of the old file mean nothing in
+// the new one. moved holds the new offset of every quarantined needle copied.
+// v.mu must be held.
+func (s *scrubState) compacted(moved map[KeyPair]int64, index map[KeyPair]NeedleMeta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, e := range s.quarantine {
+		off, ok := moved[key]
+		if !ok || index[key].Offset != off {
+			delete(s.quarantine, key)
+			continue
+		}
+		e.Offset = off
+		s.quarantine[key] = e
+	}
+
+	s.cursor = SuperBlockSize
+	s.gen++
+}
+
+// quarantined returns the quarantined needles that are still live, the others
+// were overwritten or deleted since. v.mu and s.mu must be held.
+func (v *Volume) quarantined() []ScrubEntry {
+	entries := make([]ScrubEntry, 0, len(v.scrub.quarantine))
+	for key, e := range v.scrub.quarantine {
+		if meta, ok := v.index[key]; ok && meta.Offset == e.Offset {
+			entries = append(entries, e)
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b ScrubEntry) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+	return entries
+}
+
+// Quarantine returns the live needles the scrubber found corrupt, in file order.
+func (v *Volume) Quarantine() []ScrubEntry {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	v.scrub.mu.Lock()
+	defer v.scrub.mu.Unlock()
+
+	return v.quarantined()
+}
+
+/*
+Scrub checks the magic numbers and the CRC of the live needles in file order
+and quarantines the corrupt ones, a needle that checks out again leaves the
+quarantine. A pass
+
+ 1. starts at the cursor the last pass stopped at
+ 2. reads at most ScrubRate bytes per second
+ 3. saves the cursor every second and when it is cancelled through ctx
+ 4. starts over once it reached the end of the volume
+
+so a large volume is covered over several calls or restarts. A compaction
+during the pass ends it early, the next one starts over on the new file.
+*/
+func (v *Volume) Scrub(ctx context.Context) (ScrubReport, error) {
+	v.scrubMu.Lock()
+	defer v.scrubMu.Unlock()
+
+	var report ScrubReport
+
+	v.mu.RLock()
+	v.scrub.mu.Lock()
+	cursor, gen := v.scrub.cursor, v.scrub.gen
+	v.scrub.mu.Unlock()
+
+	pending := make([]liveNeedle, 0, len(v.index))
+	for key, meta := range v.index {
+		if meta.Offset >= cursor {
+			pending = append(pending, liveNeedle{key: key, meta: meta})
+		}
+	}
+	f, release := v.holdData()
+	v.mu.RUnlock()
+	defer release()
+
+	slices.SortFunc(pending, func(a, b liveNeedle) int {
+		return cmp.Compare(a.meta.Offset, b.meta.Offset)
+	})
+
+	chunk, err := v.bufferPool.Get(streamChunkSize)
+	if err != nil {
+		return report, err
+	}
+	defer v.bufferPool.Put(chunk)
+
+	var (
+		buf   = chunk.B[:cap(chunk.B)]
+		start = time.Now()
+		saved = start
+	)
+
+	for _, live := range pending {
+		if err := v.throttle(ctx, start, report.Bytes); err != nil {
+			return report, errors.Join(err, v.saveScrub(gen))
+		}
+
+		err := checkNeedle(f, live.key, live.meta, buf)
+		report.Checked++
+		report.Bytes += live.meta.length()
+
+		// a needle overwritten or deleted meanwhile is no longer our concern
+		if err != nil && !v.isLive(live) {
+			err = nil
+		}
+
+		entry := ScrubEntry{Key: live.key, Offset: live.meta.Offset, Err: err}
+		if err != nil {
+			report.Corrupt = append(report.Corrupt, entry)
+		}
+
+		if !v.advanceScrub(gen, entry, live.meta.Offset+live.meta.length()) {
+			return report, nil
+		}
+
+		if time.Since(saved) >= scrubSaveInterval {
+			saved = time.Now()
+			if err := v.saveScrub(gen); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	report.Done = v.finishScrub(gen)
+	return report, v.saveScrub(gen)
+}
+
+// throttle sleeps until reading bytes since start stays within ScrubRate.
+func (v *Volume) throttle(ctx context.Context, start time.Time, bytes int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if v.opts.ScrubRate <= 0 {
+		return nil
+	}
+
+	wait := time.Duration(float64(bytes)/float64(v.opts.ScrubRate)*float64(time.Second)) - time.Since(start)
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (v *Volume) isLive(live liveNeedle) bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	meta, ok := v.index[live.key]
+	return ok && meta.Offset == live.meta.Offset
+}
+
+// advanceScrub records the result of e and moves the cursor, it reports false
+// when a compaction started a new generation since the pass began.
+func (v *Volume) advanceScrub(gen uint64, e ScrubEntry, cursor int64) bool {
+	v.scrub.mu.Lock()
+	defer v.scrub.mu.Unlock()
+
+	if v.scrub.gen != gen {
+		return false
+	}
+
+	if e.Err != nil {
+		v.scrub.quarantine[e.Key] = e
+	} else {
+		delete(v.scrub.quarantine, e.Key)
+	}
+
+	v.scrub.cursor = cursor
+	return true
+}
+
+// finishScrub rewinds the cursor so the next pass starts over, it reports false
+// when a compaction started a new generation since the pass began.
+func (v *Volume) finishScrub(gen uint64) bool {
+	v.scrub.mu.Lock()
+	defer v.scrub.mu.Unlock()
+
+	if v.scrub.gen != gen {
+		return false
+	}
+
+	v.scrub.cursor = SuperBlockSize
+	return true
+}
+
+func (v *Volume) saveScrub(gen uint64) error {
+	if v.opts.ReadOnly {
+		return nil
+	}
+
+	v.scrub.mu.Lock()
+	defer v.scrub.mu.Unlock()
+
+	if v.scrub.gen != gen {
+		return nil
+	}
+	return v.scrub.save()
+}
+
+// checkNeedle verifies the magic numbers and the CRC of the needle at meta
+// without decoding its payload, a compressed needle is checked as stored. buf
+// has to hold a v2 header and MaxAttrSize bytes of attributes.
+func checkNeedle(r io.ReaderAt, key KeyPair, meta NeedleMeta, buf []byte) error {
+	head := buf[:headerSize(meta.Version)+int64(meta.AttrSize)]
+	if _, err := r.ReadAt(head, meta.Offset); err != nil {
+		return fmt.Errorf("%w: read header: %v", errtype.ErrCorruptVolume, err)
+	}
+
+	h := decodeNeedleHeader(head)
+	if !validMagic(h.MagicHeader) || h.Version() != meta.Version {
+		return fmt.Errorf("%w: header magic %#x", errtype.ErrMagicNumber, h.MagicHeader)
+	}
+
+	if h.Key != key.Key || h.AlternateKey != key.AltKey || h.Size != meta.Size || h.AttrSize != meta.AttrSize {
+		return fmt.Errorf("%w: needle header disagrees with the index", errtype.ErrCorruptVolume)
+	}
+
+	crc := needleCRC(head)
+	pos := meta.Offset + int64(len(head))
+
+	for remain := int64(meta.Size); remain > 0; {
+		n := min(remain, int64(len(buf)))
+		if _, err := r.ReadAt(buf[:n], pos); err != nil {
+			return fmt.Errorf("%w: read data: %v", errtype.ErrCorruptVolume, err)
+		}
+
+		crc = crc.Update(buf[:n])
+		pos += n
+		remain -= n
+	}
+
+	footer := buf[:NeedleFooterSize]
+	if _, err := r.ReadAt(footer, pos); err != nil {
+		return fmt.Errorf("%w: read footer: %v", errtype.ErrCorruptVolume, err)
+	}
+
+	if magic := binary.BigEndian.Uint32(footer[4:8]); magic != MagicFooter {
+		return fmt.Errorf("%w: footer magic %#x", errtype.ErrMagicNumber, magic)
+	}
+
+	if binary.BigEndian.Uint32(footer[0:4]) != crc.Value() {
+		return errtype.ErrCrcNotValid
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// corruptNeedles damages the payload of key 1 and the header magic of key 2.
+func corruptNeedles(t *testing.T, v *Volume, f *os.File) {
+	t.Helper()
+
+	data := v.index[KeyPair{Key: 1}]
+	_, err := f.WriteAt([]byte{0xff}, data.Offset+headerSize(data.Version)+1)
+	require.NoError(t, err)
+
+	magic := v.index[KeyPair{Key: 2}]
+	_, err = f.WriteAt([]byte{0, 0, 0, 0}, magic.Offset)
+	require.NoError(t, err)
+}
+
+func TestVolume_Scrub(t *testing.T) {
+	t.Run("Success_Clean", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		for key := range uint64(4) {
+			require.NoError(t, v.Write(newNeedle(key, "clean")))
+		}
+
+		report, err := v.Scrub(context.Background())
+		require.NoError(t, err)
+		assert.True(t, report.Done)
+		assert.Equal(t, 4, report.Checked)
+		assert.Equal(t, 4*needleLength(NeedleVersion2, 0, 5), report.Bytes)
+		assert.Empty(t, report.Corrupt)
+		assert.Empty(t, v.Quarantine())
+		assert.FileExists(t, scrubPath(f.Name()))
+	})
+
+	t.Run("Success_Quarantine", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		for key := range uint64(4) {
+			require.NoError(t, v.Write(newNeedle(key, "scrub me")))
+		}
+		corruptNeedles(t, v, f)
+
+		report, err := v.Scrub(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 4, report.Checked)
+		require.Len(t, report.Corrupt, 2)
+		assert.Equal(t, KeyPair{Key: 1}, report.Corrupt[0].Key)
+		assert.Equal(t, v.index[KeyPair{Key: 1}].Offset, report.Corrupt[0].Offset)
+		assert.ErrorIs(t, report.Corrupt[0].Err, errtype.ErrCrcNotValid)
+		assert.ErrorIs(t, report.Corrupt[1].Err, errtype.ErrMagicNumber)
+		require.NoError(t, v.Close())
+
+		// the quarantine survives a restart
+		v = reopenVolume(t, f)
+		quarantine := v.Quarantine()
+		require.Len(t, quarantine, 2)
+		assert.Equal(t, report.Corrupt[0].Offset, quarantine[0].Offset)
+		assert.ErrorIs(t, quarantine[0].Err, errtype.ErrCrcNotValid)
+		assert.ErrorIs(t, quarantine[1].Err, errtype.ErrMagicNumber)
+
+		// a needle written again leaves the quarantine
+		require.NoError(t, v.Write(newNeedle(1, "fixed")))
+		quarantine = v.Quarantine()
+		require.Len(t, quarantine, 1)
+		assert.Equal(t, KeyPair{Key: 2}, quarantine[0].Key)
+	})
+
+	t.Run("Success_Resume", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		// every needle after the first one waits a second for its turn
+		size := needleLength(NeedleVersion2, 0, 4096)
+		v, err := NewVolume(f, WithScrubber(0, size))
+		require.NoError(t, err)
+		for key := range uint64(4) {
+			require.NoError(t, v.Write(newNeedle(key, string(newPayload(4096)))))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		report, err := v.Scrub(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.False(t, report.Done)
+		assert.Equal(t, 1, report.Checked)
+		require.NoError(t, v.Close())
+
+		v = reopenVolume(t, f)
+		report, err = v.Scrub(context.Background())
+		require.NoError(t, err)
+		assert.True(t, report.Done)
+		assert.Equal(t, 3, report.Checked)
+
+		// the next pass starts over
+		report, err = v.Scrub(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 4, report.Checked)
+	})
+
+	t.Run("Success_Compact", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		for key := range uint64(4) {
+			require.NoError(t, v.Write(newNeedle(key, "scrub me")))
+		}
+		require.NoError(t, v.Write(newNeedle(0, "overwritten")))
+		corruptNeedles(t, v, f)
+
+		_, err := v.Scrub(context.Background())
+		require.NoError(t, err)
+		require.Len(t, v.Quarantine(), 2)
+
+		_, err = v.Compact()
+		require.NoError(t, err)
+
+		quarantine := v.Quarantine()
+		require.Len(t, quarantine, 2)
+		assert.Equal(t, v.index[KeyPair{Key: 1}].Offset, quarantine[0].Offset)
+		assert.Equal(t, v.index[KeyPair{Key: 2}].Offset, quarantine[1].Offset)
+
+		report, err := v.Scrub(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 4, report.Checked)
+		assert.Len(t, report.Corrupt, 2)
+	})
+
+	t.Run("Success_Background", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithScrubber(time.Millisecond, 0))
+		require.NoError(t, err)
+		for key := range uint64(4) {
+			require.NoError(t, v.Write(newNeedle(key, "scrub me")))
+		}
+
+		v.mu.RLock()
+		corruptNeedles(t, v, f)
+		v.mu.RUnlock()
+
+		require.Eventually(t, func() bool {
+			return len(v.Quarantine()) == 2
+		}, time.Second, time.Millisecond)
+
+		require.NoError(t, v.Close())
+	})
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"fmt"
+
+	errtype "github.com/peterouob/file_system/type"
+)
+
+// Seal makes the volume read only for new needles and persists that in the
+// superblock, so the volume stays sealed after a restart. Deletes are still
+// accepted, their tombstones are what compaction reclaims a sealed volume by.
+func (v *Volume) Seal() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.seal()
+}
+
+func (v *Volume) seal() error {
+	if v.opts.ReadOnly {
+		return errtype.ErrReadOnly
+	}
+
+	if v.super.Sealed {
+		return nil
+	}
+
+	v.super.Sealed = true
+	if err := v.writeSuperBlock(); err != nil {
+		v.super.Sealed = false
+		return fmt.Errorf("seal error: %w", err)
+	}
+
+	return nil
+}
+
+// Sealed reports whether the volume takes no more needles.
+func (v *Volume) Sealed() bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	return v.super.Sealed
+}
+
+// maxSize is the limit of the data file, the one written to the superblock at
+// creation wins over the one the volume is opened with.
+func (v *Volume) maxSize() int64 {
+	if v.super.MaxSize > 0 {
+		return v.super.MaxSize
+	}
+	return v.opts.MaxSize
+}
+
+// writable checks that n more bytes can be appended to the volume. A volume too
+// full to take them is sealed. v.mu must be held.
+func (v *Volume) writable(n int64) error {
+	if v.opts.ReadOnly {
+		return errtype.ErrReadOnly
+	}
+
+	if v.super.Sealed {
+		return errtype.ErrVolumeSealed
+	}
+
+	limit := v.maxSize()
+	if limit > 0 && SuperBlockSize+n > limit {
+		// it wouldn't fit an empty volume either, no reason to seal this one
+		return fmt.Errorf("%w: needle of %d bytes, volume limit %d", errtype.ErrToLarge, n, limit)
+	}
+
+	if limit > 0 && v.writeOffset+n > limit {
+		if err := v.seal(); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %d of %d bytes used", errtype.ErrVolumeSealed, v.writeOffset, limit)
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolume_Seal(t *testing.T) {
+	t.Run("Success_SealWhenFull", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithMaxSize(SuperBlockSize+2*needleLength(NeedleVersion2, 0, 100)))
+		require.NoError(t, err)
+
+		require.NoError(t, v.Write(newRandomNeedle(1, 100)))
+		require.NoError(t, v.Write(newRandomNeedle(2, 100)))
+		assert.False(t, v.Sealed())
+
+		assert.ErrorIs(t, v.Write(newRandomNeedle(3, 100)), errtype.ErrVolumeSealed)
+		assert.True(t, v.Sealed())
+
+		_, err = v.Read(KeyPair{Key: 2}, 0)
+		assert.NoError(t, err)
+
+		require.NoError(t, v.Close())
+
+		// the limit and the seal come from the superblock, not the options
+		reopened, err := NewVolume(f, WithMaxSize(DefaultMaxVolumeSize))
+		require.NoError(t, err)
+		assert.True(t, reopened.Sealed())
+		assert.Equal(t, SuperBlockSize+2*needleLength(NeedleVersion2, 0, 100), reopened.SuperBlock().MaxSize)
+		assert.ErrorIs(t, reopened.Write(newRandomNeedle(4, 1)), errtype.ErrVolumeSealed)
+	})
+
+	t.Run("Success_ExplicitSeal", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		require.NoError(t, v.Write(newRandomNeedle(1, 100)))
+		require.NoError(t, v.Seal())
+		require.NoError(t, v.Seal())
+
+		assert.ErrorIs(t, v.Write(newRandomNeedle(2, 100)), errtype.ErrVolumeSealed)
+
+		reopened, err := NewVolume(f)
+		require.NoError(t, err)
+		assert.True(t, reopened.Sealed())
+	})
+}
+
+func TestVolume_ReadOnly(t *testing.T) {
+	t.Run("Success_ReadWithoutWriting", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		require.NoError(t, v.Write(newRandomNeedle(1, 100)))
+		require.NoError(t, v.Close())
+
+		// a torn needle at the tail must survive a read only open
+		buf := newRandomNeedle(2, 100).Bytes(v.bufferPool)
+		_, err := f.WriteAt(buf.B[:40], v.writeOffset)
+		require.NoError(t, err)
+
+		before, err := f.Stat()
+		require.NoError(t, err)
+		idxBefore, err := os.ReadFile(indexPath(f.Name()))
+		require.NoError(t, err)
+
+		ro, err := os.Open(f.Name())
+		require.NoError(t, err)
+		defer func() {
+			_ = ro.Close()
+		}()
+
+		rv, err := NewVolume(ro, WithReadOnly())
+		require.NoError(t, err)
+
+		got, err := rv.Read(KeyPair{Key: 1}, 0)
+		require.NoError(t, err)
+		assert.Equal(t, byte(1), got[0])
+
+		assert.ErrorIs(t, rv.Write(newRandomNeedle(3, 10)), errtype.ErrReadOnly)
+		assert.ErrorIs(t, rv.Delete(KeyPair{Key: 1}, 0), errtype.ErrReadOnly)
+		assert.ErrorIs(t, rv.Seal(), errtype.ErrReadOnly)
+		_, err = rv.Compact()
+		assert.ErrorIs(t, err, errtype.ErrReadOnly)
+		require.NoError(t, rv.Close())
+
+		after, err := f.Stat()
+		require.NoError(t, err)
+		assert.Equal(t, before.Size(), after.Size())
+
+		idxAfter, err := os.ReadFile(indexPath(f.Name()))
+		require.NoError(t, err)
+		assert.Equal(t, idxBefore, idxAfter)
+	})
+
+	t.Run("Success_MissingIndexFile", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		require.NoError(t, v.Write(newRandomNeedle(1, 100)))
+		require.NoError(t, v.Close())
+		require.NoError(t, os.Remove(indexPath(f.Name())))
+
+		rv, err := NewVolume(f, WithReadOnly())
+		require.NoError(t, err)
+		assert.Len(t, rv.index, 1)
+
+		_, err = os.Stat(indexPath(f.Name()))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("Error_EmptyFile", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		_, err := NewVolume(f, WithReadOnly())
+		assert.ErrorIs(t, err, errtype.ErrSuperBlock)
+	})
+}
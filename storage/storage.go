@@ -1,12 +1,22 @@
 package storage
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/peterouob/file_system/crypto"
+	errtype "github.com/peterouob/file_system/type"
 )
 
 type DiskStore struct {
@@ -15,6 +25,15 @@ type DiskStore struct {
 
 const (
 	defaultRoot = "root"
+	// metaDir holds an objectMeta per object under Root, at the path of the
+	// object, so objects are listed by key whatever the PathTransformFunc.
+	metaDir = ".meta"
+	// tmpPattern names the files objects are written to before they get
+	// their path.
+	tmpPattern = ".tmp-*"
+	// defaultSweepGrace outlasts any write, a temp file older than it was
+	// left behind by a crash.
+	defaultSweepGrace = time.Hour
 )
 
 func defaultPathTransformFunc(key string) PathKey {
@@ -28,58 +47,288 @@ func NewDiskStore(options ...Option) *DiskStore {
 	opts := Opts{
 		Root:              defaultRoot,
 		PathTransformFunc: defaultPathTransformFunc,
+		SweepGrace:        defaultSweepGrace,
 	}
 
 	for _, opt := range options {
 		opt(&opts)
 	}
 
-	return &DiskStore{
+	s := &DiskStore{
 		opts,
 	}
+	if _, err := s.Sweep(); err != nil {
+		log.Printf("sweep store %s: %v", s.Root, err)
+	}
+	return s
+}
+
+/*
+Sweep removes the temp files writes left behind under Root when they were cut
+off by a crash, and returns how many it removed. Only temp files last modified
+more than SweepGrace ago are removed, so the sweep NewDiskStore runs once
+leaves alone the writes another process sharing the store has going on.
+*/
+func (s *DiskStore) Sweep() (int, error) {
+	root, err := os.OpenRoot(s.Root)
+	if err != nil {
+		// nothing was written yet
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	var removed int
+	err = fs.WalkDir(root.FS(), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		if ok, _ := filepath.Match(tmpPattern, d.Name()); !ok {
+			return nil
+		}
+
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if time.Since(info.ModTime()) < s.SweepGrace {
+			return nil
+		}
+
+		if err := root.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
 }
 
 type Store interface {
 	Has(string) bool
 	Write(key string, r io.Reader) (int64, error)
 	Read(key string) (int64, io.ReadCloser, error)
+	ReadRange(key string, off, n int64) (io.ReadCloser, error)
+	Delete(key string) error
+	Stat(key string) (ObjectInfo, error)
+	List(prefix, token string, limit int) ([]ObjectInfo, string, error)
+	Walk(prefix string, fn func(ObjectInfo) error) error
+}
+
+// ObjectInfo describes an object of a Store.
+type ObjectInfo struct {
+	Key      string // empty for an object without metadata, see List
+	Path     string // path of the object under Root
+	Size     int64  // bytes as stored, an encrypted object counts its IV
+	ModTime  time.Time
+	Checksum []byte // SHA-256 of the bytes as stored
+}
+
+// objectMeta is kept next to every object written since the store records
+// keys, an object without one has no Checksum and is listed without its Key.
+type objectMeta struct {
+	Key    string `json:"key"`
+	SHA256 []byte `json:"sha256"`
 }
 
 var _ Store = (*DiskStore)(nil)
 
+/*
+pathKey transforms key into its path under Root and rejects with ErrInvalidKey
+what doesn't stay inside: empty names, "." and ".." elements, absolute paths and
+the names the store keeps for itself, metaDir at the top and temp files.
+*/
+func (s *DiskStore) pathKey(key string) (PathKey, error) {
+	path := s.PathTransformFunc(key)
+	if key == "" || path.FileName == "" {
+		return path, fmt.Errorf("%w: %q", errtype.ErrInvalidKey, key)
+	}
+
+	full := path.GetFullPath()
+	if !fs.ValidPath(full) || !filepath.IsLocal(filepath.FromSlash(full)) {
+		return path, fmt.Errorf("%w: %q escapes the root", errtype.ErrInvalidKey, key)
+	}
+
+	parts := strings.Split(full, "/")
+	if parts[0] == metaDir {
+		return path, fmt.Errorf("%w: %q is reserved", errtype.ErrInvalidKey, key)
+	}
+	for _, part := range parts {
+		if ok, _ := filepath.Match(tmpPattern, part); ok {
+			return path, fmt.Errorf("%w: %q is reserved", errtype.ErrInvalidKey, key)
+		}
+	}
+	return path, nil
+}
+
+/*
+openRoot opens Root, every operation of the store works through it so a
+symlink under Root can't lead a read, write or delete out of it. create makes
+Root first for the operations that write.
+*/
+func (s *DiskStore) openRoot(create bool) (*os.Root, error) {
+	if create {
+		if err := os.MkdirAll(s.Root, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	return os.OpenRoot(s.Root)
+}
+
 func (s *DiskStore) Has(key string) bool {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s", s.Root, pathKey.GetFullPath())
+	path, err := s.pathKey(key)
+	if err != nil {
+		return false
+	}
+
+	root, err := s.openRoot(false)
+	if err != nil {
+		return false
+	}
+	defer func() {
+		_ = root.Close()
+	}()
 
-	_, err := os.Stat(fullPathWithRoot)
-	return !errors.Is(err, os.ErrNotExist)
+	// a path leading out of root errors too
+	_, err = root.Stat(path.GetFullPath())
+	return err == nil
 }
 
-func (s *DiskStore) openWriteFile(key string) (*os.File, error) {
-	path := s.PathTransformFunc(key)
-	pathWithRoot := fmt.Sprintf("%s/%s", s.Root, path.FilePath)
+/*
+writeAtomic writes what fill writes to a temp file next to path under root and
+renames it into place once it is synced, the directory is synced after the
+rename. A crash leaves either the old file or the new one at path, never a
+partial one, and at worst a temp file the startup sweep removes.
+*/
+func writeAtomic(root *os.Root, path string, fill func(io.Writer) error) (err error) {
+	dir := filepath.Dir(path)
+	if err := root.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
 
-	if err := os.MkdirAll(pathWithRoot, os.ModePerm); err != nil {
-		return nil, err
+	tmp, tmpPath, err := createTemp(root, dir)
+	if err != nil {
+		return err
 	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = root.Remove(tmpPath)
+		}
+	}()
 
-	fullPathWithRoot := fmt.Sprintf("%s/%s", s.Root, path.GetFullPath())
-	f, err := os.Create(fullPathWithRoot)
+	if err := fill(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := root.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDirIn(root, dir)
+}
+
+// createTemp creates a new file matching tmpPattern in dir under root, os.Root
+// has no CreateTemp.
+func createTemp(root *os.Root, dir string) (*os.File, string, error) {
+	for {
+		path := filepath.Join(dir, strings.TrimSuffix(tmpPattern, "*")+rand.Text())
+		f, err := root.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		return f, path, err
+	}
+}
+
+// writeObject writes the object under key through copyFn and records its
+// checksum once it is in place.
+func (s *DiskStore) writeObject(key string, copyFn func(io.Writer) (int64, error)) (int64, error) {
+	path, err := s.pathKey(key)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+
+	root, err := s.openRoot(true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	var n int64
+	h := sha256.New()
+	err = writeAtomic(root, path.GetFullPath(), func(w io.Writer) (err error) {
+		n, err = copyFn(io.MultiWriter(w, h))
+		return err
+	})
+	if err != nil {
+		return n, err
+	}
+
+	return n, writeMeta(root, key, path, h.Sum(nil))
+}
+
+// metaPath returns the path of the objectMeta of the object at path under Root.
+func metaPath(path string) string {
+	return filepath.Join(metaDir, path)
+}
+
+// writeMeta records the key and the checksum of the object just written.
+func writeMeta(root *os.Root, key string, path PathKey, sum []byte) error {
+	b, err := json.Marshal(objectMeta{Key: key, SHA256: sum})
+	if err != nil {
+		return err
+	}
+
+	return writeAtomic(root, metaPath(path.GetFullPath()), func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+// readMeta reads the objectMeta of the object at path under root.
+func readMeta(root *os.Root, path string) (objectMeta, error) {
+	var meta objectMeta
+
+	b, err := root.ReadFile(metaPath(path))
+	if err != nil {
+		return meta, err
 	}
-	return f, nil
+	return meta, json.Unmarshal(b, &meta)
 }
 
 func (s *DiskStore) openReadFile(key string) (*os.File, error) {
-	path := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s", s.Root, path.GetFullPath())
+	path, err := s.pathKey(key)
+	if err != nil {
+		return nil, err
+	}
 
-	f, err := os.Open(fullPathWithRoot)
+	root, err := s.openRoot(false)
 	if err != nil {
 		return nil, err
 	}
-	return f, nil
+	defer func() {
+		_ = root.Close()
+	}()
+
+	return root.Open(path.GetFullPath())
 }
 
 func (s *DiskStore) Write(key string, r io.Reader) (int64, error) {
@@ -87,33 +336,81 @@ func (s *DiskStore) Write(key string, r io.Reader) (int64, error) {
 }
 
 func (s *DiskStore) writeStream(key string, r io.Reader) (int64, error) {
-	f, err := s.openWriteFile(key)
+	return s.writeObject(key, func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
+	})
+}
+
+func (s *DiskStore) WriteEncrypt(encKey []byte, key string, r io.Reader) (int64, error) {
+	n, err := s.writeObject(key, func(w io.Writer) (int64, error) {
+		n, err := crypto.CopyEnCrypto(encKey, r, w)
+		return int64(n), err
+	})
 	if err != nil {
 		return 0, err
 	}
+	return n, nil
+}
 
+/*
+WriteContent stores what r holds under a key derived from the content, the hex
+SHA-256 of it, and returns the key. Content the store already holds isn't
+stored twice, together with CASPathTransformFunc it gives a deduplicating
+store with an even fan-out.
+*/
+func (s *DiskStore) WriteContent(r io.Reader) (string, int64, error) {
+	root, err := s.openRoot(true)
+	if err != nil {
+		return "", 0, err
+	}
 	defer func() {
-		_ = f.Close()
+		_ = root.Close()
 	}()
 
-	return io.Copy(f, r)
-}
-
-func (s *DiskStore) WriteEncrypt(encKey []byte, key string, r io.Reader) (int64, error) {
-	f, err := s.openWriteFile(key)
+	// the key is only known once the content was read
+	tmp, tmpPath, err := createTemp(root, ".")
 	if err != nil {
-		return 0, err
+		return "", 0, err
 	}
-
 	defer func() {
-		_ = f.Close()
+		_ = tmp.Close()
+		_ = root.Remove(tmpPath)
 	}()
 
-	n, err := crypto.CopyEnCrypto(encKey, r, f)
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
 	if err != nil {
-		return 0, err
+		return "", n, err
 	}
-	return int64(n), nil
+	if err := tmp.Sync(); err != nil {
+		return "", n, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", n, err
+	}
+
+	sum := h.Sum(nil)
+	key := hex.EncodeToString(sum)
+	path, err := s.pathKey(key)
+	if err != nil {
+		return "", n, err
+	}
+	if _, err := root.Stat(path.GetFullPath()); err == nil {
+		return key, n, nil
+	}
+
+	dir := filepath.Dir(path.GetFullPath())
+	if err := root.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", n, err
+	}
+	if err := root.Rename(tmpPath, path.GetFullPath()); err != nil {
+		return "", n, err
+	}
+	if err := syncDirIn(root, dir); err != nil {
+		return "", n, err
+	}
+
+	return key, n, writeMeta(root, key, path, sum)
 }
 
 func (s *DiskStore) Read(key string) (int64, io.ReadCloser, error) {
@@ -150,3 +447,83 @@ func (s *DiskStore) ReadDecrypt(encKey []byte, key string, d io.Writer) (int64,
 
 	return int64(n), nil
 }
+
+// Delete removes the object stored under key and the directories left empty by
+// it, Root itself stays.
+func (s *DiskStore) Delete(key string) error {
+	path, err := s.pathKey(key)
+	if err != nil {
+		return err
+	}
+
+	root, err := s.openRoot(false)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %w", errtype.ErrNotFound, err)
+		}
+		return err
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	full := path.GetFullPath()
+	if err := root.Remove(full); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %w", errtype.ErrNotFound, err)
+		}
+		return err
+	}
+	pruneDirs(root, filepath.Dir(full))
+
+	if err := root.Remove(metaPath(full)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	pruneDirs(root, filepath.Dir(metaPath(full)))
+
+	return nil
+}
+
+// pruneDirs removes dir under root and its parents as long as they are empty,
+// root itself stays.
+func pruneDirs(root *os.Root, dir string) {
+	for dir = filepath.Clean(dir); dir != "."; dir = filepath.Dir(dir) {
+		// fails on the first directory that still holds something
+		if root.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// Stat describes the object stored under key without opening it.
+func (s *DiskStore) Stat(key string) (ObjectInfo, error) {
+	path, err := s.pathKey(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	root, err := s.openRoot(false)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ObjectInfo{}, fmt.Errorf("%w: %w", errtype.ErrNotFound, err)
+		}
+		return ObjectInfo{}, err
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	fi, err := root.Stat(path.GetFullPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ObjectInfo{}, fmt.Errorf("%w: %w", errtype.ErrNotFound, err)
+		}
+		return ObjectInfo{}, err
+	}
+
+	info := ObjectInfo{Key: key, Path: path.GetFullPath(), Size: fi.Size(), ModTime: fi.ModTime()}
+	if meta, err := readMeta(root, path.GetFullPath()); err == nil && meta.Key == key {
+		info.Checksum = meta.SHA256
+	}
+	return info, nil
+}
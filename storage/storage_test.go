@@ -2,10 +2,16 @@ package storage
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	errtype "github.com/peterouob/file_system/type"
 	"github.com/peterouob/file_system/utils"
 )
 
@@ -104,6 +110,197 @@ func TestDiskWithCrypto(t *testing.T) {
 	}
 }
 
+func TestDiskStore_Delete(t *testing.T) {
+	s, teardown := setupDiskTest(t)
+	defer teardown()
+
+	for _, key := range []string{"abcd", "abef"} {
+		if _, err := s.Write(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Delete("abcd"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has("abcd") || !s.Has("abef") {
+		t.Fatalf("expect only abef left")
+	}
+
+	if err := s.Delete("abef"); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{s.Root + "/ab", s.Root + "/" + metaDir + "/ab"} {
+		if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expect empty directory %s removed, got %v", dir, err)
+		}
+	}
+	if _, err := os.Stat(s.Root); err != nil {
+		t.Errorf("expect root kept, got %v", err)
+	}
+
+	if err := s.Delete("abcd"); !errors.Is(err, errtype.ErrNotFound) {
+		t.Errorf("expect ErrNotFound, got %v", err)
+	}
+}
+
+func TestDiskStore_Stat(t *testing.T) {
+	s, teardown := setupDiskTest(t)
+	defer teardown()
+
+	key := "peter_picture"
+	data := []byte("peter_picture_data")
+	if _, err := s.Write(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(data)
+	if info.Key != key || info.Size != int64(len(data)) || info.ModTime.IsZero() || !bytes.Equal(info.Checksum, sum[:]) {
+		t.Errorf("stat wrong: got %+v", info)
+	}
+
+	if _, err := s.Stat("missing"); !errors.Is(err, errtype.ErrNotFound) {
+		t.Errorf("expect ErrNotFound, got %v", err)
+	}
+}
+
+func TestDiskStore_List(t *testing.T) {
+	for name, transform := range map[string]PathTransformFunc{
+		"Default": defaultPathTransformFunc,
+		"File":    FileTransform,
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, teardown := setupDiskTest(t)
+			defer teardown()
+			s.PathTransformFunc = transform
+
+			want := make(map[string]bool)
+			for i := range 10 {
+				key := fmt.Sprintf("photo-%02d", i)
+				want[key] = true
+				if _, err := s.Write(key, bytes.NewReader([]byte(key))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := s.Write("doc-00", bytes.NewReader([]byte("doc"))); err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				got   = make(map[string]bool)
+				pages int
+				token string
+			)
+			for {
+				page, next, err := s.List("photo-", token, 4)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pages++
+				for _, info := range page {
+					if got[info.Key] {
+						t.Errorf("key %s listed twice", info.Key)
+					}
+					got[info.Key] = true
+				}
+				if next == "" {
+					break
+				}
+				token = next
+			}
+
+			if len(got) != len(want) || pages != 3 {
+				t.Errorf("list wrong: got %d keys in %d pages, want %d keys in 3", len(got), pages, len(want))
+			}
+			for key := range want {
+				if !got[key] {
+					t.Errorf("key %s not listed", key)
+				}
+			}
+
+			var walked int
+			stop := errors.New("stop")
+			err := s.Walk("", func(ObjectInfo) error {
+				walked++
+				if walked == 5 {
+					return stop
+				}
+				return nil
+			})
+			if !errors.Is(err, stop) || walked != 5 {
+				t.Errorf("expect the walk to stop after 5, got %d: %v", walked, err)
+			}
+		})
+	}
+}
+
+func TestDiskStore_ListWithoutMeta(t *testing.T) {
+	s, teardown := setupDiskTest(t)
+	defer teardown()
+
+	if _, err := s.Write("kept", bytes.NewReader([]byte("kept"))); err != nil {
+		t.Fatal(err)
+	}
+	// the sidecar of an object lost to a crash between the rename and writeMeta
+	if _, err := s.Write("crashed", bytes.NewReader([]byte("crashed"))); err != nil {
+		t.Fatal(err)
+	}
+	crashed, err := s.pathKey("crashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(s.Root, metaPath(crashed.GetFullPath()))); err != nil {
+		t.Fatal(err)
+	}
+	// an object written before the store kept metadata
+	if err := os.MkdirAll(filepath.Join(s.Root, "legacy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(s.Root, "legacy", "object"), []byte("legacy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := make(map[string]string)
+	if err := s.Walk("", func(info ObjectInfo) error {
+		paths[info.Path] = info.Key
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	kept, err := s.pathKey("kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		kept.GetFullPath():    "kept",
+		crashed.GetFullPath(): "",
+		"legacy/object":       "",
+	}
+	if len(paths) != len(want) {
+		t.Errorf("walk wrong: got %v, want %v", paths, want)
+	}
+	for path, key := range want {
+		if got, ok := paths[path]; !ok || got != key {
+			t.Errorf("object %s: got key %q (listed %v), want %q", path, got, ok, key)
+		}
+	}
+
+	// without a key an object can't match a prefix
+	page, _, err := s.List("k", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].Key != "kept" {
+		t.Errorf("list with prefix wrong: %v", page)
+	}
+}
+
 //func BenchmarkDiskStore_Write_Reader(b *testing.B) {
 //	s, treadDown := setupDiskTest(&testing.T{})
 //	defer treadDown()
@@ -129,3 +326,264 @@ func TestDiskWithCrypto(t *testing.T) {
 //
 //	}
 //}
+
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("reader failed")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestDiskStore_WriteAtomic(t *testing.T) {
+	disk, teardown := setupDiskTest(t)
+	defer teardown()
+
+	key := "atomic_key"
+	if _, err := disk.Write(key, &failingReader{data: []byte("partial")}); err == nil {
+		t.Fatal("expect the write to fail")
+	}
+	if disk.Has(key) {
+		t.Fatalf("expect no object %s after a failed write", key)
+	}
+
+	data := []byte("complete")
+	if _, err := disk.Write(key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed overwrite keeps the old object
+	if _, err := disk.Write(key, &failingReader{data: []byte("partial")}); err == nil {
+		t.Fatal("expect the write to fail")
+	}
+	_, r, err := disk.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	_ = r.Close()
+	if err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("expect %s, but got %s: %v", data, b, err)
+	}
+
+	removed, err := disk.Sweep()
+	if err != nil || removed != 0 {
+		t.Fatalf("expect no temp file left behind, removed %d: %v", removed, err)
+	}
+}
+
+func TestDiskStore_Sweep(t *testing.T) {
+	disk, teardown := setupDiskTest(t)
+	defer teardown()
+
+	key := "sweep_key"
+	if _, err := disk.Write(key, bytes.NewReader([]byte("kept"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// temp files of writes cut off by a crash, and one of a write going on
+	old := time.Now().Add(-2 * defaultSweepGrace)
+	var fresh string
+	for _, dir := range []string{disk.Root, fmt.Sprintf("%s/%s", disk.Root, FileTransform(key).FilePath)} {
+		for _, mtime := range []time.Time{old, time.Now()} {
+			f, err := os.CreateTemp(dir, tmpPattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = f.Close()
+			if err := os.Chtimes(f.Name(), mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+			fresh = f.Name()
+		}
+	}
+
+	disk = NewDiskStore(WithRoot(disk.Root), WithPathTransformFunc(FileTransform))
+	removed, err := disk.Sweep()
+	if err != nil || removed != 0 {
+		t.Fatalf("expect NewDiskStore to have swept, removed %d: %v", removed, err)
+	}
+	if !disk.Has(key) {
+		t.Fatalf("expect object %s to survive the sweep", key)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("expect the temp file of a write going on to survive the sweep: %v", err)
+	}
+
+	disk.SweepGrace = 0
+	removed, err = disk.Sweep()
+	if err != nil || removed != 2 {
+		t.Fatalf("expect a sweep without grace to remove 2 temp files, removed %d: %v", removed, err)
+	}
+}
+
+func TestDiskStore_InvalidKey(t *testing.T) {
+	disk, teardown := setupDiskTest(t)
+	defer teardown()
+
+	outside, err := os.MkdirTemp("", "storage_outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(outside)
+	}()
+
+	traversal := []string{
+		"", "../../etc/passwd", "..", "ab/../../x", outside + "/escaped",
+		"ab/./c", "ab//c", "ab/.tmp-123",
+	}
+
+	for transform, keys := range map[string][]string{
+		"FileTransform": append([]string{"a", "ab"}, traversal...),
+		"default":       append([]string{".meta/x"}, traversal...),
+	} {
+		disk.PathTransformFunc = defaultPathTransformFunc
+		if transform == "FileTransform" {
+			disk.PathTransformFunc = FileTransform
+		}
+
+		for _, key := range keys {
+			if _, err := disk.Write(key, bytes.NewReader([]byte("data"))); !errors.Is(err, errtype.ErrInvalidKey) {
+				t.Errorf("expect Write of %q to fail with ErrInvalidKey, but got %v", key, err)
+			}
+			if _, _, err := disk.Read(key); !errors.Is(err, errtype.ErrInvalidKey) {
+				t.Errorf("expect Read of %q to fail with ErrInvalidKey, but got %v", key, err)
+			}
+			if _, err := disk.Stat(key); !errors.Is(err, errtype.ErrInvalidKey) {
+				t.Errorf("expect Stat of %q to fail with ErrInvalidKey, but got %v", key, err)
+			}
+			if err := disk.Delete(key); !errors.Is(err, errtype.ErrInvalidKey) {
+				t.Errorf("expect Delete of %q to fail with ErrInvalidKey, but got %v", key, err)
+			}
+			if disk.Has(key) {
+				t.Errorf("expect Has of %q to be false", key)
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expect nothing written outside of the root, got %d entries: %v", len(entries), err)
+	}
+}
+
+func TestDiskStore_ReadSymlink(t *testing.T) {
+	disk, teardown := setupDiskTest(t)
+	defer teardown()
+
+	secret, err := os.CreateTemp("", "storage_secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = secret.Close()
+	defer func() {
+		_ = os.Remove(secret.Name())
+	}()
+
+	if err := os.MkdirAll(disk.Root+"/ab", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret.Name(), disk.Root+"/ab/link"); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	if _, r, err := disk.Read("ablink"); err == nil {
+		_ = r.Close()
+		t.Fatal("expect a symlink out of the root not to be read")
+	}
+}
+
+func TestDiskStore_WriteDeleteSymlink(t *testing.T) {
+	disk, teardown := setupDiskTest(t)
+	defer teardown()
+
+	outside := t.TempDir()
+	victim := filepath.Join(outside, "victim")
+	if err := os.WriteFile(victim, []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(disk.Root, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	// every key starting with "ab" lands in the directory the link leads to
+	if err := os.Symlink(outside, filepath.Join(disk.Root, "ab")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	if _, err := disk.Write("abescaped", bytes.NewReader([]byte("escaped"))); err == nil {
+		t.Error("expect a write through a symlink out of the root to fail")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "escaped")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expect nothing written out of the root, got %v", err)
+	}
+
+	if err := disk.Delete("abvictim"); err == nil {
+		t.Error("expect a delete through a symlink out of the root to fail")
+	}
+	if b, err := os.ReadFile(victim); err != nil || string(b) != "outside" {
+		t.Errorf("expect the file out of the root to stay, got %q: %v", b, err)
+	}
+
+	if disk.Has("abvictim") {
+		t.Error("expect a file out of the root not to be seen")
+	}
+	if _, err := disk.Stat("abvictim"); err == nil {
+		t.Error("expect a file out of the root not to be described")
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expect only the victim out of the root, got %d entries", len(entries))
+	}
+}
+
+func TestDiskStore_ReadRange(t *testing.T) {
+	disk, teardown := setupDiskTest(t)
+	defer teardown()
+
+	data := bytes.Repeat([]byte("range read data "), 64)
+	if _, err := disk.Write("plain_key", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	encKey := utils.NewEncryptionKey()
+	if _, err := disk.WriteEncrypt(encKey, "crypto_key", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range [][2]int64{{0, 10}, {7, 33}, {16, 16}, {1000, 24}, {1024, 0}} {
+		rc, err := disk.ReadRange("plain_key", r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil || !bytes.Equal(b, data[r[0]:r[0]+r[1]]) {
+			t.Errorf("range %v: got %q: %v", r, b, err)
+		}
+
+		out := new(bytes.Buffer)
+		n, err := disk.ReadDecryptRange(encKey, "crypto_key", r[0], r[1], out)
+		if err != nil || n != r[1] || !bytes.Equal(out.Bytes(), data[r[0]:r[0]+r[1]]) {
+			t.Errorf("decrypted range %v: got %q: %v", r, out.Bytes(), err)
+		}
+	}
+
+	for _, r := range [][2]int64{{-1, 1}, {0, -1}, {1025, 0}, {1000, 25}} {
+		if _, err := disk.ReadRange("plain_key", r[0], r[1]); !errors.Is(err, errtype.ErrRange) {
+			t.Errorf("expect range %v to fail with ErrRange, but got %v", r, err)
+		}
+		if _, err := disk.ReadDecryptRange(encKey, "crypto_key", r[0], r[1], io.Discard); !errors.Is(err, errtype.ErrRange) {
+			t.Errorf("expect decrypted range %v to fail with ErrRange, but got %v", r, err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"crypto/aes"
+	"fmt"
+	"io"
+
+	"github.com/peterouob/file_system/crypto"
+	errtype "github.com/peterouob/file_system/type"
+)
+
+// sectionReadCloser reads a section of a file and closes the file.
+type sectionReadCloser struct {
+	*io.SectionReader
+	io.Closer
+}
+
+// validRange reports ErrRange unless n bytes from off lie within size bytes.
+func validRange(off, n, size int64) error {
+	if off < 0 || n < 0 || off > size || n > size-off {
+		return fmt.Errorf("%w: %d bytes at %d of %d", errtype.ErrRange, n, off, size)
+	}
+	return nil
+}
+
+// ReadRange returns a reader of the n bytes at off of the object stored under
+// key, a range reaching past the object reports ErrRange.
+func (s *DiskStore) ReadRange(key string, off, n int64) (io.ReadCloser, error) {
+	f, err := s.openReadFile(key)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	if err := validRange(off, n, fi.Size()); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return sectionReadCloser{io.NewSectionReader(f, off, n), f}, nil
+}
+
+// ReadDecryptRange decrypts the n bytes at off of an object written with
+// WriteEncrypt into d, off and n count the plain bytes. Decryption starts at
+// off, the bytes before it aren't read.
+func (s *DiskStore) ReadDecryptRange(encKey []byte, key string, off, n int64, d io.Writer) (int64, error) {
+	f, err := s.openReadFile(key)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// the IV goes first
+	if err := validRange(off, n, max(fi.Size()-aes.BlockSize, 0)); err != nil {
+		return 0, err
+	}
+
+	return crypto.CopyDeCryptoRange(encKey, f, off, n, d)
+}
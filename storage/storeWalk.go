@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// errPageFull stops the walk of List once a page is full.
+var errPageFull = errors.New("page full")
+
+// Walk calls fn for every object whose key starts with prefix, in the order of
+// their paths under Root, objects without metadata come with an empty Key. An
+// error returned by fn stops the walk and is returned.
+func (s *DiskStore) Walk(prefix string, fn func(ObjectInfo) error) error {
+	return s.walk(prefix, "", func(info ObjectInfo, _ string) error {
+		return fn(info)
+	})
+}
+
+/*
+List returns up to limit objects whose key starts with prefix, in the order of
+their paths under Root, and the token the next page starts after. Pass the
+empty token for the first page, an empty token is returned with the last one.
+A token is the path of the last object of a page, objects written or deleted
+between two pages are seen or missed like in any paginated listing.
+*/
+func (s *DiskStore) List(prefix, token string, limit int) ([]ObjectInfo, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("list limit %d", limit)
+	}
+
+	var (
+		page []ObjectInfo
+		next string
+	)
+
+	err := s.walk(prefix, token, func(info ObjectInfo, rel string) error {
+		page = append(page, info)
+		if len(page) == limit {
+			next = rel
+			return errPageFull
+		}
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, errPageFull) {
+		return nil, "", err
+	}
+	return page, next, nil
+}
+
+/*
+walk walks the objects under Root past the one at the path after and calls fn
+with every object whose key starts with prefix and its path. The data files are
+walked, not the metadata next to them: an object written before the store kept
+metadata, or whose metadata a crash cut off, has no known key. It is still
+listed, with its Path and an empty Key, as long as prefix is empty.
+*/
+func (s *DiskStore) walk(prefix, after string, fn func(ObjectInfo, string) error) error {
+	root, err := s.openRoot(false)
+	if err != nil {
+		// nothing was written yet
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	afterParts := splitPath(after)
+
+	return fs.WalkDir(root.FS(), ".", func(rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// deleted meanwhile
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		parts := splitPath(rel)
+
+		if rel == metaDir {
+			return filepath.SkipDir
+		}
+		if ok, _ := filepath.Match(tmpPattern, d.Name()); ok {
+			// a write in progress or cut off by a crash
+			return nil
+		}
+
+		// WalkDir goes through the tree in the order of the path components,
+		// everything up to after was listed already
+		if d.IsDir() {
+			if after != "" && slices.Compare(parts, afterParts[:min(len(parts), len(afterParts))]) < 0 {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if after != "" && slices.Compare(parts, afterParts) <= 0 {
+			return nil
+		}
+
+		info := ObjectInfo{Path: rel}
+		if meta, err := readMeta(root, rel); err == nil {
+			info.Key, info.Checksum = meta.Key, meta.SHA256
+		}
+		if !strings.HasPrefix(info.Key, prefix) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			// deleted meanwhile
+			return nil
+		}
+		info.Size, info.ModTime = fi.Size(), fi.ModTime()
+
+		return fn(info, rel)
+	})
+}
+
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
@@ -0,0 +1,546 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/peterouob/file_system/utils"
+)
+
+// streamChunkSize is the pooled chunk the streaming APIs move payloads through.
+const streamChunkSize = largeSize
+
+/*
+WriteFrom appends a needle whose size bytes of payload are read from r, without
+holding the whole payload in memory. Cookie, Key, AlternateKey and Flag are taken
+from h, the rest of the v2 header is set by WriteFrom. Flag loses the bits
+telling how a payload is stored, the bits framing the log report ErrNeedleFlag. The payload is written
+through pooled chunks while the CRC is computed along the way.
+
+The range of the needle is reserved under the volume lock, the payload streams
+in without it, so a slow reader holds up nobody but Compact, Reload and Close,
+which wait for it. The needle turns visible once it is whole, a needle or
+tombstone of the same key appended meanwhile wins over it. If r fails or ends
+early the partly written needle is dropped again.
+The payload is stored as it is read, the volume Codec only applies to Write. A
+volume with Keys can't seal a payload it doesn't hold and rejects WriteFrom with
+ErrEncryption, a size above MaxNeedleSize reports ErrToLarge.
+*/
+func (v *Volume) WriteFrom(h NeedleHeader, r io.Reader, size uint32, attrs ...Attribute) error {
+	if v.opts.Keys != nil {
+		return fmt.Errorf("%w: encrypted volume can't stream needles in", errtype.ErrEncryption)
+	}
+
+	if err := validFlag(h.Flag); err != nil {
+		return err
+	}
+
+	if size > MaxNeedleSize {
+		return fmt.Errorf("%w: payload of %d bytes", errtype.ErrToLarge, size)
+	}
+
+	attrs = v.tagVersion(KeyPair{Key: h.Key, AltKey: h.AlternateKey}, callerAttributes(attrs))
+	if err := validAttributes(attrs); err != nil {
+		return err
+	}
+
+	h.MagicHeader = MagicHeaderV2
+	h.AppendAt = time.Now().UnixNano()
+	h.Flag &^= encodingFlags
+	h.AttrSize = uint16(attributesSize(attrs))
+	h.Size = size
+
+	p, err := v.writeFrom(h, attrs, r)
+	if err != nil {
+		return err
+	}
+
+	return v.commit(p)
+}
+
+func (v *Volume) writeFrom(h NeedleHeader, attrs []Attribute, r io.Reader) (commitPoint, error) {
+	chunk, err := v.bufferPool.Get(streamChunkSize)
+	if err != nil {
+		return commitPoint{}, err
+	}
+	defer v.bufferPool.Put(chunk)
+
+	buf := chunk.B[:cap(chunk.B)]
+	length := h.length()
+
+	// compaction, reload and Close wait for the reserved range to settle
+	v.streams.RLock()
+	defer v.streams.RUnlock()
+
+	f, offset, err := v.reserve(h, attrs, buf)
+	if err != nil {
+		return commitPoint{}, err
+	}
+
+	err = streamPayload(f, h, attrs, r, buf, offset)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	pending := v.inflight[offset]
+	delete(v.inflight, offset)
+
+	if err != nil {
+		return commitPoint{}, fmt.Errorf("write error: %w", errors.Join(err, v.abortReserved(offset, length, buf)))
+	}
+
+	if pending.superseded {
+		// a needle or tombstone of the key appended behind the range wins, as
+		// it does when the log is replayed
+		v.garbage += length
+		return v.point(v.writeOffset), nil
+	}
+
+	meta := h.meta(offset)
+	meta.ExpireAt = v.expireAt(h, attrs)
+	v.garbage += linkNeedle(v.index, v.content, v.versions, pending.key, h, meta, attrs)
+
+	return v.point(v.writeOffset), v.appendIndex(indexEntry{
+		Key:        pending.key,
+		NeedleMeta: meta,
+		Flag:       h.Flag,
+	})
+}
+
+// pendingStream is a range reserved by WriteFrom whose payload is streaming in.
+type pendingStream struct {
+	key        KeyPair
+	superseded bool // the key was written or deleted behind the range
+}
+
+/*
+reserve claims the range of the needle h at the end of the data file under v.mu
+and frames it with the header and a footer right away
+
+	+--------+-------+-----------------+--------+
+	| header | attrs | payload to come | footer |
+	+--------+-------+-----------------+--------+
+
+so a crash while the payload streams in leaves a needle replay skips for its
+checksum, not a hole that breaks the log for the needles behind it.
+*/
+func (v *Volume) reserve(h NeedleHeader, attrs []Attribute, buf []byte) (*os.File, int64, error) {
+	length := h.length()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.writable(length); err != nil {
+		return nil, 0, err
+	}
+
+	offset := v.writeOffset
+
+	header := appendAttributes(appendNeedleHeader(buf[:0], h), attrs)
+	_, err := v.dataFile.WriteAt(header, offset)
+	if err == nil {
+		// the checksum is only known once the payload is in
+		footerAt := offset + int64(len(header)) + int64(h.Size)
+		_, err = v.dataFile.WriteAt(appendFooter(buf[len(header):len(header)], 0, offset+length-footerAt), footerAt)
+	}
+	if err != nil {
+		if terr := v.dataFile.Truncate(offset); terr != nil {
+			err = errors.Join(err, terr)
+		}
+		return nil, 0, fmt.Errorf("write error: %w", err)
+	}
+
+	key := KeyPair{Key: h.Key, AltKey: h.AlternateKey}
+	if err := v.idx.append(reservedEntry(key, offset)); err != nil {
+		if terr := v.dataFile.Truncate(offset); terr != nil {
+			err = errors.Join(err, terr)
+		}
+		return nil, 0, fmt.Errorf("index append error: %w", err)
+	}
+
+	if v.inflight == nil {
+		v.inflight = make(map[int64]*pendingStream)
+	}
+	v.inflight[offset] = &pendingStream{key: key}
+	v.writeOffset += length
+
+	return v.dataFile, offset, nil
+}
+
+// reservedEntry is the index log entry of the range reserved at offset.
+func reservedEntry(key KeyPair, offset int64) indexEntry {
+	return indexEntry{Key: key, NeedleMeta: NeedleMeta{Offset: offset}, Flag: indexReserved}
+}
+
+// checkpoint checkpoints the index up to the first range still reserved and
+// logs the reserved ranges again, the needles streaming into them aren't in
+// the index yet. v.mu must be held.
+func (v *Volume) checkpoint() error {
+	covered := v.writeOffset
+	for offset := range v.inflight {
+		covered = min(covered, offset)
+	}
+
+	if err := v.idx.checkpoint(v.index, covered); err != nil {
+		return err
+	}
+
+	for offset, pending := range v.inflight {
+		if err := v.idx.append(reservedEntry(pending.key, offset)); err != nil {
+			return fmt.Errorf("index append error: %w", err)
+		}
+	}
+	return nil
+}
+
+// supersede marks the ranges reserved for key before offset as overwritten.
+// v.mu must be held.
+func (v *Volume) supersede(key KeyPair, offset int64) {
+	for at, pending := range v.inflight {
+		if pending.key == key && at < offset {
+			pending.superseded = true
+		}
+	}
+}
+
+// streamPayload writes the payload of the needle h read from r into the range
+// reserved at offset and seals it with the footer, without holding v.mu.
+func streamPayload(f *os.File, h NeedleHeader, attrs []Attribute, r io.Reader, buf []byte, offset int64) error {
+	header := appendAttributes(appendNeedleHeader(buf[:0], h), attrs)
+	crc := needleCRC(header)
+
+	pos := offset + int64(len(header))
+	for remain := int64(h.Size); remain > 0; {
+		n, err := io.ReadFull(r, buf[:min(remain, int64(len(buf)))])
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		crc = crc.Update(buf[:n])
+		if _, err := f.WriteAt(buf[:n], pos); err != nil {
+			return err
+		}
+
+		pos += int64(n)
+		remain -= int64(n)
+	}
+
+	_, err := f.WriteAt(appendFooter(buf[:0], crc.Value(), offset+h.length()-pos), pos)
+	return err
+}
+
+// appendFooter appends the footer with crc, padded with zeros to n bytes.
+func appendFooter(b []byte, crc uint32, n int64) []byte {
+	b = binary.BigEndian.AppendUint32(b, crc)
+	b = binary.BigEndian.AppendUint32(b, MagicFooter)
+	return append(b, make([]byte, n-NeedleFooterSize)...)
+}
+
+/*
+abortReserved gives up the range reserved at offset after its payload failed.
+At the end of the data file the range is cut off again, behind later needles it
+is overwritten with an empty commit marker of its length, which replay skips
+like the marker of a batch it never saw begin. v.mu must be held.
+*/
+func (v *Volume) abortReserved(offset, length int64, buf []byte) error {
+	if v.writeOffset == offset+length {
+		if err := v.dataFile.Truncate(offset); err != nil {
+			return err
+		}
+		v.writeOffset = offset
+		v.group.rewind(offset)
+		return nil
+	}
+
+	marker := batchMarker(CommitFlag, 0).Header
+	marker.Size = utils.Must(utils.CIU32(length - NeedleHeaderV2Size - NeedleFooterSize))
+
+	header := appendNeedleHeader(buf[:0], marker)
+	crc := needleCRC(header)
+	if _, err := v.dataFile.WriteAt(header, offset); err != nil {
+		return err
+	}
+
+	pos := offset + int64(len(header))
+	zero := buf[:cap(buf)]
+	clear(zero)
+	for remain := int64(marker.Size); remain > 0; {
+		n := min(remain, int64(len(zero)))
+		crc = crc.Update(zero[:n])
+		if _, err := v.dataFile.WriteAt(zero[:n], pos); err != nil {
+			return err
+		}
+		pos += n
+		remain -= n
+	}
+
+	if _, err := v.dataFile.WriteAt(appendFooter(buf[:0], crc.Value(), NeedleFooterSize), pos); err != nil {
+		return err
+	}
+
+	v.garbage += length
+	return nil
+}
+
+/*
+ReadTo streams the payload of a needle into w through pooled chunks and returns
+the bytes written. The CRC is verified incrementally, since the payload goes
+out before the footer is reached a mismatch is only reported by the returned
+ErrCrcNotValid after w has seen the data.
+*/
+func (v *Volume) ReadTo(key KeyPair, cookie uint64, w io.Writer) (int64, error) {
+	v.mu.RLock()
+	meta, ok := v.index[key]
+	dataFile, release := v.holdData()
+	v.mu.RUnlock()
+	defer release()
+
+	if !ok {
+		return 0, fmt.Errorf("read not found the data from key:,%w: %v", errtype.ErrNotFound, key)
+	}
+
+	if meta.expired(time.Now().UnixNano()) {
+		return 0, fmt.Errorf("%w: %v", errtype.ErrExpired, key)
+	}
+
+	n, written, err := v.readTo(dataFile, meta, cookie, w)
+	if err != nil || n.Header.Flag&RefFlag == 0 {
+		return written, err
+	}
+
+	b, f, releaseBlob, err := v.resolve(n)
+	if err != nil {
+		return 0, err
+	}
+	defer releaseBlob()
+
+	_, written, err = v.readTo(f, b.meta, b.cookie, w)
+	return written, err
+}
+
+/*
+ReadRange returns the n bytes at off of the payload of the needle stored under
+key, a range reaching past the payload reports ErrRange. Only the range of a
+plain needle is read, its CRC isn't verified, Scrub catches bit rot there. An
+encrypted or compressed needle is restored whole and cut to the range.
+*/
+func (v *Volume) ReadRange(key KeyPair, cookie uint64, off, n int64) ([]byte, error) {
+	v.mu.RLock()
+	meta, ok := v.index[key]
+	dataFile, release := v.holdData()
+	v.mu.RUnlock()
+	defer release()
+
+	if !ok {
+		return nil, fmt.Errorf("read not found the data from key:,%w: %v", errtype.ErrNotFound, key)
+	}
+
+	if meta.expired(time.Now().UnixNano()) {
+		return nil, fmt.Errorf("%w: %v", errtype.ErrExpired, key)
+	}
+
+	needle, data, err := v.readRange(dataFile, meta, cookie, off, n)
+	if err != nil || needle.Header.Flag&RefFlag == 0 {
+		return data, err
+	}
+
+	b, f, releaseBlob, err := v.resolve(needle)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseBlob()
+
+	_, data, err = v.readRange(f, b.meta, b.cookie, off, n)
+	return data, err
+}
+
+// readRange reads the n bytes at off of the payload of the needle at meta. A
+// reference needle comes back without data, the range is read from its content.
+func (v *Volume) readRange(f *os.File, meta NeedleMeta, cookie uint64, off, n int64) (*Needle, []byte, error) {
+	hs := headerSize(meta.Version)
+	head := make([]byte, hs+int64(meta.AttrSize))
+	if _, err := f.ReadAt(head, meta.Offset); err != nil {
+		return nil, nil, fmt.Errorf("read error: %v", err)
+	}
+
+	if err := ValidNeedleBlock(head, cookie); err != nil {
+		return nil, nil, err
+	}
+
+	attrs, err := parseAttributes(head[hs:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	needle := &Needle{
+		Header: decodeNeedleHeader(head),
+		Attrs:  attrs,
+	}
+
+	switch {
+	case needle.Header.Flag&RefFlag != 0:
+		return needle, nil, nil
+	case needle.Header.Flag&(EncryptFlag|CompressFlag) != 0:
+		// the stored bytes don't line up with the payload
+		whole, err := v.readNeedle(f, meta, cookie)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := validRange(off, n, int64(len(whole.Data))); err != nil {
+			return nil, nil, err
+		}
+		return needle, whole.Data[off : off+n], nil
+	}
+
+	if err := validRange(off, n, int64(meta.Size)); err != nil {
+		return nil, nil, err
+	}
+
+	data := make([]byte, n)
+	if _, err := f.ReadAt(data, meta.Offset+int64(len(head))+off); err != nil {
+		return nil, nil, fmt.Errorf("read error: %v", err)
+	}
+	return needle, data, nil
+}
+
+// readTo streams the payload of the needle at meta into w and returns the
+// needle without its Data.
+func (v *Volume) readTo(f *os.File, meta NeedleMeta, cookie uint64, w io.Writer) (*Needle, int64, error) {
+	chunk, err := v.bufferPool.Get(streamChunkSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer v.bufferPool.Put(chunk)
+
+	return readNeedleTo(f, meta, cookie, v.opts.Keys, w, chunk.B[:cap(chunk.B)])
+}
+
+// readNeedleTo reads the header and attributes of the needle at meta into buf
+// in one go, buf has to hold a v2 header and MaxAttrSize bytes of attributes.
+// An encrypted needle is only opened as a whole, its payload is read into memory.
+func readNeedleTo(f *os.File, meta NeedleMeta, cookie uint64, keys KeyProvider, w io.Writer, buf []byte) (*Needle, int64, error) {
+	hs := headerSize(meta.Version)
+	head := buf[:hs+int64(meta.AttrSize)]
+	if _, err := f.ReadAt(head, meta.Offset); err != nil {
+		return nil, 0, fmt.Errorf("read error: %v", err)
+	}
+
+	if err := ValidNeedleBlock(head, cookie); err != nil {
+		return nil, 0, err
+	}
+
+	crc := needleCRC(head)
+
+	attrs, err := parseAttributes(bytes.Clone(head[hs:]))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	needle := &Needle{
+		Header: decodeNeedleHeader(head),
+		Attrs:  attrs,
+	}
+
+	var (
+		written int64
+		derr    error
+	)
+
+	pos := meta.Offset + int64(len(head))
+
+	if needle.Header.Flag&EncryptFlag != 0 {
+		cr := &crcReader{r: io.NewSectionReader(f, pos, int64(meta.Size)), crc: crc}
+		sealed := bytes.NewBuffer(make([]byte, 0, meta.Size))
+		if _, err := sealed.ReadFrom(cr); err != nil {
+			return nil, 0, fmt.Errorf("read error: %v", err)
+		}
+		crc = cr.crc
+		pos += int64(meta.Size)
+
+		// nothing goes out before the seal is checked
+		needle.Data = sealed.Bytes()
+		if derr = openNeedle(keys, needle); derr == nil {
+			written, derr = writePayload(needle, w)
+		}
+		needle.Data = nil
+	} else if needle.Header.Flag&CompressFlag != 0 {
+		// the CRC covers the compressed bytes, they are summed up while the
+		// codec reads them
+		cr := &crcReader{r: io.NewSectionReader(f, pos, int64(meta.Size)), crc: crc}
+		written, derr = decompressTo(attrs, cr, w)
+		if _, err := io.Copy(io.Discard, cr); err != nil {
+			return nil, written, fmt.Errorf("read error: %v", err)
+		}
+		crc = cr.crc
+		pos += int64(meta.Size)
+	} else {
+		for remain := int64(meta.Size); remain > 0; {
+			n := min(remain, int64(len(buf)))
+			if _, err := f.ReadAt(buf[:n], pos); err != nil {
+				return nil, written, fmt.Errorf("read error: %v", err)
+			}
+
+			crc = crc.Update(buf[:n])
+			nw, err := w.Write(buf[:n])
+			written += int64(nw)
+			if err != nil {
+				return nil, written, err
+			}
+
+			pos += n
+			remain -= n
+		}
+	}
+
+	footer := buf[:NeedleFooterSize]
+	if _, err := f.ReadAt(footer, pos); err != nil {
+		return nil, written, fmt.Errorf("read error: %v", err)
+	}
+
+	needle.Footer = NeedleFooter{
+		Checksum:    binary.BigEndian.Uint32(footer[0:4]),
+		MagicFooter: binary.BigEndian.Uint32(footer[4:8]),
+	}
+
+	if needle.Footer.Checksum != crc.Value() {
+		return nil, written, errtype.ErrCrcNotValid
+	}
+
+	if derr != nil {
+		return nil, written, derr
+	}
+
+	return needle, written, nil
+}
+
+// writePayload writes the payload of a needle held in memory to w, decompressing
+// it on the way when needed.
+func writePayload(n *Needle, w io.Writer) (int64, error) {
+	if n.Header.Flag&CompressFlag != 0 {
+		return decompressTo(n.Attrs, bytes.NewReader(n.Data), w)
+	}
+
+	written, err := w.Write(n.Data)
+	return int64(written), err
+}
+
+// crcReader sums up the checksum of everything read through it.
+type crcReader struct {
+	r   io.Reader
+	crc CRC
+}
+
+func (r *crcReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.crc = r.crc.Update(p[:n])
+	return n, err
+}
@@ -0,0 +1,385 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/peterouob/file_system/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newPayload(size int) []byte {
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	return payload
+}
+
+func TestVolume_Stream(t *testing.T) {
+	t.Run("Success_WriteFromReadTo", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		payload := newPayload(3*streamChunkSize + 123)
+		key := KeyPair{Key: 7, AltKey: 1}
+
+		err := v.WriteFrom(NeedleHeader{Key: 7, AlternateKey: 1, Cookie: 99}, bytes.NewReader(payload), uint32(len(payload)))
+		require.NoError(t, err)
+		assert.Equal(t, SuperBlockSize+needleLength(NeedleVersion2, 0, uint32(len(payload))), v.writeOffset)
+
+		out := new(bytes.Buffer)
+		n, err := v.ReadTo(key, 99, out)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(payload)), n)
+		assert.Equal(t, payload, out.Bytes())
+
+		got, err := v.Read(key, 99)
+		require.NoError(t, err)
+		assert.Equal(t, payload, got)
+
+		reloaded, err := NewVolume(f)
+		require.NoError(t, err)
+		got, err = reloaded.Read(key, 99)
+		require.NoError(t, err)
+		assert.Equal(t, payload, got)
+	})
+
+	t.Run("Success_BeyondBufferPool", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+
+		n := newRandomNeedle(1, xlargeSize+1)
+		require.NoError(t, v.Write(n))
+
+		got, err := v.Read(KeyPair{Key: 1}, 0)
+		require.NoError(t, err)
+		assert.Equal(t, n.Data, got)
+	})
+
+	t.Run("Error_ShortReader", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		require.NoError(t, v.Write(newRandomNeedle(1, 100)))
+		before := v.writeOffset
+
+		err := v.WriteFrom(NeedleHeader{Key: 2}, bytes.NewReader(newPayload(10)), 4096)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		assert.Equal(t, before, v.writeOffset)
+		assert.NotContains(t, v.index, KeyPair{Key: 2})
+
+		fi, err := f.Stat()
+		require.NoError(t, err)
+		assert.Equal(t, before, fi.Size())
+
+		require.NoError(t, v.Write(newRandomNeedle(3, 10)))
+		reloaded, err := NewVolume(f)
+		require.NoError(t, err)
+		assert.Len(t, reloaded.index, 2)
+	})
+
+	t.Run("Error_ReadToCRC", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		payload := newPayload(streamChunkSize + 10)
+		require.NoError(t, v.WriteFrom(NeedleHeader{Key: 1}, bytes.NewReader(payload), uint32(len(payload))))
+
+		_, err := f.WriteAt([]byte{0xff}, v.index[KeyPair{Key: 1}].Offset+NeedleHeaderSize+streamChunkSize+1)
+		require.NoError(t, err)
+
+		_, err = v.ReadTo(KeyPair{Key: 1}, 0, io.Discard)
+		assert.ErrorIs(t, err, errtype.ErrCrcNotValid)
+	})
+
+	t.Run("Error_ReadToCookie", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+		require.NoError(t, v.WriteFrom(NeedleHeader{Key: 1, Cookie: 5}, bytes.NewReader(newPayload(10)), 10))
+
+		_, err := v.ReadTo(KeyPair{Key: 1}, 6, io.Discard)
+		assert.ErrorIs(t, err, errtype.ErrCookie)
+
+		_, err = v.ReadTo(KeyPair{Key: 2}, 5, io.Discard)
+		assert.ErrorIs(t, err, errtype.ErrNotFound)
+	})
+
+	t.Run("Error_TooLarge", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+		require.NoError(t, v.Write(newRandomNeedle(1, 100)))
+		before := v.writeOffset
+
+		for _, size := range []uint32{MaxNeedleSize + 1, math.MaxUint32} {
+			err := v.WriteFrom(NeedleHeader{Key: 2}, bytes.NewReader(nil), size)
+			assert.ErrorIs(t, err, errtype.ErrToLarge)
+		}
+		assert.Equal(t, before, v.writeOffset)
+		assert.NotContains(t, v.index, KeyPair{Key: 2})
+
+		// an index entry claiming a needle near 4 GiB is streamed, not pooled
+		meta := v.index[KeyPair{Key: 1}]
+		meta.Size = math.MaxUint32
+		_, err := v.readNeedle(v.dataFile, meta, 0)
+		assert.Error(t, err)
+	})
+}
+
+func TestVolume_WriteFromUnlocked(t *testing.T) {
+	// startStream starts a WriteFrom of size bytes of key from a pipe and
+	// returns once its range is reserved
+	startStream := func(t *testing.T, v *Volume, key uint64, size uint32) (*io.PipeWriter, <-chan error) {
+		t.Helper()
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			done <- v.WriteFrom(NeedleHeader{Key: key}, pr, size)
+		}()
+
+		require.Eventually(t, func() bool {
+			v.mu.RLock()
+			defer v.mu.RUnlock()
+			return len(v.inflight) == 1
+		}, 5*time.Second, time.Millisecond)
+		return pw, done
+	}
+
+	within := func(t *testing.T, fn func()) {
+		t.Helper()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			fn()
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("blocked by the stream")
+		}
+	}
+
+	t.Run("Success_StalledReader", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		require.NoError(t, v.Write(newNeedle(1, "before")))
+
+		payload := newPayload(3*streamChunkSize + 5)
+		pw, done := startStream(t, v, 2, uint32(len(payload)))
+		_, err := pw.Write(payload[:100])
+		require.NoError(t, err)
+
+		// the stream hangs mid payload, reads and writes go on
+		within(t, func() {
+			assert.NoError(t, v.Write(newNeedle(3, "during")))
+			got, err := v.Read(KeyPair{Key: 1}, 10)
+			assert.NoError(t, err)
+			assert.Equal(t, "before", string(got))
+			_, err = v.Read(KeyPair{Key: 2}, 0)
+			assert.ErrorIs(t, err, errtype.ErrNotFound)
+		})
+
+		_, err = pw.Write(payload[100:])
+		require.NoError(t, err)
+		require.NoError(t, <-done)
+
+		got, err := v.Read(KeyPair{Key: 2}, 0)
+		require.NoError(t, err)
+		assert.Equal(t, payload, got)
+
+		require.NoError(t, v.Reload())
+		for _, want := range []struct {
+			key    uint64
+			cookie uint64
+			data   []byte
+		}{{1, 10, []byte("before")}, {2, 0, payload}, {3, 30, []byte("during")}} {
+			got, err := v.Read(KeyPair{Key: want.key}, want.cookie)
+			require.NoError(t, err)
+			assert.Equal(t, want.data, got)
+		}
+
+		reloaded, err := NewVolume(f)
+		require.NoError(t, err)
+		assert.Len(t, reloaded.index, 3)
+	})
+
+	t.Run("Success_SupersededByWrite", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+
+		pw, done := startStream(t, v, 1, 100)
+		within(t, func() {
+			assert.NoError(t, v.Write(newNeedle(1, "later")))
+		})
+
+		_, err := pw.Write(newPayload(100))
+		require.NoError(t, err)
+		require.NoError(t, <-done)
+
+		// the needle appended behind the stream wins, live and on replay
+		got, err := v.Read(KeyPair{Key: 1}, 10)
+		require.NoError(t, err)
+		assert.Equal(t, "later", string(got))
+
+		require.NoError(t, v.Reload())
+		got, err = v.Read(KeyPair{Key: 1}, 10)
+		require.NoError(t, err)
+		assert.Equal(t, "later", string(got))
+	})
+
+	t.Run("Error_AbortedBehindWrite", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		pw, done := startStream(t, v, 1, 4096)
+		within(t, func() {
+			assert.NoError(t, v.Write(newNeedle(2, "behind")))
+		})
+
+		errClient := errors.New("client went away")
+		pw.CloseWithError(errClient)
+		assert.ErrorIs(t, <-done, errClient)
+
+		// the range can't be cut off, it is skipped on replay
+		end := v.writeOffset
+		require.NoError(t, v.Reload())
+		assert.Equal(t, end, v.writeOffset)
+
+		got, err := v.Read(KeyPair{Key: 2}, 20)
+		require.NoError(t, err)
+		assert.Equal(t, "behind", string(got))
+		_, err = v.Read(KeyPair{Key: 1}, 0)
+		assert.ErrorIs(t, err, errtype.ErrNotFound)
+
+		report, err := CheckVolume(f, end, func(CheckedNeedle) {})
+		require.NoError(t, err)
+		assert.Zero(t, report.Corrupt)
+	})
+
+	t.Run("Success_CrashAfterLaterWrites", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		pw, done := startStream(t, v, 1000, 100)
+		within(t, func() {
+			for key := uint64(1); key <= 200; key++ {
+				assert.NoError(t, v.Write(newNeedle(key, "behind")))
+			}
+		})
+
+		// the entries of the writes behind the stream reach the index file, the
+		// entry of the streamed needle is still buffered when the process dies
+		v.mu.Lock()
+		require.NoError(t, v.idx.flush())
+		v.mu.Unlock()
+
+		_, err := pw.Write(newPayload(100))
+		require.NoError(t, err)
+		require.NoError(t, <-done)
+
+		reopened, err := NewVolume(f)
+		require.NoError(t, err)
+		got, err := reopened.Read(KeyPair{Key: 1000}, 0)
+		require.NoError(t, err)
+		assert.Equal(t, newPayload(100), got)
+		assert.Len(t, reopened.index, 201)
+
+		// a checkpoint taken while the stream is in flight covers the log up to it
+		pw, done = startStream(t, v, 2000, 100)
+		within(t, func() {
+			assert.NoError(t, v.Write(newNeedle(201, "behind")))
+			v.mu.Lock()
+			assert.NoError(t, v.checkpoint())
+			v.mu.Unlock()
+			assert.NoError(t, v.Write(newNeedle(202, "behind")))
+		})
+		v.mu.Lock()
+		require.NoError(t, v.idx.flush())
+		v.mu.Unlock()
+		_, err = pw.Write(newPayload(100))
+		require.NoError(t, err)
+		require.NoError(t, <-done)
+
+		reopened, err = NewVolume(f)
+		require.NoError(t, err)
+		got, err = reopened.Read(KeyPair{Key: 2000}, 0)
+		require.NoError(t, err)
+		assert.Equal(t, newPayload(100), got)
+	})
+
+	t.Run("Success_CompactWaits", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+
+		pw, done := startStream(t, v, 1, 100)
+		compacted := make(chan error, 1)
+		go func() {
+			_, err := v.Compact()
+			compacted <- err
+		}()
+
+		_, err := pw.Write(newPayload(100))
+		require.NoError(t, err)
+		require.NoError(t, <-done)
+		require.NoError(t, <-compacted)
+
+		got, err := v.Read(KeyPair{Key: 1}, 0)
+		require.NoError(t, err)
+		assert.Equal(t, newPayload(100), got)
+	})
+}
+
+func TestVolume_ReadOwnsData(t *testing.T) {
+	v, _ := setupTestVolume(t)
+	require.NoError(t, v.Write(newRandomNeedle(1, 100)))
+	require.NoError(t, v.Write(newRandomNeedle(2, 100)))
+
+	first, err := v.Read(KeyPair{Key: 1}, 0)
+	require.NoError(t, err)
+	want := bytes.Clone(first)
+
+	for range 10 {
+		_, err := v.Read(KeyPair{Key: 2}, 0)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, want, first)
+}
+
+func TestVolume_ReadRange(t *testing.T) {
+	payload := newPayload(5000)
+
+	for name, options := range map[string][]VolumeOption{
+		"Plain":      nil,
+		"Compressed": {WithCompression(FlateCodec)},
+		"Encrypted":  {WithEncryption(StaticKey(utils.NewEncryptionKey()))},
+		"Dedup":      {WithDedup()},
+	} {
+		t.Run("Success_"+name, func(t *testing.T) {
+			f := setup(t)
+			defer teardown(f, t)
+
+			v, err := NewVolume(f, options...)
+			require.NoError(t, err)
+			require.NoError(t, v.Write(newNeedle(1, string(payload))))
+			require.NoError(t, v.Write(newNeedle(2, string(payload))))
+
+			for _, r := range [][2]int64{{0, 10}, {123, 1000}, {4990, 10}, {5000, 0}} {
+				for key := uint64(1); key <= 2; key++ {
+					got, err := v.ReadRange(KeyPair{Key: key}, key*10, r[0], r[1])
+					require.NoError(t, err, "range %v", r)
+					assert.Equal(t, payload[r[0]:r[0]+r[1]], got, "range %v", r)
+				}
+			}
+		})
+	}
+
+	t.Run("Error_OutOfRange", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+		require.NoError(t, v.Write(newNeedle(1, "short")))
+
+		for _, r := range [][2]int64{{-1, 2}, {0, -1}, {6, 0}, {3, 3}} {
+			_, err := v.ReadRange(KeyPair{Key: 1}, 10, r[0], r[1])
+			assert.ErrorIs(t, err, errtype.ErrRange, "range %v", r)
+		}
+
+		_, err := v.ReadRange(KeyPair{Key: 1}, 11, 0, 1)
+		assert.ErrorIs(t, err, errtype.ErrCookie)
+		_, err = v.ReadRange(KeyPair{Key: 2}, 20, 0, 1)
+		assert.ErrorIs(t, err, errtype.ErrNotFound)
+	})
+}
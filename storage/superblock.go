@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	errtype "github.com/peterouob/file_system/type"
+)
+
+/*
+SuperBlock is stored at offset 0 of every volume data file, the needles follow it
++-------+---------+-----------+----------+----------+-----------+---------+--------+-----+----------+-----------+----------+-----+
+| Magic | Version | Alignment | Features | VolumeID | CreatedAt | MaxSize | Sealed | TTL | Versions | RetainFor | Reserved | CRC |
+| 4     | 2       | 2         | 4        | 4        | 8         | 8       | 1      | 8   | 4        | 8         | 7        | 4   |
++-------+---------+-----------+----------+----------+-----------+---------+--------+-----+----------+-----------+----------+-----+
+
+Versions and RetainFor are the Retention of a volume with FeatureVersions.
+
+Version is the needle format of the volume, a volume written by a newer format
+or with Features this build doesn't know is refused instead of misread. The
+reserved bytes are zero, new settings take them over without a version bump.
+*/
+type SuperBlock struct {
+	CreatedAt int64         // unix nano
+	MaxSize   int64         // bytes the data file may grow to, 0 for no limit
+	TTL       time.Duration // every needle expires once it is older, 0 for none
+	Retention Retention     // older versions kept on a volume with FeatureVersions
+	Magic     uint32
+	Features  uint32
+	VolumeID  uint32
+	Version   uint16
+	Alignment uint16
+	Sealed    bool // the volume is full or was sealed, no needle is appended any more
+}
+
+const (
+	SuperBlockMagic   = 0x48535442
+	SuperBlockSize    = 64
+	SuperBlockVersion = 1
+
+	needleAlignment = 8
+
+	// FeatureDedup marks a volume whose needles share payloads through
+	// reference needles, see contentIndex.
+	FeatureDedup uint32 = 1 << 0
+	// FeatureVersions marks a volume that keeps older versions of its keys,
+	// see versionIndex.
+	FeatureVersions uint32 = 1 << 1
+
+	// knownFeatures holds every feature bit this build can read.
+	knownFeatures = FeatureDedup | FeatureVersions
+)
+
+func newSuperBlock(opts VolumeOpts) SuperBlock {
+	sb := SuperBlock{
+		Magic:     SuperBlockMagic,
+		Version:   SuperBlockVersion,
+		Alignment: needleAlignment,
+		VolumeID:  opts.VolumeID,
+		CreatedAt: time.Now().UnixNano(),
+		MaxSize:   opts.MaxSize,
+		TTL:       opts.TTL,
+	}
+
+	if opts.Dedup {
+		sb.Features |= FeatureDedup
+	}
+
+	if opts.Versioning {
+		sb.Features |= FeatureVersions
+		sb.Retention = opts.Retention
+	}
+
+	return sb
+}
+
+func (sb SuperBlock) Bytes() []byte {
+	b := make([]byte, 0, SuperBlockSize)
+	b = binary.BigEndian.AppendUint32(b, sb.Magic)
+	b = binary.BigEndian.AppendUint16(b, sb.Version)
+	b = binary.BigEndian.AppendUint16(b, sb.Alignment)
+	b = binary.BigEndian.AppendUint32(b, sb.Features)
+	b = binary.BigEndian.AppendUint32(b, sb.VolumeID)
+	b = binary.BigEndian.AppendUint64(b, uint64(sb.CreatedAt))
+	b = binary.BigEndian.AppendUint64(b, uint64(sb.MaxSize))
+	if sb.Sealed {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(sb.TTL))
+	b = binary.BigEndian.AppendUint32(b, sb.Retention.Versions)
+	b = binary.BigEndian.AppendUint64(b, uint64(sb.Retention.For))
+	b = b[:SuperBlockSize-4]
+	return binary.BigEndian.AppendUint32(b, NewCRC(b).Value())
+}
+
+// ParseSuperBlock decodes and validates a superblock read from the start of a volume.
+func ParseSuperBlock(b []byte) (SuperBlock, error) {
+	if len(b) < SuperBlockSize {
+		return SuperBlock{}, errtype.ErrBufferTooSmall
+	}
+
+	if binary.BigEndian.Uint32(b[0:4]) != SuperBlockMagic {
+		return SuperBlock{}, errtype.ErrSuperBlock
+	}
+
+	if NewCRC(b[:SuperBlockSize-4]).Value() != binary.BigEndian.Uint32(b[SuperBlockSize-4:SuperBlockSize]) {
+		return SuperBlock{}, fmt.Errorf("%w: crc not valid", errtype.ErrSuperBlock)
+	}
+
+	sb := SuperBlock{
+		Magic:     binary.BigEndian.Uint32(b[0:4]),
+		Version:   binary.BigEndian.Uint16(b[4:6]),
+		Alignment: binary.BigEndian.Uint16(b[6:8]),
+		Features:  binary.BigEndian.Uint32(b[8:12]),
+		VolumeID:  binary.BigEndian.Uint32(b[12:16]),
+		CreatedAt: int64(binary.BigEndian.Uint64(b[16:24])),
+		MaxSize:   int64(binary.BigEndian.Uint64(b[24:32])),
+		Sealed:    b[32] == 1,
+		TTL:       time.Duration(binary.BigEndian.Uint64(b[33:41])),
+		Retention: Retention{
+			Versions: binary.BigEndian.Uint32(b[41:45]),
+			For:      time.Duration(binary.BigEndian.Uint64(b[45:53])),
+		},
+	}
+
+	if sb.Version > SuperBlockVersion || sb.Features&^knownFeatures != 0 {
+		return SuperBlock{}, fmt.Errorf("%w: version %d features %#x", errtype.ErrVolumeVersion, sb.Version, sb.Features)
+	}
+
+	if sb.Alignment != needleAlignment {
+		return SuperBlock{}, fmt.Errorf("%w: needle alignment %d", errtype.ErrVolumeVersion, sb.Alignment)
+	}
+
+	return sb, nil
+}
+
+// SuperBlock returns the superblock the volume was opened with.
+func (v *Volume) SuperBlock() SuperBlock {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	return v.super
+}
+
+// initSuperBlock writes the superblock of a new data file, or reads and checks
+// the superblock of an existing one. A data file from before superblocks, which
+// starts right with a needle, is migrated first.
+func (v *Volume) initSuperBlock() error {
+	fi, err := v.dataFile.Stat()
+	if err != nil {
+		return fmt.Errorf("superblock error: %w", err)
+	}
+
+	var buf [SuperBlockSize]byte
+	head := buf[:min(fi.Size(), SuperBlockSize)]
+	if _, err := v.dataFile.ReadAt(head, 0); err != nil {
+		return fmt.Errorf("superblock error: %w", err)
+	}
+
+	// a legacy file starts right with a needle, one small needle is shorter
+	// than a superblock
+	if len(head) >= 4 && binary.BigEndian.Uint32(head[0:4]) == MagicHeader {
+		if v.opts.ReadOnly {
+			return fmt.Errorf("%w: volume without superblock must be opened writable to migrate", errtype.ErrVolumeVersion)
+		}
+		return v.migrateLegacy()
+	}
+
+	// any other file shorter than a superblock was cut off while being
+	// created and can't hold any needle yet
+	if fi.Size() < SuperBlockSize {
+		if v.opts.ReadOnly {
+			return fmt.Errorf("%w: missing in read only volume", errtype.ErrSuperBlock)
+		}
+		v.super = newSuperBlock(v.opts)
+		if err := v.dataFile.Truncate(0); err != nil {
+			return fmt.Errorf("superblock error: %w", err)
+		}
+		return v.writeSuperBlock()
+	}
+
+	sb, err := ParseSuperBlock(buf[:])
+	if err != nil {
+		return err
+	}
+
+	v.super = sb
+	return nil
+}
+
+// writeSuperBlock persists v.super at the start of the data file.
+func (v *Volume) writeSuperBlock() error {
+	if _, err := v.dataFile.WriteAt(v.super.Bytes(), 0); err != nil {
+		return fmt.Errorf("superblock error: %w", err)
+	}
+	return v.dataFile.Sync()
+}
+
+/*
+migrateLegacy moves a data file written before superblocks existed behind a
+fresh superblock. The needle log is copied as is into a temporary file which is
+renamed over the old one, so a crash leaves either format behind intact. The
+index file points at the old offsets and is rebuilt by the full reload that
+follows.
+*/
+func (v *Volume) migrateLegacy() error {
+	fi, err := v.dataFile.Stat()
+	if err != nil {
+		return fmt.Errorf("migrate error: %w", err)
+	}
+
+	tmpPath := strings.TrimSuffix(v.path, filepath.Ext(v.path)) + ".mig"
+	dst, err := os.OpenFile(filepath.Clean(tmpPath), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("migrate error: %w", err)
+	}
+
+	abort := func(err error) error {
+		_ = dst.Close()
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("migrate error: %w", err)
+	}
+
+	chunk, err := v.bufferPool.Get(largeSize)
+	if err != nil {
+		return abort(err)
+	}
+	defer v.bufferPool.Put(chunk)
+
+	sb := newSuperBlock(v.opts)
+
+	if _, err := dst.Write(sb.Bytes()); err != nil {
+		return abort(err)
+	}
+
+	if _, err := copyRange(dst, v.dataFile, 0, fi.Size(), chunk.B[:cap(chunk.B)]); err != nil {
+		return abort(err)
+	}
+
+	if err := dst.Sync(); err != nil {
+		return abort(err)
+	}
+
+	if err := os.Rename(tmpPath, v.path); err != nil {
+		return abort(err)
+	}
+
+	if err := syncDir(filepath.Dir(v.path)); err != nil {
+		return fmt.Errorf("migrate error: %w", err)
+	}
+
+	v.retireData()
+	v.dataFile = dst
+	v.ownsData = true
+	v.super = sb
+	v.migrated = true
+	return nil
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuperBlock_Bytes(t *testing.T) {
+	sb := newSuperBlock(VolumeOpts{VolumeID: 7, MaxSize: 1 << 30})
+	sb.Sealed = true
+	b := sb.Bytes()
+	assert.Len(t, b, SuperBlockSize)
+
+	got, err := ParseSuperBlock(b)
+	require.NoError(t, err)
+	assert.Equal(t, sb, got)
+
+	t.Run("Error_Magic", func(t *testing.T) {
+		bad := sb.Bytes()
+		bad[0] = 0
+		_, err := ParseSuperBlock(bad)
+		assert.ErrorIs(t, err, errtype.ErrSuperBlock)
+	})
+
+	t.Run("Error_CRC", func(t *testing.T) {
+		bad := sb.Bytes()
+		bad[20] ^= 0xff
+		_, err := ParseSuperBlock(bad)
+		assert.ErrorIs(t, err, errtype.ErrSuperBlock)
+	})
+
+	t.Run("Error_NewerVersion", func(t *testing.T) {
+		newer := sb
+		newer.Version = SuperBlockVersion + 1
+		_, err := ParseSuperBlock(newer.Bytes())
+		assert.ErrorIs(t, err, errtype.ErrVolumeVersion)
+	})
+
+	t.Run("Error_UnknownFeature", func(t *testing.T) {
+		newer := sb
+		newer.Features = 1 << 31
+		_, err := ParseSuperBlock(newer.Bytes())
+		assert.ErrorIs(t, err, errtype.ErrVolumeVersion)
+	})
+}
+
+func TestVolume_SuperBlock(t *testing.T) {
+	t.Run("Success_WriteAndValidate", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithVolumeID(42))
+		require.NoError(t, err)
+
+		sb := v.SuperBlock()
+		assert.Equal(t, uint32(42), sb.VolumeID)
+		assert.Equal(t, uint16(SuperBlockVersion), sb.Version)
+		assert.NotZero(t, sb.CreatedAt)
+
+		require.NoError(t, v.Write(newRandomNeedle(1, 10)))
+		require.NoError(t, v.Close())
+
+		// the id of an existing volume comes from its superblock
+		reopened, err := NewVolume(f, WithVolumeID(1))
+		require.NoError(t, err)
+		assert.Equal(t, sb, reopened.SuperBlock())
+		assert.Len(t, reopened.index, 1)
+	})
+
+	t.Run("Error_Corrupt", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		_, err := NewVolume(f)
+		require.NoError(t, err)
+
+		_, err = f.WriteAt([]byte{0xff}, 16)
+		require.NoError(t, err)
+
+		_, err = NewVolume(f)
+		assert.ErrorIs(t, err, errtype.ErrSuperBlock)
+	})
+
+	t.Run("Success_MigrateLegacy", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "legacy.vol")
+		pool := NewBufferPool()
+
+		var legacy []byte
+		for i := range 3 {
+			legacy = append(legacy, newRandomNeedle(uint64(i), 100).Bytes(pool).B...)
+		}
+		require.NoError(t, os.WriteFile(path, legacy, 0600))
+
+		f, err := os.OpenFile(path, os.O_RDWR, 0600)
+		require.NoError(t, err)
+		defer func() {
+			_ = f.Close()
+		}()
+
+		v, err := NewVolume(f, WithVolumeID(3))
+		require.NoError(t, err)
+		defer func() {
+			_ = v.Close()
+		}()
+
+		assert.Equal(t, uint32(3), v.SuperBlock().VolumeID)
+		assert.Len(t, v.index, 3)
+
+		got, err := v.Read(KeyPair{Key: 2}, 0)
+		require.NoError(t, err)
+		assert.Equal(t, byte(2), got[0])
+
+		onDisk, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(SuperBlockMagic), binary.BigEndian.Uint32(onDisk[0:4]))
+		assert.Equal(t, legacy, onDisk[SuperBlockSize:])
+	})
+
+	t.Run("Success_MigrateSmallLegacy", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "legacy.vol")
+
+		// one needle shorter than a superblock
+		legacy := newNeedle(1, "tiny").Bytes(NewBufferPool()).B
+		require.Less(t, len(legacy), SuperBlockSize)
+		require.NoError(t, os.WriteFile(path, legacy, 0600))
+
+		f, err := os.OpenFile(path, os.O_RDWR, 0600)
+		require.NoError(t, err)
+		defer func() {
+			_ = f.Close()
+		}()
+
+		v, err := NewVolume(f)
+		require.NoError(t, err)
+		defer func() {
+			_ = v.Close()
+		}()
+
+		got, err := v.Read(KeyPair{Key: 1}, 10)
+		require.NoError(t, err)
+		assert.Equal(t, "tiny", string(got))
+
+		onDisk, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, legacy, onDisk[SuperBlockSize:])
+	})
+}
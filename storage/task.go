@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// task runs fn every interval in the background until it is stopped, stop
+// cancels the context of a running fn and waits for it to return.
+type task struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func startTask(interval time.Duration, fn func(ctx context.Context)) *task {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &task{cancel: cancel}
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				fn(ctx)
+			}
+		}
+	}()
+
+	return t
+}
+
+func (t *task) stop() {
+	t.cancel()
+	t.wg.Wait()
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"encoding/binary"
+	"time"
+
+	errtype "github.com/peterouob/file_system/type"
+)
+
+// SetTTL lets the needle expire ttl after the volume appended it.
+func (n *Needle) SetTTL(ttl time.Duration) {
+	n.SetAttr(AttrTTL, binary.BigEndian.AppendUint64(nil, uint64(ttl)))
+}
+
+// TTL returns the AttrTTL of the needle, 0 when it never expires.
+func (n *Needle) TTL() time.Duration {
+	return attrTTL(n.Attrs)
+}
+
+// ExpiresAt returns when a needle read back from a volume expires, the zero
+// time when it never does. The TTL of the volume is not taken into account.
+func (n *Needle) ExpiresAt() time.Time {
+	if n.TTL() <= 0 || n.Header.AppendAt == 0 {
+		return time.Time{}
+	}
+	return n.AppendTime().Add(n.TTL())
+}
+
+func attrTTL(attrs []Attribute) time.Duration {
+	for _, a := range attrs {
+		if a.Type == AttrTTL && len(a.Value) == 8 {
+			return time.Duration(binary.BigEndian.Uint64(a.Value))
+		}
+	}
+	return 0
+}
+
+func (m NeedleMeta) expired(now int64) bool {
+	return m.ExpireAt != 0 && m.ExpireAt <= now
+}
+
+// expireAt returns when the needle h with attrs expires, the shorter of its own
+// TTL and the TTL of the volume wins. v1 needles have no append time and never
+// expire.
+func (v *Volume) expireAt(h NeedleHeader, attrs []Attribute) int64 {
+	if h.AppendAt == 0 || h.Flag&DeleteFlag != 0 {
+		return 0
+	}
+
+	ttl := attrTTL(attrs)
+	if vt := v.super.TTL; vt > 0 && (ttl <= 0 || vt < ttl) {
+		ttl = vt
+	}
+
+	if ttl <= 0 {
+		return 0
+	}
+
+	return h.AppendAt + int64(ttl)
+}
+
+// TTL returns the TTL every needle of the volume lives at most, 0 for none.
+func (v *Volume) TTL() time.Duration {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	return v.super.TTL
+}
+
+// Expired reports whether the volume has a TTL and every needle it ever held
+// expired, the whole volume can be dropped then. A volume nothing was written
+// to yet is not expired.
+func (v *Volume) Expired() bool {
+	now := time.Now().UnixNano()
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	if v.super.TTL <= 0 || v.writeOffset == SuperBlockSize {
+		return false
+	}
+
+	for _, meta := range v.index {
+		if !meta.expired(now) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reap tombstones every needle past its TTL and returns how many it removed.
+// Like Delete it returns once the tombstones are on disk.
+func (v *Volume) Reap() (int, error) {
+	if v.opts.ReadOnly {
+		return 0, errtype.ErrReadOnly
+	}
+
+	p, n, err := v.reap(time.Now().UnixNano())
+	if err != nil || n == 0 {
+		return n, err
+	}
+
+	return n, v.commitDelete(p)
+}
+
+func (v *Volume) reap(now int64) (commitPoint, int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	var (
+		p      commitPoint
+		reaped int
+		header [NeedleHeaderSize]byte
+	)
+
+	for key, meta := range v.index {
+		if !meta.expired(now) {
+			continue
+		}
+
+		if _, err := v.dataFile.ReadAt(header[:], meta.Offset); err != nil {
+			return p, reaped, err
+		}
+
+		next, err := v.tombstone(key, meta, header[:])
+		if err != nil {
+			return p, reaped, err
+		}
+
+		p = next
+		reaped++
+	}
+
+	return p, reaped, nil
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTTLNeedle(key uint64, ttl time.Duration) *Needle {
+	n := newNeedle(key, "short lived")
+	n.SetTTL(ttl)
+	return n
+}
+
+func TestVolume_TTL(t *testing.T) {
+	t.Run("Success_ExpireAndReap", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		require.NoError(t, v.Write(newTTLNeedle(1, time.Millisecond)))
+		require.NoError(t, v.Write(newTTLNeedle(2, time.Hour)))
+		require.NoError(t, v.Write(newNeedle(3, "forever")))
+
+		got, err := v.ReadNeedle(KeyPair{Key: 2}, 20)
+		require.NoError(t, err)
+		assert.Equal(t, time.Hour, got.TTL())
+		assert.Equal(t, got.AppendTime().Add(time.Hour), got.ExpiresAt())
+
+		time.Sleep(5 * time.Millisecond)
+
+		_, err = v.Read(KeyPair{Key: 1}, 10)
+		assert.ErrorIs(t, err, errtype.ErrExpired)
+		_, err = v.ReadTo(KeyPair{Key: 1}, 10, io.Discard)
+		assert.ErrorIs(t, err, errtype.ErrExpired)
+
+		reaped, err := v.Reap()
+		require.NoError(t, err)
+		assert.Equal(t, 1, reaped)
+
+		_, err = v.Read(KeyPair{Key: 1}, 10)
+		assert.ErrorIs(t, err, errtype.ErrNotFound)
+		assert.Len(t, v.index, 2)
+
+		require.NoError(t, v.Close())
+		reopened := reopenVolume(t, f)
+		assert.NotContains(t, reopened.index, KeyPair{Key: 1})
+		assert.Len(t, reopened.index, 2)
+	})
+
+	t.Run("Success_ExpiryAfterReopen", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		require.NoError(t, v.Write(newTTLNeedle(1, time.Hour)))
+		want := v.index[KeyPair{Key: 1}].ExpireAt
+		assert.NotZero(t, want)
+		require.NoError(t, v.Close())
+
+		// from the index file
+		reopened := reopenVolume(t, f)
+		assert.Equal(t, want, reopened.index[KeyPair{Key: 1}].ExpireAt)
+		require.NoError(t, reopened.Close())
+
+		// from a scan of the data file
+		require.NoError(t, os.Remove(indexPath(f.Name())))
+		reopened = reopenVolume(t, f)
+		assert.Equal(t, want, reopened.index[KeyPair{Key: 1}].ExpireAt)
+	})
+
+	t.Run("Success_VolumeTTL", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithTTL(10*time.Millisecond))
+		require.NoError(t, err)
+		assert.False(t, v.Expired())
+
+		require.NoError(t, v.Write(newNeedle(1, "first")))
+		require.NoError(t, v.Write(newTTLNeedle(2, time.Hour)))
+		assert.False(t, v.Expired())
+
+		require.Eventually(t, v.Expired, time.Second, time.Millisecond)
+
+		_, err = v.Read(KeyPair{Key: 2}, 20)
+		assert.ErrorIs(t, err, errtype.ErrExpired)
+		require.NoError(t, v.Close())
+
+		// the TTL is kept in the superblock
+		reopened, err := NewVolume(f)
+		require.NoError(t, err)
+		assert.Equal(t, 10*time.Millisecond, reopened.TTL())
+		assert.True(t, reopened.Expired())
+	})
+
+	t.Run("Success_BackgroundReaper", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithReapInterval(time.Millisecond))
+		require.NoError(t, err)
+
+		require.NoError(t, v.Write(newTTLNeedle(1, time.Millisecond)))
+		require.NoError(t, v.Write(newNeedle(2, "forever")))
+
+		require.Eventually(t, func() bool {
+			v.mu.RLock()
+			defer v.mu.RUnlock()
+			_, ok := v.index[KeyPair{Key: 1}]
+			return !ok
+		}, time.Second, time.Millisecond)
+
+		require.NoError(t, v.Close())
+	})
+}
+
+func TestVolumeStore_DropExpired(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenVolumeStore(dir, WithTTL(10*time.Millisecond))
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, s.Close())
+	}()
+
+	id, err := s.Put(newNeedle(1, "first"))
+	require.NoError(t, err)
+
+	dropped, err := s.DropExpired()
+	require.NoError(t, err)
+	assert.Empty(t, dropped)
+
+	time.Sleep(15 * time.Millisecond)
+
+	dropped, err = s.DropExpired()
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{id}, dropped)
+	assert.NoFileExists(t, filepath.Join(dir, "1.vol"))
+	assert.NoFileExists(t, filepath.Join(dir, "1.idx"))
+
+	_, err = s.Get(id, KeyPair{Key: 1}, 10)
+	assert.ErrorIs(t, err, errtype.ErrNotFound)
+
+	next, err := s.Put(newNeedle(2, "second"))
+	require.NoError(t, err)
+	assert.NotEqual(t, id, next)
+}
@@ -0,0 +1,314 @@
+package storage
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"time"
+
+	errtype "github.com/peterouob/file_system/type"
+)
+
+/*
+Retention decides which older versions of a key a versioned volume keeps. An
+older version survives while it is one of the Versions newest older versions
+or was written less than For ago, the zero Retention keeps none.
+*/
+type Retention struct {
+	For      time.Duration
+	Versions uint32
+}
+
+// keeps reports whether the older version written at appendAt, with newer
+// older versions in front of it, is retained at now.
+func (r Retention) keeps(newer int, appendAt, now int64) bool {
+	return newer < int(r.Versions) || (r.For > 0 && now-appendAt < int64(r.For))
+}
+
+type versionMeta struct {
+	NeedleMeta
+	AppendAt int64
+	Version  uint64
+}
+
+// history is what a versioned volume knows about one key besides the needle the
+// index points at.
+type history struct {
+	old       []versionMeta // replaced versions still on disk, oldest first
+	current   uint64        // the version the index points at
+	currentAt int64         // and its append time
+	last      uint64        // the highest version handed out
+}
+
+/*
+versionIndex keeps the history of every key of a versioned volume. Each Write
+to a key gets the next version, the index points at the highest one and the
+replaced versions stay readable through ReadVersion while the Retention of the
+volume keeps them, compaction reclaims the ones it let go.
+
+Like the content index it isn't kept in the index file, a versioned volume
+rebuilds it from a scan of its data file on open. Deleting a key drops its
+older versions but not the highest version handed out, the tombstone carries
+it so the next write goes on from there after a reload as well.
+*/
+type versionIndex struct {
+	keys      map[KeyPair]*history
+	retention Retention
+}
+
+func newVersionIndex(r Retention) *versionIndex {
+	return &versionIndex{keys: make(map[KeyPair]*history), retention: r}
+}
+
+func attrVersion(attrs []Attribute) uint64 {
+	for _, a := range attrs {
+		if a.Type == AttrVersion && len(a.Value) == 8 {
+			return binary.BigEndian.Uint64(a.Value)
+		}
+	}
+	return 0
+}
+
+// Version returns the version a versioned volume gave the needle, 0 for none.
+func (n *Needle) Version() uint64 {
+	return attrVersion(n.Attrs)
+}
+
+// clone copies vi, compaction moves the needles of the copy.
+func (vi *versionIndex) clone() *versionIndex {
+	c := newVersionIndex(vi.retention)
+	for key, h := range vi.keys {
+		hh := *h
+		hh.old = slices.Clone(h.old)
+		c.keys[key] = &hh
+	}
+	return c
+}
+
+// reserve hands out the next version of key.
+func (vi *versionIndex) reserve(key KeyPair) uint64 {
+	h, ok := vi.keys[key]
+	if !ok {
+		h = &history{}
+		vi.keys[key] = h
+	}
+	h.last++
+	return h.last
+}
+
+// apply adds the needle h at meta to the history of key and points index at it
+// when it is the highest version, a write that reserved its version before a
+// concurrent one but was appended after it only joins the history. It returns
+// the bytes of older versions that fell out of the retention.
+func (vi *versionIndex) apply(index map[KeyPair]NeedleMeta, key KeyPair, h NeedleHeader, meta NeedleMeta, attrs []Attribute) int64 {
+	hist, ok := vi.keys[key]
+	if !ok {
+		hist = &history{}
+		vi.keys[key] = hist
+	}
+
+	vm := versionMeta{NeedleMeta: meta, AppendAt: h.AppendAt, Version: attrVersion(attrs)}
+	hist.last = max(hist.last, vm.Version)
+
+	cur, ok := index[key]
+	switch {
+	case !ok:
+	case vm.Version >= hist.current:
+		hist.old = append(hist.old, versionMeta{NeedleMeta: cur, AppendAt: hist.currentAt, Version: hist.current})
+	default:
+		i, _ := slices.BinarySearchFunc(hist.old, vm.Version, byVersion)
+		hist.old = slices.Insert(hist.old, i, vm)
+		return hist.trim(vi.retention, time.Now().UnixNano())
+	}
+
+	hist.current, hist.currentAt = vm.Version, vm.AppendAt
+	index[key] = meta
+	return hist.trim(vi.retention, time.Now().UnixNano())
+}
+
+func byVersion(m versionMeta, version uint64) int {
+	return cmp.Compare(m.Version, version)
+}
+
+// trim drops the older versions out of the retention at now and returns their
+// bytes.
+func (h *history) trim(r Retention, now int64) int64 {
+	var dropped int64
+	for len(h.old) > 0 && !r.keeps(len(h.old)-1, h.old[0].AppendAt, now) {
+		dropped += h.old[0].length()
+		h.old = h.old[1:]
+	}
+	return dropped
+}
+
+// drop forgets the needles of key and returns the bytes its older versions
+// took. The highest version handed out stays, raised to last, the version a
+// replayed tombstone carries.
+func (vi *versionIndex) drop(key KeyPair, last uint64) int64 {
+	if vi == nil {
+		return 0
+	}
+
+	h, ok := vi.keys[key]
+	if !ok {
+		if last == 0 {
+			return 0
+		}
+		h = &history{}
+		vi.keys[key] = h
+	}
+
+	var n int64
+	for _, m := range h.old {
+		n += m.length()
+	}
+	*h = history{last: max(h.last, last)}
+	return n
+}
+
+// tombstone returns the tombstone deleting key, whose needle had cookie, with
+// the highest version of key handed out.
+func (vi *versionIndex) tombstone(key KeyPair, cookie uint64) Needle {
+	t := tombstoneNeedle(key, cookie)
+	if vi == nil {
+		return t
+	}
+
+	if h, ok := vi.keys[key]; ok && h.last > 0 {
+		t.SetAttr(AttrVersion, binary.BigEndian.AppendUint64(nil, h.last))
+	}
+	return t
+}
+
+// tombstones returns a tombstone for every deleted key that was handed out a
+// version, sorted by key. Compaction drops the tombstone a delete appended,
+// without its successor the next write would start again at version 1.
+func (vi *versionIndex) tombstones(index map[KeyPair]NeedleMeta) []Needle {
+	if vi == nil {
+		return nil
+	}
+
+	var deleted []KeyPair
+	for key, h := range vi.keys {
+		if _, ok := index[key]; !ok && h.last > 0 {
+			deleted = append(deleted, key)
+		}
+	}
+	slices.SortFunc(deleted, func(a, b KeyPair) int {
+		return cmp.Or(cmp.Compare(a.Key, b.Key), cmp.Compare(a.AltKey, b.AltKey))
+	})
+
+	tombstones := make([]Needle, len(deleted))
+	for i, key := range deleted {
+		tombstones[i] = vi.tombstone(key, 0)
+	}
+	return tombstones
+}
+
+// retained trims every history to the retention at now, the older versions
+// left are the ones compaction copies.
+func (vi *versionIndex) retained(now int64) []liveNeedle {
+	var live []liveNeedle
+	for key, h := range vi.keys {
+		h.trim(vi.retention, now)
+		for _, m := range h.old {
+			live = append(live, liveNeedle{key: key, meta: m.NeedleMeta, hidden: true})
+		}
+	}
+	return live
+}
+
+// historyBytes returns the bytes taken by older versions.
+func (vi *versionIndex) historyBytes() int64 {
+	if vi == nil {
+		return 0
+	}
+
+	var n int64
+	for _, h := range vi.keys {
+		for _, m := range h.old {
+			n += m.length()
+		}
+	}
+	return n
+}
+
+// find returns the needle of version of key.
+func (vi *versionIndex) find(index map[KeyPair]NeedleMeta, key KeyPair, version uint64) (NeedleMeta, bool) {
+	h, ok := vi.keys[key]
+	if !ok {
+		return NeedleMeta{}, false
+	}
+
+	if meta, ok := index[key]; ok && h.current == version {
+		return meta, true
+	}
+
+	i, ok := slices.BinarySearchFunc(h.old, version, byVersion)
+	if !ok {
+		return NeedleMeta{}, false
+	}
+	return h.old[i].NeedleMeta, true
+}
+
+// tagVersion gives the needle of key with attrs the next version of key on a
+// versioned volume.
+func (v *Volume) tagVersion(key KeyPair, attrs []Attribute) []Attribute {
+	if v.versions == nil {
+		return attrs
+	}
+
+	v.mu.Lock()
+	version := v.versions.reserve(key)
+	v.mu.Unlock()
+
+	n := Needle{Attrs: slices.Clone(attrs)}
+	n.SetAttr(AttrVersion, binary.BigEndian.AppendUint64(nil, version))
+	return n.Attrs
+}
+
+// Versions returns the versions of key that can be read, oldest first.
+func (v *Volume) Versions(key KeyPair) []uint64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	if v.versions == nil {
+		return nil
+	}
+
+	h, ok := v.versions.keys[key]
+	if _, live := v.index[key]; !ok || !live {
+		return nil
+	}
+
+	versions := make([]uint64, 0, len(h.old)+1)
+	for _, m := range h.old {
+		versions = append(versions, m.Version)
+	}
+	return append(versions, h.current)
+}
+
+// ReadVersion reads version of the needle stored under key, a version dropped by
+// the retention or written before the key was last deleted reports ErrNotFound.
+func (v *Volume) ReadVersion(key KeyPair, cookie uint64, version uint64) (*Needle, error) {
+	v.mu.RLock()
+	if v.versions == nil {
+		v.mu.RUnlock()
+		return nil, fmt.Errorf("%w: volume keeps no versions", errtype.ErrNotFound)
+	}
+	meta, ok := v.versions.find(v.index, key, version)
+	dataFile, release := v.holdData()
+	v.mu.RUnlock()
+	defer release()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %v version %d", errtype.ErrNotFound, key, version)
+	}
+
+	if meta.expired(time.Now().UnixNano()) {
+		return nil, fmt.Errorf("%w: %v version %d", errtype.ErrExpired, key, version)
+	}
+
+	return v.readNeedle(dataFile, meta, cookie)
+}
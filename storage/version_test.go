@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolume_Versions(t *testing.T) {
+	key := KeyPair{Key: 1}
+
+	writeVersions := func(t *testing.T, v *Volume, n int) {
+		t.Helper()
+		for i := 1; i <= n; i++ {
+			require.NoError(t, v.Write(newNeedle(1, fmt.Sprintf("version %d", i))))
+		}
+	}
+
+	readVersion := func(t *testing.T, v *Volume, version uint64) {
+		t.Helper()
+		n, err := v.ReadVersion(key, 10, version)
+		require.NoError(t, err, "version %d", version)
+		assert.Equal(t, fmt.Sprintf("version %d", version), string(n.Data))
+		assert.Equal(t, version, n.Version())
+	}
+
+	t.Run("Success_History", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithVersioning(Retention{Versions: 5}))
+		require.NoError(t, err)
+
+		writeVersions(t, v, 3)
+		assert.Equal(t, []uint64{1, 2, 3}, v.Versions(key))
+		for version := uint64(1); version <= 3; version++ {
+			readVersion(t, v, version)
+		}
+
+		data, err := v.Read(key, 10)
+		require.NoError(t, err)
+		assert.Equal(t, "version 3", string(data))
+
+		_, err = v.ReadVersion(key, 10, 4)
+		assert.ErrorIs(t, err, errtype.ErrNotFound)
+
+		// older versions are live data, not garbage
+		assert.Zero(t, v.garbage)
+		require.NoError(t, v.Close())
+
+		v = reopenVolume(t, f)
+		assert.Equal(t, Retention{Versions: 5}, v.super.Retention)
+		assert.Equal(t, []uint64{1, 2, 3}, v.Versions(key))
+		readVersion(t, v, 1)
+
+		_, err = v.Compact()
+		require.NoError(t, err)
+		assert.Zero(t, v.garbage)
+		for version := uint64(1); version <= 3; version++ {
+			readVersion(t, v, version)
+		}
+	})
+
+	t.Run("Success_Retention", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithVersioning(Retention{Versions: 1}))
+		require.NoError(t, err)
+
+		writeVersions(t, v, 3)
+		assert.Equal(t, []uint64{2, 3}, v.Versions(key))
+		_, err = v.ReadVersion(key, 10, 1)
+		assert.ErrorIs(t, err, errtype.ErrNotFound)
+		assert.Equal(t, v.index[key].length(), v.garbage)
+
+		_, err = v.Compact()
+		require.NoError(t, err)
+		assert.Zero(t, v.garbage)
+		readVersion(t, v, 2)
+		readVersion(t, v, 3)
+	})
+
+	t.Run("Success_RetainFor", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithVersioning(Retention{For: time.Hour}))
+		require.NoError(t, err)
+
+		writeVersions(t, v, 3)
+		assert.Equal(t, []uint64{1, 2, 3}, v.Versions(key))
+
+		// written too long ago for the retention
+		v.mu.Lock()
+		v.versions.keys[key].old[0].AppendAt -= int64(2 * time.Hour)
+		v.mu.Unlock()
+
+		_, err = v.Compact()
+		require.NoError(t, err)
+		assert.Equal(t, []uint64{2, 3}, v.Versions(key))
+		readVersion(t, v, 2)
+	})
+
+	t.Run("Success_Delete", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithVersioning(Retention{Versions: 5}))
+		require.NoError(t, err)
+
+		writeVersions(t, v, 2)
+		require.NoError(t, v.Delete(key, 10))
+		assert.Empty(t, v.Versions(key))
+		_, err = v.ReadVersion(key, 10, 1)
+		assert.ErrorIs(t, err, errtype.ErrNotFound)
+		assert.Equal(t, v.writeOffset-SuperBlockSize, v.garbage)
+
+		// numbering goes on from the deleted versions
+		require.NoError(t, v.Write(newNeedle(1, "version 3")))
+		assert.Equal(t, []uint64{3}, v.Versions(key))
+		readVersion(t, v, 3)
+		require.NoError(t, v.Delete(key, 10))
+		require.NoError(t, v.Close())
+
+		// the tombstone keeps the count on reload, compaction keeps a tombstone
+		v = reopenVolume(t, f)
+		_, err = v.Compact()
+		require.NoError(t, err)
+		v = reopenVolume(t, f)
+		require.NoError(t, v.Write(newNeedle(1, "version 4")))
+		assert.Equal(t, []uint64{4}, v.Versions(key))
+		readVersion(t, v, 4)
+		_, err = v.ReadVersion(key, 10, 1)
+		assert.ErrorIs(t, err, errtype.ErrNotFound)
+
+		// and so does an archive
+		require.NoError(t, v.Delete(key, 10))
+		archive := new(bytes.Buffer)
+		require.NoError(t, v.Export(archive))
+		dst, err := os.Create(filepath.Join(t.TempDir(), "imported.vol"))
+		require.NoError(t, err)
+		defer func() {
+			_ = dst.Close()
+		}()
+		imported, err := ImportVolume(archive, dst)
+		require.NoError(t, err)
+		assert.Empty(t, imported.Versions(key))
+		require.NoError(t, imported.Write(newNeedle(1, "version 5")))
+		assert.Equal(t, []uint64{5}, imported.Versions(key))
+		readVersion(t, imported, 5)
+	})
+
+	t.Run("Success_WriteFrom", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		v, err := NewVolume(f, WithVersioning(Retention{Versions: 5}))
+		require.NoError(t, err)
+
+		writeVersions(t, v, 1)
+		payload := "version 2"
+		require.NoError(t, v.WriteFrom(NeedleHeader{Key: 1, Cookie: 10}, bytes.NewReader([]byte(payload)), uint32(len(payload))))
+		assert.Equal(t, []uint64{1, 2}, v.Versions(key))
+		readVersion(t, v, 1)
+		readVersion(t, v, 2)
+	})
+
+	t.Run("Error_Unversioned", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+		require.NoError(t, v.Write(newNeedle(1, "plain")))
+
+		assert.Nil(t, v.Versions(key))
+		_, err := v.ReadVersion(key, 10, 1)
+		assert.ErrorIs(t, err, errtype.ErrNotFound)
+	})
+
+	t.Run("Error_Dedup", func(t *testing.T) {
+		f := setup(t)
+		defer teardown(f, t)
+
+		_, err := NewVolume(f, WithDedup(), WithVersioning(Retention{}))
+		assert.ErrorIs(t, err, errtype.ErrVolumeVersion)
+	})
+}
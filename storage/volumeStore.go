@@ -0,0 +1,353 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	errtype "github.com/peterouob/file_system/type"
+)
+
+const volumeExt = ".vol"
+
+/*
+VolumeStore is the store machine of the haystack design, it owns a directory of
+numbered volumes
+
+	<dir>/1.vol 1.idx
+	<dir>/2.vol 2.idx
+	...
+
+Put appends a needle to one of the writable volumes and returns the volume id,
+which the caller keeps next to the key to Get the needle back. When every
+writable volume is sealed a new one is created.
+*/
+type VolumeStore struct {
+	volumes  map[uint32]*storeVolume
+	dir      string
+	options  []VolumeOption
+	writable []uint32
+	mu       sync.RWMutex
+	next     atomic.Uint64 // round robin over writable
+	lastID   uint32
+	readOnly bool
+}
+
+type storeVolume struct {
+	*Volume
+	file *os.File
+}
+
+func volumePath(dir string, id uint32) string {
+	return filepath.Join(dir, strconv.FormatUint(uint64(id), 10)+volumeExt)
+}
+
+// OpenVolumeStore opens every volume in dir, creating dir if needed. The options
+// are applied to every volume the store opens or creates.
+func OpenVolumeStore(dir string, options ...VolumeOption) (*VolumeStore, error) {
+	var opts VolumeOpts
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	s := &VolumeStore{
+		volumes:  make(map[uint32]*storeVolume),
+		dir:      dir,
+		options:  options,
+		readOnly: opts.ReadOnly,
+	}
+
+	if !s.readOnly {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, err
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || filepath.Ext(name) != volumeExt {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, volumeExt), 10, 32)
+		if err != nil {
+			continue
+		}
+
+		if err := s.open(uint32(id), false); err != nil {
+			return nil, errors.Join(err, s.Close())
+		}
+	}
+
+	return s, nil
+}
+
+// open opens or creates the volume id. s.mu must be held or s not yet shared.
+func (s *VolumeStore) open(id uint32, create bool) error {
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE | os.O_EXCL
+	}
+	if s.readOnly {
+		flag = os.O_RDONLY
+	}
+
+	path := volumePath(s.dir, id)
+	f, err := os.OpenFile(filepath.Clean(path), flag, 0600)
+	if err != nil {
+		return err
+	}
+
+	v, err := NewVolume(f, append(slices.Clone(s.options), WithVolumeID(id))...)
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("open volume %s: %w", path, err)
+	}
+
+	if got := v.SuperBlock().VolumeID; got != id {
+		_ = v.Close()
+		_ = f.Close()
+		return fmt.Errorf("%w: %s holds volume %d", errtype.ErrSuperBlock, path, got)
+	}
+
+	s.volumes[id] = &storeVolume{Volume: v, file: f}
+	s.lastID = max(s.lastID, id)
+
+	if !s.readOnly && !v.Sealed() {
+		s.writable = append(s.writable, id)
+	}
+
+	return nil
+}
+
+// Put appends the needle to a writable volume and returns the volume id it
+// landed in. A volume that turns out full is skipped and sealed by the volume
+// itself, once none is left a new volume is created.
+func (s *VolumeStore) Put(n *Needle) (uint32, error) {
+	if s.readOnly {
+		return 0, errtype.ErrReadOnly
+	}
+
+	for {
+		id, err := s.pickWritable()
+		if err != nil {
+			return 0, err
+		}
+
+		v, err := s.volume(id)
+		if err != nil {
+			return 0, err
+		}
+
+		err = v.Write(n)
+		if err == nil {
+			return id, nil
+		}
+
+		if !errors.Is(err, errtype.ErrVolumeSealed) {
+			return 0, err
+		}
+
+		s.retire(id)
+	}
+}
+
+// pickWritable returns a writable volume id, creating a volume when none is left.
+func (s *VolumeStore) pickWritable() (uint32, error) {
+	s.mu.RLock()
+	if len(s.writable) > 0 {
+		id := s.writable[s.next.Add(1)%uint64(len(s.writable))]
+		s.mu.RUnlock()
+		return id, nil
+	}
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// another Put may have created one meanwhile
+	if len(s.writable) > 0 {
+		return s.writable[0], nil
+	}
+
+	id := s.lastID + 1
+	if err := s.open(id, true); err != nil {
+		return 0, fmt.Errorf("create volume error: %w", err)
+	}
+
+	return id, nil
+}
+
+// retire takes a sealed volume out of the writable set.
+func (s *VolumeStore) retire(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writable = slices.DeleteFunc(s.writable, func(w uint32) bool {
+		return w == id
+	})
+}
+
+func (s *VolumeStore) volume(id uint32) (*storeVolume, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	v, ok := s.volumes[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: volume %d", errtype.ErrNotFound, id)
+	}
+
+	return v, nil
+}
+
+// Volume returns the open volume with the given id.
+func (s *VolumeStore) Volume(id uint32) (*Volume, error) {
+	v, err := s.volume(id)
+	if err != nil {
+		return nil, err
+	}
+	return v.Volume, nil
+}
+
+// VolumeIDs returns the ids of every open volume in ascending order.
+func (s *VolumeStore) VolumeIDs() []uint32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]uint32, 0, len(s.volumes))
+	for id := range s.volumes {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// Get reads a needle from the volume it was put in.
+func (s *VolumeStore) Get(volumeID uint32, key KeyPair, cookie uint64) ([]byte, error) {
+	v, err := s.volume(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	return v.Read(key, cookie)
+}
+
+// Delete deletes a needle from the volume it was put in.
+func (s *VolumeStore) Delete(volumeID uint32, key KeyPair, cookie uint64) error {
+	v, err := s.volume(volumeID)
+	if err != nil {
+		return err
+	}
+	return v.Delete(key, cookie)
+}
+
+// Compact compacts every volume past its garbage threshold and returns the
+// bytes reclaimed in total.
+func (s *VolumeStore) Compact() (int64, error) {
+	if s.readOnly {
+		return 0, nil
+	}
+
+	var reclaimed int64
+	for _, id := range s.VolumeIDs() {
+		v, err := s.volume(id)
+		if err != nil {
+			return reclaimed, err
+		}
+
+		n, err := v.CompactIfNeeded()
+		reclaimed += n
+		if err != nil {
+			return reclaimed, fmt.Errorf("volume %d: %w", id, err)
+		}
+	}
+
+	return reclaimed, nil
+}
+
+// DropExpired drops every volume whose TTL passed for all of its needles and
+// removes its files, it returns the ids of the dropped volumes.
+func (s *VolumeStore) DropExpired() ([]uint32, error) {
+	if s.readOnly {
+		return nil, nil
+	}
+
+	var (
+		dropped []uint32
+		errs    []error
+	)
+
+	for _, id := range s.VolumeIDs() {
+		v, err := s.volume(id)
+		if err != nil || !v.Expired() {
+			continue
+		}
+
+		// seal first so no Put lands in the volume while it is dropped, and
+		// check again for a Put that made it in before the seal
+		if err := v.Seal(); err != nil {
+			errs = append(errs, fmt.Errorf("volume %d: %w", id, err))
+			continue
+		}
+		s.retire(id)
+
+		if !v.Expired() {
+			continue
+		}
+
+		if err := s.drop(id); err != nil {
+			errs = append(errs, fmt.Errorf("volume %d: %w", id, err))
+			continue
+		}
+		dropped = append(dropped, id)
+	}
+
+	return dropped, errors.Join(errs...)
+}
+
+// drop closes the volume id and removes its data, index and scrub file.
+func (s *VolumeStore) drop(id uint32) error {
+	s.mu.Lock()
+	v, ok := s.volumes[id]
+	delete(s.volumes, id)
+	s.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	path := volumePath(s.dir, id)
+	err := errors.Join(v.Close(), v.file.Close(), os.Remove(path), os.Remove(indexPath(path)))
+
+	// a volume that was never scrubbed has no scrub file
+	if rerr := os.Remove(scrubPath(path)); !errors.Is(rerr, os.ErrNotExist) {
+		err = errors.Join(err, rerr)
+	}
+
+	return err
+}
+
+// Close closes every volume together with its data file.
+func (s *VolumeStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for id, v := range s.volumes {
+		errs = append(errs, v.Close(), v.file.Close())
+		delete(s.volumes, id)
+	}
+	s.writable = nil
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	errtype "github.com/peterouob/file_system/type"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolumeStore(t *testing.T) {
+	smallVolume := WithMaxSize(SuperBlockSize + 4*needleLength(NeedleVersion2, 0, 100))
+
+	t.Run("Success_PutGet", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "data")
+		s, err := OpenVolumeStore(dir)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, s.Close())
+		}()
+
+		id, err := s.Put(newRandomNeedle(1, 100))
+		require.NoError(t, err)
+		assert.Equal(t, uint32(1), id)
+		assert.FileExists(t, filepath.Join(dir, "1.vol"))
+
+		got, err := s.Get(id, KeyPair{Key: 1}, 0)
+		require.NoError(t, err)
+		assert.Equal(t, byte(1), got[0])
+
+		_, err = s.Get(9, KeyPair{Key: 1}, 0)
+		assert.ErrorIs(t, err, errtype.ErrNotFound)
+	})
+
+	t.Run("Success_RollOverAndReopen", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := OpenVolumeStore(dir, smallVolume)
+		require.NoError(t, err)
+
+		ids := make(map[uint64]uint32)
+		for i := range 10 {
+			id, err := s.Put(newRandomNeedle(uint64(i), 100))
+			require.NoError(t, err)
+			ids[uint64(i)] = id
+		}
+		assert.Equal(t, []uint32{1, 2, 3}, s.VolumeIDs())
+
+		v, err := s.Volume(1)
+		require.NoError(t, err)
+		assert.True(t, v.Sealed())
+		require.NoError(t, s.Close())
+
+		s, err = OpenVolumeStore(dir, smallVolume)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, s.Close())
+		}()
+
+		assert.Equal(t, []uint32{3}, s.writable)
+		for key, id := range ids {
+			got, err := s.Get(id, KeyPair{Key: key}, 0)
+			require.NoError(t, err)
+			assert.Equal(t, byte(key), got[0])
+		}
+	})
+
+	t.Run("Success_ConcurrentPut", func(t *testing.T) {
+		s, err := OpenVolumeStore(t.TempDir(), smallVolume)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, s.Close())
+		}()
+
+		var (
+			wg  sync.WaitGroup
+			mu  sync.Mutex
+			ids = make(map[uint64]uint32)
+		)
+		for w := range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range 10 {
+					key := uint64(w*10 + i)
+					id, err := s.Put(newRandomNeedle(key, 100))
+					if !assert.NoError(t, err) {
+						return
+					}
+					mu.Lock()
+					ids[key] = id
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Len(t, ids, 40)
+		for key, id := range ids {
+			got, err := s.Get(id, KeyPair{Key: key}, 0)
+			require.NoError(t, err)
+			assert.Equal(t, byte(key), got[0])
+		}
+	})
+
+	t.Run("Error_NeedleLargerThanVolume", func(t *testing.T) {
+		s, err := OpenVolumeStore(t.TempDir(), smallVolume)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, s.Close())
+		}()
+
+		_, err = s.Put(newRandomNeedle(1, 1024))
+		assert.ErrorIs(t, err, errtype.ErrToLarge)
+
+		v, err := s.Volume(1)
+		require.NoError(t, err)
+		assert.False(t, v.Sealed())
+	})
+
+	t.Run("Error_VolumeIDMismatch", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := OpenVolumeStore(dir)
+		require.NoError(t, err)
+		_, err = s.Put(newRandomNeedle(1, 100))
+		require.NoError(t, err)
+		require.NoError(t, s.Close())
+
+		require.NoError(t, os.Rename(filepath.Join(dir, "1.vol"), filepath.Join(dir, "5.vol")))
+
+		_, err = OpenVolumeStore(dir)
+		assert.ErrorIs(t, err, errtype.ErrSuperBlock)
+	})
+}
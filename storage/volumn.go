@@ -1,12 +1,19 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"log"
 	"os"
+	"slices"
 	"sync"
+	"time"
 
 	errtype "github.com/peterouob/file_system/type"
+	"github.com/peterouob/file_system/utils"
 )
 
 type KeyPair struct {
@@ -16,15 +23,40 @@ type KeyPair struct {
 
 type Volume struct {
 	dataFile    *os.File
+	idx         *indexFile
 	index       map[KeyPair]NeedleMeta
 	bufferPool  *BufferPool
+	path        string
+	files       fileRefs // data files replaced by compaction, still open for in-flight reads
+	opts        VolumeOpts
 	writeOffset int64
+	garbage     int64 // bytes taken by overwritten needles and tombstones
+	group       *groupCommit
+	super       SuperBlock
 	mu          sync.RWMutex
+	compactMu   sync.Mutex
+	streams     sync.RWMutex             // held shared by WriteFrom while its payload streams in
+	inflight    map[int64]*pendingStream // ranges reserved by WriteFrom by offset, v.mu guards it
+	scrubMu     sync.Mutex               // one Scrub pass at a time
+	scrub       *scrubState
+	content     *contentIndex // payloads shared between keys, nil unless the volume has FeatureDedup, set once
+	versions    *versionIndex // older versions of the keys, nil unless the volume has FeatureVersions, set once
+	tasks       []*task       // background reaper and scrubber, stopped by Close
+	ownsData    bool          // dataFile was opened by the volume and is closed by Close
+	migrated    bool          // the data file was moved behind a superblock on open
 }
 
 type NeedleMeta struct {
-	Offset int64
-	Size   uint32
+	Offset   int64
+	ExpireAt int64 // unix nano time the needle expires at, 0 for never
+	Size     uint32
+	AttrSize uint16
+	Version  uint8
+}
+
+// length returns the number of bytes the needle takes on disk.
+func (m NeedleMeta) length() int64 {
+	return needleLength(m.Version, m.AttrSize, m.Size)
 }
 
 var (
@@ -32,36 +64,374 @@ var (
 	O          sync.Once
 )
 
-func NewVolume(dataFile *os.File) *Volume {
+func NewVolume(dataFile *os.File, options ...VolumeOption) (*Volume, error) {
 
 	O.Do(func() {
 		bufferPool = NewBufferPool()
 		bufferPool.WarnUp()
 	})
 
+	opts := VolumeOpts{
+		CompactThreshold: defaultCompactThreshold,
+		MaxSize:          DefaultMaxVolumeSize,
+	}
+
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	if opts.Dedup && opts.Versioning {
+		return nil, fmt.Errorf("%w: dedup and versioning can't be combined", errtype.ErrVolumeVersion)
+	}
+
 	v := &Volume{
 		dataFile:    dataFile,
 		index:       make(map[KeyPair]NeedleMeta),
-		writeOffset: 0,
+		writeOffset: SuperBlockSize,
 		bufferPool:  bufferPool,
+		path:        dataFile.Name(),
+		opts:        opts,
+		group:       newGroupCommit(),
+	}
+
+	if err := v.initSuperBlock(); err != nil {
+		return nil, err
+	}
+
+	if v.super.Features&FeatureDedup != 0 {
+		v.content = newContentIndex()
+	}
+
+	if v.super.Features&FeatureVersions != 0 {
+		v.versions = newVersionIndex(v.super.Retention)
+	}
+
+	idx, err := openIndexFile(indexPath(v.path), opts.ReadOnly)
+	if err != nil {
+		v.closeOwned()
+		return nil, fmt.Errorf("open index error: %w", err)
+	}
+	v.idx = idx
+	v.scrub = loadScrubState(scrubPath(v.path))
+
+	// the content and version indexes are only rebuilt by a scan
+	if v.migrated || v.content != nil || v.versions != nil {
+		err = v.reload()
+	} else {
+		err = v.load()
+	}
+
+	if err != nil {
+		_ = idx.close()
+		v.closeOwned()
+		return nil, err
+	}
+
+	if opts.ReapInterval > 0 && !opts.ReadOnly {
+		v.tasks = append(v.tasks, startTask(opts.ReapInterval, func(context.Context) {
+			if _, err := v.Reap(); err != nil {
+				log.Printf("reap volume %s: %v", v.path, err)
+			}
+		}))
+	}
+
+	if opts.ScrubInterval > 0 {
+		v.tasks = append(v.tasks, startTask(opts.ScrubInterval, func(ctx context.Context) {
+			report, err := v.Scrub(ctx)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.Printf("scrub volume %s: %v", v.path, err)
+			}
+			for _, e := range report.Corrupt {
+				log.Printf("scrub volume %s: quarantined %v at %d: %v", v.path, e.Key, e.Offset, e.Err)
+			}
+		}))
+	}
+
+	return v, nil
+}
+
+// closeOwned closes the data files the volume opened itself.
+func (v *Volume) closeOwned() {
+	_ = v.files.close()
+	if v.ownsData {
+		_ = v.dataFile.Close()
+	}
+}
+
+// load restores the index from the index file and replays only the needles
+// appended to the data file after it. When the index file is missing, damaged
+// or disagrees with the data file it falls back to a full reload. It runs before
+// the volume is shared, so it doesn't take v.mu.
+func (v *Volume) load() error {
+	fi, err := v.dataFile.Stat()
+	if err != nil {
+		return fmt.Errorf("load error: %w", err)
+	}
+
+	index, covered, last, err := v.idx.load()
+	covered = max(covered, SuperBlockSize)
+	if err == nil && v.indexConsistent(index, covered, last, fi.Size()) {
+		if err := v.replay(index, covered, fi.Size()); err == nil {
+			if v.writeOffset == covered {
+				return nil
+			}
+			return v.idx.checkpoint(v.index, v.writeOffset)
+		}
+	}
+
+	return v.reload()
+}
+
+// indexConsistent checks the index file against the data file, the data it
+// covers must exist and every entry must point at a needle with its key, the
+// last one logged included. A lost log append or a stale checkpoint makes the
+// caller fall back to a full reload, needles Scrub quarantined are known to
+// be damaged and pass.
+func (v *Volume) indexConsistent(index map[KeyPair]NeedleMeta, covered int64, last *indexEntry, size int64) bool {
+	if covered > size {
+		return false
+	}
+
+	if last != nil && !v.needleAt(last.Key, last.NeedleMeta, size) {
+		return false
+	}
+
+	for key, meta := range index {
+		if e, ok := v.scrub.quarantine[key]; ok && e.Offset == meta.Offset {
+			continue
+		}
+		if !v.needleAt(key, meta, size) {
+			return false
+		}
+	}
+	return true
+}
+
+// needleAt reports whether the data file of the given size holds a needle of
+// key framed like meta at meta.Offset.
+func (v *Volume) needleAt(key KeyPair, meta NeedleMeta, size int64) bool {
+	if meta.Offset < 0 || meta.Offset+meta.length() > size {
+		return false
+	}
+
+	var header [NeedleHeaderV2Size]byte
+	hs := headerSize(meta.Version)
+	if _, err := v.dataFile.ReadAt(header[:hs], meta.Offset); err != nil {
+		return false
+	}
+
+	h := decodeNeedleHeader(header[:hs])
+	if !validMagic(h.MagicHeader) || h.Key != key.Key || h.AlternateKey != key.AltKey {
+		return false
+	}
+	if got := h.meta(meta.Offset); got.Size != meta.Size || got.AttrSize != meta.AttrSize || got.Version != meta.Version {
+		return false
 	}
 
-	return v
+	var footer [NeedleFooterSize]byte
+	if _, err := v.dataFile.ReadAt(footer[:], meta.Offset+hs+int64(meta.AttrSize)+int64(meta.Size)); err != nil {
+		return false
+	}
+	return binary.BigEndian.Uint32(footer[4:8]) == MagicFooter
 }
 
+// appendIndex logs e to the index file and checkpoints the whole index once
+// enough entries piled up since the last checkpoint. v.mu must be held.
+func (v *Volume) appendIndex(e indexEntry) error {
+	v.supersede(e.Key, e.Offset)
+
+	if err := v.idx.append(e); err != nil {
+		return fmt.Errorf("index append error: %w", err)
+	}
+
+	if v.idx.needCheckpoint() {
+		return v.checkpoint()
+	}
+
+	return nil
+}
+
+// Close checkpoints the index and closes the index file. The data file given to
+// NewVolume belongs to the caller and is left open, data files the volume opened
+// itself during compaction are closed.
+func (v *Volume) Close() error {
+	v.compactMu.Lock()
+	defer v.compactMu.Unlock()
+
+	for _, t := range v.tasks {
+		t.stop()
+	}
+	v.tasks = nil
+
+	v.streams.Lock()
+	defer v.streams.Unlock()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	errs := []error{v.idx.checkpoint(v.index, v.writeOffset), v.idx.close()}
+
+	errs = append(errs, v.files.close())
+
+	if v.ownsData {
+		errs = append(errs, v.dataFile.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// Write appends the needle to the volume in the v2 layout together with its
+// attributes, the append time is set by the volume. On a dedup volume a payload
+// the volume already holds is appended as a reference needle instead. It returns
+// once the needle is durable under the volume's Durability. A Flag with
+// DeleteFlag, BatchFlag or CommitFlag reports ErrNeedleFlag.
 func (v *Volume) Write(n *Needle) error {
+	w, err := v.prepareNeedle(n)
+	if err != nil {
+		return err
+	}
+
+	if v.content != nil && len(n.Data) >= dedupMinSize {
+		if ok, err := v.dedup(&w); err != nil || ok {
+			return err
+		}
+	}
+
+	release, err := v.encodeNeedle(&w)
+	defer release()
+	if err != nil {
+		return err
+	}
+
+	if NeedleHeaderV2Size+attributesSize(w.Attrs)+len(w.Data)+NeedleFooterSize > xlargeSize {
+		size, err := utils.CIU32(len(w.Data))
+		if err != nil {
+			return fmt.Errorf("%w: payload of %d bytes", errtype.ErrToLarge, len(w.Data))
+		}
+		w.Header.AttrSize = uint16(attributesSize(w.Attrs))
+		w.Header.Size = size
+
+		p, err := v.writeFrom(w.Header, w.Attrs, bytes.NewReader(w.Data))
+		if err != nil {
+			return err
+		}
+		return v.commit(p)
+	}
 
-	dataBytes := n.Bytes(v.bufferPool)
+	dataBytes := w.Bytes(v.bufferPool)
 
 	defer v.bufferPool.Put(dataBytes)
 
-	writeOffset := int64(len(dataBytes.B))
+	p, err := v.write(&w, dataBytes)
+	if err != nil {
+		return err
+	}
+
+	return v.commit(p)
+}
+
+const (
+	// encodingFlags tell how the volume stored a payload, ReadNeedle reports
+	// them and a needle written again gets its own.
+	encodingFlags = CompressFlag | EncryptFlag | RefFlag
+	// logFlags frame the needle log, no needle a caller writes may carry them.
+	logFlags = DeleteFlag | batchMarkers
+)
+
+// prepareNeedle returns the copy of n the volume appends, in the v2 layout
+// with its version and append time set. Size is taken from Data, the flags and
+// attributes describing how a payload was stored are dropped, so a needle read
+// with ReadNeedle can be written again.
+func (v *Volume) prepareNeedle(n *Needle) (Needle, error) {
+	if err := validFlag(n.Header.Flag); err != nil {
+		return Needle{}, err
+	}
+
+	size, err := utils.CIU32(len(n.Data))
+	if err != nil || size > MaxNeedleSize {
+		return Needle{}, fmt.Errorf("%w: payload of %d bytes", errtype.ErrToLarge, len(n.Data))
+	}
+
+	w := *n
+	w.Attrs = v.tagVersion(KeyPair{Key: n.Header.Key, AltKey: n.Header.AlternateKey}, callerAttributes(n.Attrs))
+
+	if err := validAttributes(w.Attrs); err != nil {
+		return Needle{}, err
+	}
+
+	w.Header.MagicHeader = MagicHeaderV2
+	w.Header.AppendAt = time.Now().UnixNano()
+	w.Header.Flag &^= encodingFlags
+	w.Header.Size = size
+	w.Footer.MagicFooter = MagicFooter
+	return w, nil
+}
+
+// validFlag rejects the flags that frame the needle log, a needle carrying
+// them would delete keys or cut the log off on replay.
+func validFlag(flag byte) error {
+	if flag&logFlags != 0 {
+		return fmt.Errorf("%w: %#x", errtype.ErrNeedleFlag, flag&logFlags)
+	}
+	return nil
+}
+
+// callerAttributes returns attrs without the attributes the volume sets itself.
+func callerAttributes(attrs []Attribute) []Attribute {
+	return slices.DeleteFunc(slices.Clone(attrs), func(a Attribute) bool {
+		switch a.Type {
+		case AttrCodec, AttrCipher, AttrHash, AttrVersion:
+			return true
+		}
+		return false
+	})
+}
+
+// encodeNeedle compresses and seals the payload of w as the volume is set up
+// to, release hands the buffer a compressed payload sits in back to the pool
+// once w is written.
+func (v *Volume) encodeNeedle(w *Needle) (func(), error) {
+	release := func() {}
+
+	if v.opts.Codec != nil && len(w.Data) >= compressMinSize && len(w.Data) <= xlargeSize {
+		zbuf, err := v.bufferPool.Get(uint32(len(w.Data)))
+		if err != nil {
+			return release, err
+		}
+		release = func() { v.bufferPool.Put(zbuf) }
+
+		if err := v.compressNeedle(w, zbuf.B); err != nil {
+			return release, err
+		}
+	}
+
+	if v.opts.Keys != nil {
+		if err := sealNeedle(v.opts.Keys, w); err != nil {
+			return release, err
+		}
+	}
 
+	return release, nil
+}
+
+func (v *Volume) write(n *Needle, dataBytes *Buffer) (commitPoint, error) {
 	v.mu.Lock()
 	defer v.mu.Unlock()
 
+	return v.writeLocked(n, dataBytes)
+}
+
+// writeLocked appends the encoded needle n and points its key at it. v.mu must
+// be held.
+func (v *Volume) writeLocked(n *Needle, dataBytes *Buffer) (commitPoint, error) {
+	writeOffset := int64(len(dataBytes.B))
+
+	if err := v.writable(writeOffset); err != nil {
+		return commitPoint{}, err
+	}
+
 	if n, err := v.dataFile.WriteAt(dataBytes.B, v.writeOffset); err != nil || n != len(dataBytes.B) {
-		return fmt.Errorf("write error: %v", err)
+		return commitPoint{}, fmt.Errorf("write error: %v", err)
 	}
 
 	key := KeyPair{
@@ -69,102 +439,349 @@ func (v *Volume) Write(n *Needle) error {
 		AltKey: n.Header.AlternateKey,
 	}
 
-	v.index[key] = NeedleMeta{
-		Offset: v.writeOffset,
-		Size:   n.Header.Size,
-	}
+	meta := n.Header.meta(v.writeOffset)
+	meta.ExpireAt = v.expireAt(n.Header, n.Attrs)
+	v.garbage += linkNeedle(v.index, v.content, v.versions, key, n.Header, meta, n.Attrs)
 
 	v.writeOffset += writeOffset
-	return nil
+
+	return v.point(v.writeOffset), v.appendIndex(indexEntry{
+		Key:        key,
+		NeedleMeta: meta,
+		Flag:       n.Header.Flag,
+	})
 }
 
+// Read returns the data of the needle stored under key, see ReadNeedle for its
+// header and attributes.
 func (v *Volume) Read(key KeyPair, cookie uint64) ([]byte, error) {
+	n, err := v.ReadNeedle(key, cookie)
+	if err != nil {
+		return nil, err
+	}
+	return n.Data, nil
+}
+
+// ReadNeedle reads the needle stored under key with its header and attributes.
+// Needles written in the v1 layout come back without attributes and append time.
+// The Data of an encrypted or compressed needle is decrypted and decompressed,
+// its Header keeps the stored Size and the EncryptFlag and CompressFlag. A
+// reference needle comes back with its own header and attributes and the Data
+// of the needle it refers to.
+// A needle past its TTL reports ErrExpired until the reaper removes it.
+func (v *Volume) ReadNeedle(key KeyPair, cookie uint64) (*Needle, error) {
 	v.mu.RLock()
 	meta, ok := v.index[key]
+	dataFile, release := v.holdData()
 	v.mu.RUnlock()
+	defer release()
 
 	if !ok {
 		return nil, fmt.Errorf("read not found the data from key:,%w: %v", errtype.ErrNotFound, key)
 	}
 
-	var lastMetaSize = meta.Size
+	if meta.expired(time.Now().UnixNano()) {
+		return nil, fmt.Errorf("%w: %v", errtype.ErrExpired, key)
+	}
 
-	totalSize := NeedleHeaderSize + lastMetaSize + NeedleFooterSize
+	n, err := v.readNeedle(dataFile, meta, cookie)
+	if err != nil || n.Header.Flag&RefFlag == 0 {
+		return n, err
+	}
 
-	buf, err := v.bufferPool.Get(totalSize)
-	buf.B = buf.B[:totalSize]
+	b, f, releaseBlob, err := v.resolve(n)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseBlob()
+
+	content, err := v.readNeedle(f, b.meta, b.cookie)
+	if err != nil {
+		return nil, err
+	}
+
+	n.Data = content.Data
+	return n, nil
+}
+
+// readNeedle reads the needle at meta of f and restores its payload.
+func (v *Volume) readNeedle(f *os.File, meta NeedleMeta, cookie uint64) (*Needle, error) {
+	totalSize := meta.length()
+
+	// the framed length of a needle near MaxNeedleSize doesn't fit the uint32
+	// the pool takes, it can't come from the pool anyway
+	var (
+		buf *Buffer
+		err = errtype.ErrToLarge
+	)
+	if totalSize <= xlargeSize {
+		buf, err = v.bufferPool.Get(uint32(totalSize))
+	}
 
 	if errors.Is(err, errtype.ErrToLarge) {
-		return nil, fmt.Errorf("read error: %v", err)
+		// too large for one pooled buffer, stream it through chunks instead
+		data := bytes.NewBuffer(make([]byte, 0, min(meta.Size, xlargeSize)))
+		n, _, err := v.readTo(f, meta, cookie, data)
+		if err != nil {
+			return nil, err
+		}
+		n.Data = data.Bytes()
+		return n, nil
 	}
 
 	defer v.bufferPool.Put(buf)
 
-	if n, err := v.dataFile.ReadAt(buf.B, meta.Offset); err != nil || n != int(totalSize) {
+	buf.B = buf.B[:totalSize]
+
+	if n, err := f.ReadAt(buf.B, meta.Offset); err != nil || int64(n) != totalSize {
 		return nil, fmt.Errorf("read error: %v", err)
 	}
 
-	if err := ValidNeedleBlock(buf.B, cookie); err != nil {
+	n, err := decodeNeedle(buf.B, cookie)
+	if err != nil {
 		return nil, err
 	}
 
-	data, err := GetNeedleBlockInfo(totalSize, lastMetaSize, buf.B)
+	if n.Header.Flag&EncryptFlag != 0 {
+		if err := openNeedle(v.opts.Keys, n); err != nil {
+			return nil, err
+		}
+	}
 
-	if errors.Is(err, errtype.ErrCrcNotValid) {
-		return nil, err
+	if n.Header.Flag&CompressFlag != 0 {
+		if n.Data, err = decompress(n); err != nil {
+			return nil, err
+		}
 	}
 
-	return data, nil
+	return n, nil
+}
+
+// Reload rebuilds the in-memory index by scanning the needle log that follows
+// the superblock and writes a fresh index checkpoint. Tombstones remove their
+// key again, and a torn record left at the tail by a crash in the middle of an
+// append is truncated away so the next write starts from the last intact needle.
+func (v *Volume) Reload() error {
+	v.streams.Lock()
+	defer v.streams.Unlock()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.reload()
 }
 
-func (v *Volume) Reload() {
-	//TODO when the system start reload(recover) the data from disk
-	panic("implement me")
+func (v *Volume) reload() error {
+	fi, err := v.dataFile.Stat()
+	if err != nil {
+		return fmt.Errorf("reload error: %w", err)
+	}
+
+	if v.content != nil {
+		*v.content = *newContentIndex()
+	}
+	if v.versions != nil {
+		*v.versions = *newVersionIndex(v.super.Retention)
+	}
+
+	if err := v.replay(make(map[KeyPair]NeedleMeta), SuperBlockSize, fi.Size()); err != nil {
+		return err
+	}
+
+	return v.idx.checkpoint(v.index, v.writeOffset)
 }
 
-// Delete TODO:i think it can us a queue to record the first delNeedle write time and use a matrics when system isn't busy then delete the delNeedle block on disk
-// i think maybe use segment tree is a good idea to find and delete the time range on disk
+// replay applies the needles found in the data file between from and size on
+// top of index and installs the result as the volume index. v.mu must be held.
+func (v *Volume) replay(index map[KeyPair]NeedleMeta, from, size int64) error {
+	var batch batchLog
+	res, err := scanNeedles(v.dataFile, from, size, v.bufferPool, func(rec needleRecord) error {
+		batch.add(rec, func(rec needleRecord) {
+			v.applyRecord(index, v.content, v.versions, rec)
+		})
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("reload error: %w", err)
+	}
+
+	// a batch without its commit marker is torn as a whole
+	if batch.open {
+		res.End, res.Torn = batch.start, true
+	}
+
+	// a read only volume leaves the torn tail on disk, it is never appended to
+	if res.Torn && !v.opts.ReadOnly {
+		if err := v.dataFile.Truncate(res.End); err != nil {
+			return fmt.Errorf("reload truncate error: %w", err)
+		}
+	}
+
+	v.index = index
+	v.writeOffset = res.End
+	v.garbage = v.writeOffset - SuperBlockSize - v.content.liveBytes(index) - v.versions.historyBytes()
+	return nil
+}
+
+// applyRecord applies a needle found in the needle log to index, content and
+// versions, content is nil unless the volume has FeatureDedup and versions nil
+// unless it has FeatureVersions.
+func (v *Volume) applyRecord(index map[KeyPair]NeedleMeta, content *contentIndex, versions *versionIndex, rec needleRecord) {
+	key := KeyPair{
+		Key:    rec.Header.Key,
+		AltKey: rec.Header.AlternateKey,
+	}
+
+	if rec.Header.Flag&batchMarkers != 0 {
+		return
+	}
+
+	if rec.Header.Flag&DeleteFlag != 0 {
+		if old, ok := index[key]; ok {
+			content.release(key, old)
+		}
+		versions.drop(key, attrVersion(rec.Attrs))
+		delete(index, key)
+		return
+	}
+
+	meta := rec.Header.meta(rec.Offset)
+	meta.ExpireAt = v.expireAt(rec.Header, rec.Attrs)
+	linkNeedle(index, content, versions, key, rec.Header, meta, rec.Attrs)
+}
+
+// linkNeedle points key at the needle h at meta in index and returns the bytes
+// that turned into garbage, through versions or content when the volume keeps
+// them.
+func linkNeedle(index map[KeyPair]NeedleMeta, content *contentIndex, versions *versionIndex, key KeyPair, h NeedleHeader, meta NeedleMeta, attrs []Attribute) int64 {
+	if versions != nil {
+		return versions.apply(index, key, h, meta, attrs)
+	}
+
+	garbage := content.link(key, h, meta, attrs, lookup(index, key))
+	index[key] = meta
+	return garbage
+}
+
+// lookup returns the needle key points at in index, nil for none.
+func lookup(index map[KeyPair]NeedleMeta, key KeyPair) *NeedleMeta {
+	if meta, ok := index[key]; ok {
+		return &meta
+	}
+	return nil
+}
+
+func liveBytes(index map[KeyPair]NeedleMeta) int64 {
+	var n int64
+	for _, meta := range index {
+		n += meta.length()
+	}
+	return n
+}
+
+/*
+Delete deletes the needle stored under key, the cookie must match the one it
+was written with. The DeleteFlag is set on the needle in place and a tombstone
+is appended behind it, so the key stays deleted when the volume is reloaded even
+if one of the two writes is lost.
+
+Delete returns once the tombstone is on disk. A lost tombstone brings deleted
+data back, so it is synced even under DurabilityNone.
+*/
 func (v *Volume) Delete(key KeyPair, cookie uint64) error {
+	p, err := v.delete(key, cookie)
+	if err != nil {
+		return err
+	}
+
+	return v.commitDelete(p)
+}
+
+// commitDelete waits for tombstones up to p to reach disk, it syncs even
+// under DurabilityNone.
+func (v *Volume) commitDelete(p commitPoint) error {
+	if v.opts.Durability == DurabilityNone {
+		if p.file == nil {
+			return nil
+		}
+		return v.syncPoint(p)
+	}
+
+	return v.commit(p)
+}
+
+func (v *Volume) delete(key KeyPair, cookie uint64) (commitPoint, error) {
 	v.mu.Lock()
 	defer v.mu.Unlock()
 
-	if _, ok := v.index[key]; ok {
-		log.Println("Deleted ...")
-		return nil
+	if v.opts.ReadOnly {
+		return commitPoint{}, errtype.ErrReadOnly
 	}
 
-	delNeedle := Needle{
-		Data: nil,
+	meta, ok := v.index[key]
+	if !ok {
+		return commitPoint{}, fmt.Errorf("delete not found the data from key:,%w: %v", errtype.ErrNotFound, key)
+	}
+
+	var header [NeedleHeaderSize]byte
+	if _, err := v.dataFile.ReadAt(header[:], meta.Offset); err != nil {
+		return commitPoint{}, fmt.Errorf("read error: %v", err)
+	}
+
+	if err := ValidNeedleBlock(header[:], cookie); err != nil {
+		return commitPoint{}, err
+	}
+
+	return v.tombstone(key, meta, header[:])
+}
+
+// tombstoneNeedle returns the tombstone deleting key, whose needle had cookie.
+func tombstoneNeedle(key KeyPair, cookie uint64) Needle {
+	return Needle{
 		Header: NeedleHeader{
 			Cookie:       cookie,
 			Key:          key.Key,
 			AlternateKey: key.AltKey,
-			MagicHeader:  MagicHeader,
-			Size:         0,
+			MagicHeader:  MagicHeaderV2,
+			AppendAt:     time.Now().UnixNano(),
 			Flag:         DeleteFlag,
 		},
 		Footer: NeedleFooter{
-			Checksum:    0,
 			MagicFooter: MagicFooter,
 		},
 	}
+}
+
+// tombstone appends a tombstone for the needle at meta whose header is given
+// and sets its DeleteFlag in place. v.mu must be held.
+func (v *Volume) tombstone(key KeyPair, meta NeedleMeta, header []byte) (commitPoint, error) {
+	delNeedle := v.versions.tombstone(key, binary.BigEndian.Uint64(header[4:12]))
 
 	buf := delNeedle.Bytes(v.bufferPool)
 	defer v.bufferPool.Put(buf)
 
-	n, err := v.dataFile.WriteAt(buf.B, v.writeOffset)
-
-	if err != nil {
-		return fmt.Errorf("write error: %v", err)
+	if n, err := v.dataFile.WriteAt(buf.B, v.writeOffset); err != nil || n != len(buf.B) {
+		return commitPoint{}, fmt.Errorf("write error: %v", err)
 	}
 
-	if n != len(buf.B) {
-		return fmt.Errorf("write error: %v", io.ErrShortWrite)
+	// content other keys refer to stays readable, the tombstone alone deletes
+	// the key
+	if !v.content.shared(key, meta) {
+		if _, err := v.dataFile.WriteAt([]byte{header[24] | DeleteFlag}, meta.Offset+24); err != nil {
+			return commitPoint{}, fmt.Errorf("write error: %v", err)
+		}
 	}
 
-	v.writeOffset += int64(n)
+	offset := v.writeOffset
+	v.writeOffset += int64(len(buf.B))
+	v.garbage += v.content.release(key, meta) + v.versions.drop(key, 0) + int64(len(buf.B))
 
 	delete(v.index, key)
 
-	return nil
+	return v.point(v.writeOffset), v.appendIndex(indexEntry{
+		Key:        key,
+		NeedleMeta: delNeedle.Header.meta(offset),
+		Flag:       DeleteFlag,
+	})
 }
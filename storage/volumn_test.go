@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
 	rand2 "math/rand/v2"
 	"os"
@@ -11,6 +13,7 @@ import (
 	"testing"
 
 	errtype "github.com/peterouob/file_system/type"
+	"github.com/peterouob/file_system/utils"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -35,7 +38,8 @@ func TestWrite(t *testing.T) {
 	f := setup(t)
 	defer teardown(f, t)
 
-	volume := NewVolume(f)
+	volume, err := NewVolume(f)
+	require.NoError(t, err)
 	needle := &Needle{
 		Header: NeedleHeader{
 			Key:          1,
@@ -55,20 +59,20 @@ func TestWrite(t *testing.T) {
 	key := KeyPair{Key: 1, AltKey: 100}
 	metas := volume.index[key]
 
-	assert.Equal(t, int64(0), metas.Offset, "First offset should be 0")
+	assert.Equal(t, int64(SuperBlockSize), metas.Offset, "First offset should follow the superblock")
 	assert.Equal(t, uint32(4096), metas.Size, "Size should be data size only")
 
-	// header + data + footer + padding
-	// (29+ 4096 + 8 + n) % 8 = 0;total = 4136
-	expectedTotalSize := int64(4136)
-	assert.Equal(t, expectedTotalSize, volume.writeOffset, "Write offset calculation incorrect")
+	// v2 header + data + footer + padding
+	// (39+ 4096 + 8 + n) % 8 = 0;total = 4144
+	expectedTotalSize := int64(4144)
+	assert.Equal(t, SuperBlockSize+expectedTotalSize, volume.writeOffset, "Write offset calculation incorrect")
 
 	assert.NoError(t, volume.Write(needle))
 	metas = volume.index[key]
 
-	assert.Equal(t, expectedTotalSize, metas.Offset, "Second offset should start after first needle")
+	assert.Equal(t, SuperBlockSize+expectedTotalSize, metas.Offset, "Second offset should start after first needle")
 
-	assert.Equal(t, expectedTotalSize*2, volume.writeOffset, "Final write offset incorrect")
+	assert.Equal(t, SuperBlockSize+expectedTotalSize*2, volume.writeOffset, "Final write offset incorrect")
 }
 
 func setupTestVolume(t *testing.T) (*Volume, *os.File) {
@@ -79,7 +83,8 @@ func setupTestVolume(t *testing.T) (*Volume, *os.File) {
 	f, err := os.Create(vPath)
 	require.NoError(t, err)
 
-	v := NewVolume(f)
+	v, err := NewVolume(f)
+	require.NoError(t, err)
 	return v, f
 }
 
@@ -197,12 +202,322 @@ func TestVolume_Read(t *testing.T) {
 	})
 }
 
+// newNeedle returns a needle holding payload whose cookie is key * 10.
+func newNeedle(key uint64, payload string) *Needle {
+	return &Needle{
+		Header: NeedleHeader{
+			MagicHeader: MagicHeader,
+			Cookie:      key * 10,
+			Key:         key,
+			Size:        uint32(len(payload)),
+		},
+		Data: []byte(payload),
+		Footer: NeedleFooter{
+			MagicFooter: MagicFooter,
+		},
+	}
+}
+
+func TestVolume_WriteReadNeedle(t *testing.T) {
+	payload := string(bytes.Repeat([]byte("read back and written again "), 50))
+	key := StaticKey(utils.NewEncryptionKey())
+
+	for name, options := range map[string][]VolumeOption{
+		"Compressed": {WithCompression(FlateCodec)},
+		"Encrypted":  {WithEncryption(key), WithCompression(FlateCodec)},
+		"Dedup":      {WithDedup()},
+		"Versioned":  {WithVersioning(Retention{Versions: 2})},
+	} {
+		t.Run("Success_"+name, func(t *testing.T) {
+			f := setup(t)
+			defer teardown(f, t)
+			src, err := NewVolume(f, options...)
+			require.NoError(t, err)
+
+			require.NoError(t, src.Write(newNeedle(1, payload)))
+			require.NoError(t, src.Write(newNeedle(2, payload)))
+			read, err := src.ReadNeedle(KeyPair{Key: 2}, 20)
+			require.NoError(t, err)
+
+			plain, _ := setupTestVolume(t)
+			for _, v := range []*Volume{plain, src} {
+				n := *read
+				n.Header.Key = 3
+				require.NoError(t, v.Write(&n))
+
+				got, err := v.ReadNeedle(KeyPair{Key: 3}, 20)
+				require.NoError(t, err)
+				assert.Equal(t, payload, string(got.Data))
+				require.NoError(t, v.Reload())
+				data, err := v.Read(KeyPair{Key: 3}, 20)
+				require.NoError(t, err)
+				assert.Equal(t, payload, string(data))
+			}
+		})
+	}
+
+	t.Run("Success_SizeFromData", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+		n := newNeedle(1, "sized")
+		n.Header.Size = 1000
+		require.NoError(t, v.Write(n))
+
+		data, err := v.Read(KeyPair{Key: 1}, 10)
+		require.NoError(t, err)
+		assert.Equal(t, "sized", string(data))
+	})
+
+	t.Run("Success_FramingFromVolume", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+		require.NoError(t, v.Write(&Needle{Header: NeedleHeader{Key: 1, Cookie: 10}, Data: []byte("bare")}))
+
+		// a needle without its magic numbers set is framed by the volume
+		fi, err := f.Stat()
+		require.NoError(t, err)
+		report, err := CheckVolume(f, fi.Size(), func(CheckedNeedle) {})
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.Live)
+		assert.Zero(t, report.Corrupt)
+
+		reloaded, err := NewVolume(f)
+		require.NoError(t, err)
+		data, err := reloaded.Read(KeyPair{Key: 1}, 10)
+		require.NoError(t, err)
+		assert.Equal(t, "bare", string(data))
+	})
+}
+
+func TestVolume_Reload(t *testing.T) {
+	reopen := func(t *testing.T, f *os.File) *Volume {
+		t.Helper()
+		v, err := NewVolume(f)
+		require.NoError(t, err)
+		return v
+	}
+
+	t.Run("Success_RebuildIndex", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		require.NoError(t, v.Write(newNeedle(1, "first")))
+		require.NoError(t, v.Write(newNeedle(2, "second")))
+		require.NoError(t, v.Write(newNeedle(1, "first-overwrite")))
+
+		reloaded := reopen(t, f)
+		assert.Equal(t, v.index, reloaded.index)
+		assert.Equal(t, v.writeOffset, reloaded.writeOffset)
+
+		got, err := reloaded.Read(KeyPair{Key: 1}, 10)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("first-overwrite"), got)
+	})
+
+	t.Run("Success_ApplyTombstone", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		require.NoError(t, v.Write(newNeedle(1, "first")))
+
+		tombstone := newNeedle(1, "")
+		tombstone.Header.Flag = DeleteFlag
+		buf := tombstone.Bytes(v.bufferPool)
+		_, err := f.WriteAt(buf.B, v.writeOffset)
+		require.NoError(t, err)
+
+		reloaded := reopen(t, f)
+		_, err = reloaded.Read(KeyPair{Key: 1}, 10)
+		assert.ErrorIs(t, err, errtype.ErrNotFound)
+		assert.Equal(t, v.writeOffset+int64(len(buf.B)), reloaded.writeOffset)
+	})
+
+	t.Run("Success_TruncateTornTail", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		require.NoError(t, v.Write(newNeedle(1, "first")))
+		intact := v.writeOffset
+
+		buf := newNeedle(2, "half written needle").Bytes(v.bufferPool)
+		_, err := f.WriteAt(buf.B[:len(buf.B)/2], intact)
+		require.NoError(t, err)
+
+		reloaded := reopen(t, f)
+		assert.Equal(t, intact, reloaded.writeOffset)
+		assert.Len(t, reloaded.index, 1)
+
+		fi, err := f.Stat()
+		require.NoError(t, err)
+		assert.Equal(t, intact, fi.Size())
+	})
+
+	t.Run("Success_SkipCorruptNeedle", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		require.NoError(t, v.Write(newNeedle(1, "first")))
+		require.NoError(t, v.Write(newNeedle(2, "second")))
+
+		_, err := f.WriteAt([]byte{'X'}, v.index[KeyPair{Key: 1}].Offset+NeedleHeaderSize)
+		require.NoError(t, err)
+
+		reloaded := reopen(t, f)
+		assert.NotContains(t, reloaded.index, KeyPair{Key: 1})
+		assert.Contains(t, reloaded.index, KeyPair{Key: 2})
+		assert.Equal(t, v.writeOffset, reloaded.writeOffset)
+	})
+
+	t.Run("Success_SkipCorruptSize", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		for key := uint64(1); key <= 5; key++ {
+			require.NoError(t, v.Write(newNeedle(key, "payload")))
+		}
+
+		// a size running past the end of the file in the middle of the log
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, 1<<30)
+		_, err := f.WriteAt(size, v.index[KeyPair{Key: 2}].Offset+25)
+		require.NoError(t, err)
+
+		reloaded := reopen(t, f)
+		assert.NotContains(t, reloaded.index, KeyPair{Key: 2})
+		for _, key := range []uint64{1, 3, 4, 5} {
+			got, err := reloaded.Read(KeyPair{Key: key}, key*10)
+			require.NoError(t, err, "key %d", key)
+			assert.Equal(t, "payload", string(got))
+		}
+		assert.Equal(t, v.writeOffset, reloaded.writeOffset)
+
+		fi, err := f.Stat()
+		require.NoError(t, err)
+		assert.Equal(t, v.writeOffset, fi.Size())
+
+		report, err := CheckVolume(f, fi.Size(), func(CheckedNeedle) {})
+		require.NoError(t, err)
+		assert.Equal(t, 4, report.Live)
+		assert.Zero(t, report.TornBytes)
+	})
+
+	t.Run("Error_CorruptFraming", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		require.NoError(t, v.Write(newNeedle(1, "first")))
+		require.NoError(t, v.Write(newNeedle(2, "second")))
+
+		_, err := f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, SuperBlockSize)
+		require.NoError(t, err)
+
+		_, err = NewVolume(f)
+		assert.ErrorIs(t, err, errtype.ErrCorruptVolume)
+	})
+}
+
+func TestVolume_Delete(t *testing.T) {
+	t.Run("Success_MarkAndTombstone", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		require.NoError(t, v.Write(newNeedle(1, "first")))
+		require.NoError(t, v.Write(newNeedle(2, "second")))
+		meta := v.index[KeyPair{Key: 1}]
+		end := v.writeOffset
+
+		require.NoError(t, v.Delete(KeyPair{Key: 1}, 10))
+
+		_, err := v.Read(KeyPair{Key: 1}, 10)
+		assert.ErrorIs(t, err, errtype.ErrNotFound)
+		assert.Equal(t, end+needleLength(NeedleVersion2, 0, 0), v.writeOffset)
+		assert.Equal(t, meta.length()+needleLength(NeedleVersion2, 0, 0), v.garbage)
+
+		flag := make([]byte, 1)
+		_, err = f.ReadAt(flag, meta.Offset+24)
+		require.NoError(t, err)
+		assert.Equal(t, DeleteFlag, flag[0]&DeleteFlag)
+
+		// the flag is not covered by the CRC, the marked needle is still intact
+		res, err := scanNeedles(f, SuperBlockSize, v.writeOffset, v.bufferPool, func(needleRecord) error {
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Zero(t, res.Corrupt)
+		assert.False(t, res.Torn)
+
+		require.NoError(t, v.Close())
+		require.NoError(t, os.Remove(indexPath(f.Name())))
+
+		reloaded, err := NewVolume(f)
+		require.NoError(t, err)
+		assert.NotContains(t, reloaded.index, KeyPair{Key: 1})
+		assert.Contains(t, reloaded.index, KeyPair{Key: 2})
+		assert.Equal(t, v.garbage, reloaded.garbage)
+	})
+
+	t.Run("Success_LostTombstone", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		require.NoError(t, v.Write(newNeedle(1, "first")))
+		end := v.writeOffset
+		require.NoError(t, v.Delete(KeyPair{Key: 1}, 10))
+		require.NoError(t, v.Close())
+
+		// the flag set in place is enough to keep the key deleted
+		require.NoError(t, f.Truncate(end))
+
+		reloaded, err := NewVolume(f)
+		require.NoError(t, err)
+		assert.Empty(t, reloaded.index)
+		assert.Equal(t, end, reloaded.writeOffset)
+	})
+
+	t.Run("Success_WriteAfterDelete", func(t *testing.T) {
+		v, f := setupTestVolume(t)
+
+		require.NoError(t, v.Write(newNeedle(1, "first")))
+		require.NoError(t, v.Delete(KeyPair{Key: 1}, 10))
+		require.NoError(t, v.Write(newNeedle(1, "again")))
+		require.NoError(t, v.Close())
+		require.NoError(t, os.Remove(indexPath(f.Name())))
+
+		reloaded, err := NewVolume(f)
+		require.NoError(t, err)
+		got, err := reloaded.Read(KeyPair{Key: 1}, 10)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("again"), got)
+	})
+
+	t.Run("Success_SealedVolume", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+
+		require.NoError(t, v.Write(newNeedle(1, "first")))
+		require.NoError(t, v.Seal())
+		require.NoError(t, v.Delete(KeyPair{Key: 1}, 10))
+		assert.Empty(t, v.index)
+	})
+
+	t.Run("Error_NotFound", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+		end := v.writeOffset
+
+		assert.ErrorIs(t, v.Delete(KeyPair{Key: 1}, 10), errtype.ErrNotFound)
+		assert.Equal(t, end, v.writeOffset)
+	})
+
+	t.Run("Error_Cookie", func(t *testing.T) {
+		v, _ := setupTestVolume(t)
+
+		require.NoError(t, v.Write(newNeedle(1, "first")))
+		end := v.writeOffset
+
+		assert.ErrorIs(t, v.Delete(KeyPair{Key: 1}, 11), errtype.ErrCookie)
+		assert.Equal(t, end, v.writeOffset)
+
+		got, err := v.Read(KeyPair{Key: 1}, 10)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("first"), got)
+	})
+}
+
 const (
 	BenchPayloadSize = 4096
 	BenchFileCount   = 10000
 )
 
-func setupTempVolume(tb testing.TB) (*Volume, string, func()) {
+func setupTempVolume(tb testing.TB, options ...VolumeOption) (*Volume, string, func()) {
 	tb.Helper()
 	tmpDir := tb.TempDir()
 	vPath := filepath.Join(tmpDir, "bench.vol")
@@ -210,7 +525,8 @@ func setupTempVolume(tb testing.TB) (*Volume, string, func()) {
 	f, err := os.Create(vPath)
 	require.NoError(tb, err)
 
-	v := NewVolume(f)
+	v, err := NewVolume(f, options...)
+	require.NoError(tb, err)
 
 	cleanup := func() {
 		_ = f.Close()
@@ -281,6 +597,51 @@ func BenchmarkHaystack_Write(b *testing.B) {
 	})
 }
 
+func BenchmarkHaystack_WriteDurability(b *testing.B) {
+	ctx, task := trace.NewTask(context.Background(), "TASK_Haystack_WriteDurability")
+	defer task.End()
+
+	for _, d := range []Durability{DurabilityNone, DurabilitySync, DurabilityGroupCommit} {
+		b.Run(d.String()+"/Serial", func(b *testing.B) {
+			region := trace.StartRegion(ctx, "REGION_Serial_Write_"+d.String())
+			defer region.End()
+			v, _, cleanup := setupTempVolume(b, WithDurability(d))
+			defer cleanup()
+
+			sampleNeedle := newRandomNeedle(1, BenchPayloadSize)
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				sampleNeedle.Header.Key = uint64(i)
+				err := v.Write(sampleNeedle)
+				assert.NoError(b, err)
+			}
+		})
+
+		b.Run(d.String()+"/Parallel", func(b *testing.B) {
+			region := trace.StartRegion(ctx, "REGION_Parallel_Write_"+d.String())
+			defer region.End()
+			v, _, cleanup := setupTempVolume(b, WithDurability(d))
+			defer cleanup()
+
+			b.ResetTimer()
+
+			var i atomic.Uint64
+
+			b.RunParallel(func(pb *testing.PB) {
+				localNeedle := newRandomNeedle(0, BenchPayloadSize)
+
+				for pb.Next() {
+					localNeedle.Header.Key = i.Add(1)
+					err := v.Write(localNeedle)
+					assert.NoError(b, err)
+				}
+			})
+		})
+	}
+}
+
 func BenchmarkOS_Write(b *testing.B) {
 
 	ctx, task := trace.NewTask(context.Background(), "BenchmarkOS_Write")
@@ -10,8 +10,21 @@ var (
 	ErrMagicNumber    = errors.New("error for file magic number")
 	ErrCookie         = errors.New("error for file cookie")
 	ErrDataDeleted    = errors.New("error for file data is deleted")
+	ErrExpired        = errors.New("error for file data is expired")
 	ErrCrcNotValid    = errors.New("error for file crc not valid")
 	ErrBufferTooSmall = errors.New("error for file buffer too small")
+	ErrCorruptVolume  = errors.New("error for volume file corrupted")
+	ErrSuperBlock     = errors.New("error for volume superblock not valid")
+	ErrVolumeVersion  = errors.New("error for volume format not supported")
+	ErrVolumeSealed   = errors.New("error for volume sealed or full")
+	ErrReadOnly       = errors.New("error for volume opened read only")
+	ErrAttribute      = errors.New("error for needle attributes not valid")
+	ErrNeedleFlag     = errors.New("error for needle flag reserved by the volume")
+	ErrCodec          = errors.New("error for needle codec unknown or failed")
+	ErrEncryption     = errors.New("error for needle key unknown or seal not valid")
+	ErrArchive        = errors.New("error for volume archive not valid")
+	ErrInvalidKey     = errors.New("error for store key not valid")
+	ErrRange          = errors.New("error for read range outside the data")
 
 	ErrToLarge = errors.New("too large")
 )